@@ -20,14 +20,14 @@ func NewProxyCommand(startFunc func(providerType string, configFile string)) *co
 	option := &Option{}
 	cmd := &cobra.Command{
 		Use:   "acproxy",
-		Short: "acproxy is a proxy interacting with active hdfs",
-		Long:  "a proxy aims to interact with Hadoop clusters, which supports hdfs temporarily",
+		Short: "acproxy is a proxy interacting with active hdfs or yarn",
+		Long:  "a proxy aims to interact with Hadoop clusters, which supports hdfs and yarn temporarily",
 		Run: func(cmd *cobra.Command, args []string) {
 			startFunc(option.ProviderType, option.ConfigFile)
 		},
 	}
 	cmd.Flags().StringVarP(&option.ConfigFile, "config_file", "c", CONFIG_FILE_DEFAULT, "location of config file")
-	cmd.Flags().StringVarP(&option.ProviderType, "type", "t", PROVIDER_TYPE_DEFAULT, "proxy provider type chosen in {hdfs}")
+	cmd.Flags().StringVarP(&option.ProviderType, "type", "t", PROVIDER_TYPE_DEFAULT, "proxy provider type chosen in {hdfs, yarn}")
 	cmd.Flags().AddGoFlagSet(flag.CommandLine)
 	flag.CommandLine.Parse(nil)
 	return cmd
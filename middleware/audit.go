@@ -0,0 +1,204 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// AuditFormatHdfs writes lines like hdfs-audit.log, tab separated key=value
+	AuditFormatHdfs = "hdfs"
+	AuditFormatJson = "json"
+
+	auditLogName    = "acproxy-audit.log"
+	hdfsAuditTime   = "2006-01-02 15:04:05,000"
+	auditNullValue  = "null"
+	auditAnonymous  = "anonymous"
+	auditSimpleAuth = "SIMPLE"
+)
+
+type AuditConf struct {
+	Dir            string `description:"directory of audit logs, empty disables audit"`
+	Format         string `description:"hdfs or json, hdfs if empty"`
+	MaxSize        int64  `description:"bytes of a log file before it is rotated, 0 disables size based rotation"`
+	RotateInterval int    `description:"ms a log file is written before it is rotated, 0 disables time based rotation"`
+	MaxBackups     int    `description:"rotated files kept, 0 keeps all"`
+}
+
+// AuditRecord is one proxied request, fields unknown to the proxy are empty
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Allowed  bool      `json:"allowed"`
+	Ugi      string    `json:"ugi"`
+	Ip       string    `json:"ip"`
+	Cmd      string    `json:"cmd"`
+	Src      string    `json:"src"`
+	Dst      string    `json:"dst"`
+	Upstream string    `json:"upstream"`
+	Retries  int       `json:"retries"`
+	Status   int       `json:"status"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+}
+
+// AuditMiddleware writes one record per request once it is served, it is put before authentication
+// so that refused requests are recorded as well
+type AuditMiddleware struct {
+	format string
+	out    io.Writer
+}
+
+// NewAuditMiddleware returns nil if no directory is configured
+func NewAuditMiddleware(conf AuditConf) (*AuditMiddleware, error) {
+	if len(conf.Dir) == 0 {
+		return nil, nil
+	}
+	format := strings.ToLower(conf.Format)
+	if len(format) == 0 {
+		format = AuditFormatHdfs
+	}
+	if format != AuditFormatHdfs && format != AuditFormatJson {
+		return nil, fmt.Errorf("invalid audit format %s, expect %s or %s", conf.Format, AuditFormatHdfs, AuditFormatJson)
+	}
+	out, err := util.NewRotatingFile(conf.Dir, auditLogName, conf.MaxSize,
+		time.Millisecond*time.Duration(conf.RotateInterval), conf.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log under %s: %s", conf.Dir, err.Error())
+	}
+	return &AuditMiddleware{format: format, out: out}, nil
+}
+
+func (m *AuditMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	begin := time.Now()
+	r, info := util.WithRequestInfo(r)
+	var body *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+	recorder := &auditResponseWriter{ResponseWriter: rw}
+	next(recorder, r)
+
+	record := newAuditRecord(r, info, begin)
+	record.Status = recorder.statusCode
+	if record.Status == 0 {
+		record.Status = http.StatusOK
+	}
+	record.Allowed = record.Status != http.StatusUnauthorized && record.Status != http.StatusForbidden
+	record.BytesOut = recorder.written
+	if body != nil {
+		record.BytesIn = body.read
+	}
+	if _, err := io.WriteString(m.out, m.formatRecord(record)); err != nil {
+		glog.Errorf("Write audit record of %s fails: %s", r.URL.String(), err.Error())
+	}
+}
+
+func newAuditRecord(r *http.Request, info *util.RequestInfo, begin time.Time) *AuditRecord {
+	record := &AuditRecord{
+		Time:     begin,
+		Ugi:      auditUgi(r, info.Principal),
+		Ip:       util.ClientAddress(r),
+		Upstream: info.Upstream,
+	}
+	if info.Attempts > 1 {
+		record.Retries = info.Attempts - 1
+	}
+	if r.URL == nil {
+		return record
+	}
+	query := r.URL.Query()
+	if urlPath := relayedUrlPath(r.URL.Path); strings.HasPrefix(urlPath, util.WebHdfsPathPrefix) {
+		record.Src = path.Clean("/" + strings.TrimPrefix(urlPath, util.WebHdfsPathPrefix))
+		record.Cmd = strings.ToUpper(query.Get("op"))
+		record.Dst = query.Get("destination")
+	} else {
+		// yarn rest and other requests are recorded by method and path
+		record.Src = r.URL.Path
+		record.Cmd = r.Method
+	}
+	return record
+}
+
+// auditUgi describes the caller as hadoop does, e.g. "bob (auth:PROXY) via alice (auth:JWT)" for alice acting as bob
+func auditUgi(r *http.Request, principal *util.Principal) string {
+	if principal == nil {
+		user := util.WebHdfsUser(r)
+		if len(user) == 0 {
+			user = auditAnonymous
+		}
+		return fmt.Sprintf("%s (auth:%s)", user, auditSimpleAuth)
+	}
+	real := fmt.Sprintf("%s (auth:%s)", principal.User, strings.ToUpper(principal.Mechanism))
+	if doas := util.WebHdfsUser(r); doas != principal.User && r.URL.Query().Get("doas") == doas {
+		return fmt.Sprintf("%s (auth:PROXY) via %s", doas, real)
+	}
+	return real
+}
+
+// hdfs audit lines are split by tabs and newlines, which are escaped in values
+var auditValueEscaper = strings.NewReplacer("\t", "\\t", "\n", "\\n", "\r", "\\r")
+
+func (m *AuditMiddleware) formatRecord(record *AuditRecord) string {
+	if m.format == AuditFormatJson {
+		data, _ := json.Marshal(record)
+		return string(data) + "\n"
+	}
+	value := func(s string) string {
+		if len(s) == 0 {
+			return auditNullValue
+		}
+		return auditValueEscaper.Replace(s)
+	}
+	return fmt.Sprintf("%s INFO acproxy.audit: allowed=%t\tugi=%s\tip=/%s\tcmd=%s\tsrc=%s\tdst=%s\tupstream=%s\tretries=%d\tstatus=%d\tbytesIn=%d\tbytesOut=%d\tproto=webhdfs\n",
+		record.Time.Format(hdfsAuditTime), record.Allowed, value(record.Ugi), value(record.Ip), value(record.Cmd),
+		value(record.Src), value(record.Dst), value(record.Upstream), record.Retries, record.Status, record.BytesIn, record.BytesOut)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	reader.read += int64(n)
+	return n, err
+}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	written    int64
+}
+
+func (w *auditResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *auditResponseWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *auditResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
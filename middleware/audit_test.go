@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal("TestAuditMiddleware:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewAuditMiddleware(AuditConf{Dir: dir})
+	if err != nil {
+		t.Fatal("TestAuditMiddleware:", err.Error())
+	}
+	// alice authenticated by jwt renames for bob, the first attempt fails over
+	r := httptest.NewRequest("PUT", "/webhdfs/v1/tmp/a?op=RENAME&destination=/tmp/b&doas=bob", strings.NewReader("ignored"))
+	r.RemoteAddr = "10.0.0.1:50000"
+	m.ServeHTTP(httptest.NewRecorder(), r, func(rw http.ResponseWriter, r *http.Request) {
+		r = util.WithPrincipal(r, &util.Principal{User: "alice", Mechanism: AuthBackendJwt})
+		ioutil.ReadAll(r.Body)
+		info := util.RequestInfoOf(r)
+		info.Attempts = 2
+		info.Upstream = "nn2:9870"
+		rw.Write([]byte(`{"boolean":true}`))
+	})
+	// anonymous requests refused by authentication are recorded as well
+	r = httptest.NewRequest("GET", "/_datanode/dn1:9864/webhdfs/v1/tmp/a?op=OPEN", nil)
+	m.ServeHTTP(httptest.NewRecorder(), r, func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	})
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, auditLogName))
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.True(t, strings.HasSuffix(lines[0], "INFO acproxy.audit: allowed=true\tugi=bob (auth:PROXY) via alice (auth:JWT)\tip=/10.0.0.1"+
+		"\tcmd=RENAME\tsrc=/tmp/a\tdst=/tmp/b\tupstream=nn2:9870\tretries=1\tstatus=200\tbytesIn=7\tbytesOut=16\tproto=webhdfs"), lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], "allowed=false\tugi=anonymous (auth:SIMPLE)\tip=/192.0.2.1"+
+		"\tcmd=OPEN\tsrc=/tmp/a\tdst=null\tupstream=null\tretries=0\tstatus=401\tbytesIn=0\tbytesOut=0\tproto=webhdfs"), lines[1])
+
+	_, err = NewAuditMiddleware(AuditConf{Dir: dir, Format: "xml"})
+	assert.NotNil(t, err)
+}
+
+func TestAuditJsonRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal("TestAuditJsonRotation:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// every record outgrows the size, and only two rotated files are kept
+	m, err := NewAuditMiddleware(AuditConf{Dir: dir, Format: AuditFormatJson, MaxSize: 10, MaxBackups: 2})
+	if err != nil {
+		t.Fatal("TestAuditJsonRotation:", err.Error())
+	}
+	for _, user := range []string{"u1", "u2", "u3", "u4"} {
+		r := httptest.NewRequest("GET", "/webhdfs/v1/tmp?op=LISTSTATUS&user.name="+user, nil)
+		m.ServeHTTP(httptest.NewRecorder(), r, func(http.ResponseWriter, *http.Request) {})
+	}
+
+	backups, _ := filepath.Glob(filepath.Join(dir, auditLogName+".*"))
+	assert.Equal(t, 2, len(backups))
+	data, _ := ioutil.ReadFile(filepath.Join(dir, auditLogName))
+	record := &AuditRecord{}
+	assert.Nil(t, json.Unmarshal(data, record))
+	assert.Equal(t, "u4 (auth:SIMPLE)", record.Ugi)
+	assert.Equal(t, "LISTSTATUS", record.Cmd)
+	assert.Equal(t, http.StatusOK, record.Status)
+}
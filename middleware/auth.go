@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+)
+
+const (
+	AuthBackendToken  = "token"
+	AuthBackendBasic  = "basic"
+	AuthBackendJwt    = "jwt"
+	AuthBackendSpnego = "spnego"
+	AuthBackendCert   = "cert"
+)
+
+// ErrNoCredentials is returned by authenticators for requests carrying none of their credentials,
+// the next authenticator is tried then
+var ErrNoCredentials = errors.New("no credentials")
+
+type Authenticator interface {
+	// Challenge is the WWW-Authenticate value asking for credentials of the backend
+	Challenge() string
+	// Authenticate returns ErrNoCredentials if r carries no credentials of the backend,
+	// and other errors if the credentials are invalid
+	Authenticate(r *http.Request) (*util.Principal, error)
+}
+
+type AuthConf struct {
+	Backends           []string          `description:"authenticators tried in order, empty disables authentication"`
+	Tokens             map[string]string `description:"static bearer token to user"`
+	HtpasswdFile       string
+	JwksFile           string
+	JwtIssuer          string
+	JwtAudience        string
+	JwtUserClaim       string
+	JwtGroupsClaim     string
+	SpnegoKeytab       string
+	SpnegoPrincipal    string   `description:"service principal in keytab, any one matching the ticket if empty"`
+	CertSubjectPattern string   `description:"regexp whose first group takes user from client certificate subject, common name if empty"`
+	DoasUsers          []string `description:"users allowed to act for others through doas"`
+}
+
+// AuthMiddleware authenticates inbound requests, and sets user.name of the request to the authenticated user
+type AuthMiddleware struct {
+	authenticators []Authenticator
+	doasUsers      map[string]bool
+}
+
+// NewAuthMiddleware returns nil if no backend is configured
+func NewAuthMiddleware(conf AuthConf) (*AuthMiddleware, error) {
+	if len(conf.Backends) == 0 {
+		return nil, nil
+	}
+	m := &AuthMiddleware{doasUsers: make(map[string]bool)}
+	for _, user := range conf.DoasUsers {
+		m.doasUsers[user] = true
+	}
+	for _, backend := range conf.Backends {
+		var authenticator Authenticator
+		var err error
+		switch backend {
+		case AuthBackendToken:
+			authenticator, err = newTokenAuthenticator(conf.Tokens)
+		case AuthBackendBasic:
+			authenticator, err = newBasicAuthenticator(conf.HtpasswdFile)
+		case AuthBackendJwt:
+			authenticator, err = newJwtAuthenticator(conf.JwksFile, conf.JwtIssuer, conf.JwtAudience, conf.JwtUserClaim, conf.JwtGroupsClaim)
+		case AuthBackendSpnego:
+			authenticator, err = newSpnegoAuthenticator(conf.SpnegoKeytab, conf.SpnegoPrincipal)
+		case AuthBackendCert:
+			authenticator, err = newCertAuthenticator(conf.CertSubjectPattern)
+		default:
+			err = fmt.Errorf("unknown backend, expect %s, %s, %s, %s or %s",
+				AuthBackendToken, AuthBackendBasic, AuthBackendJwt, AuthBackendSpnego, AuthBackendCert)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("init %s authentication: %s", backend, err.Error())
+		}
+		m.authenticators = append(m.authenticators, authenticator)
+	}
+	return m, nil
+}
+
+func (m *AuthMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	for _, authenticator := range m.authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		if err != nil {
+			glog.V(1).Infof("Request %s from %s fails authentication: %s", r.URL.String(), r.RemoteAddr, err.Error())
+			m.unauthorized(rw, "authentication failed")
+			return
+		}
+		authenticated, err := m.actAs(r, principal)
+		if err != nil {
+			glog.V(1).Infof("Request %s of %s is refused: %s", r.URL.String(), principal.Name, err.Error())
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+		next(rw, authenticated)
+		return
+	}
+	m.unauthorized(rw, "authentication required")
+}
+
+// actAs overwrites user.name with the authenticated user, doas is passed on only for users allowed to act for others;
+// credentials of the client are dropped, upstream servers are reached with those of the proxy if any
+func (m *AuthMiddleware) actAs(r *http.Request, principal *util.Principal) (*http.Request, error) {
+	authenticated := util.WithPrincipal(r, principal)
+	authenticated.Header = r.Header.Clone()
+	authenticated.Header.Del("Authorization")
+	authenticated.Header.Del("Proxy-Authorization")
+	if r.URL == nil {
+		return authenticated, nil
+	}
+	url := *r.URL
+	query := url.Query()
+	if doas := query.Get("doas"); len(doas) > 0 && doas != principal.User && !m.doasUsers[principal.User] {
+		return nil, fmt.Errorf("user %s is not allowed to act for %s", principal.User, doas)
+	}
+	query.Set("user.name", principal.User)
+	url.RawQuery = query.Encode()
+	authenticated.URL = &url
+	authenticated.RequestURI = url.RequestURI()
+	return authenticated, nil
+}
+
+func (m *AuthMiddleware) unauthorized(rw http.ResponseWriter, message string) {
+	challenges := make(map[string]bool)
+	for _, authenticator := range m.authenticators {
+		if challenge := authenticator.Challenge(); len(challenge) > 0 && !challenges[challenge] {
+			challenges[challenge] = true
+			rw.Header().Add("WWW-Authenticate", challenge)
+		}
+	}
+	http.Error(rw, message, http.StatusUnauthorized)
+}
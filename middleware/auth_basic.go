@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"active-proxy/util"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// basicAuthenticator checks http basic credentials against an htpasswd file,
+// entries hashed with bcrypt ($2y$), apr1 md5 ($apr1$) or sha1 ({SHA}) are supported
+type basicAuthenticator struct {
+	hashes map[string]string
+}
+
+func newBasicAuthenticator(htpasswdFile string) (*basicAuthenticator, error) {
+	if len(htpasswdFile) == 0 {
+		return nil, fmt.Errorf("htpasswd file is not configured")
+	}
+	file, err := os.Open(htpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	authenticator := &basicAuthenticator{hashes: make(map[string]string)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		index := strings.Index(line, ":")
+		if index <= 0 {
+			return nil, fmt.Errorf("invalid htpasswd line %q", line)
+		}
+		authenticator.hashes[line[:index]] = line[index+1:]
+	}
+	return authenticator, scanner.Err()
+}
+
+func (authenticator *basicAuthenticator) Challenge() string {
+	return `Basic realm="acproxy"`
+}
+
+func (authenticator *basicAuthenticator) Authenticate(r *http.Request) (*util.Principal, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	hash, ok := authenticator.hashes[user]
+	if !ok || !checkHtpasswd(hash, password) {
+		return nil, fmt.Errorf("wrong user or password of %s", user)
+	}
+	return &util.Principal{Name: user, User: user, Mechanism: AuthBackendBasic}, nil
+}
+
+func checkHtpasswd(hash string, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.SplitN(hash, "$", 4)
+		return len(parts) == 4 && subtle.ConstantTimeCompare([]byte(apr1(password, parts[2])), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte("{SHA}"+base64.StdEncoding.EncodeToString(sum[:])), []byte(hash)) == 1
+	}
+	// plain text and crypt(3) entries are refused
+	return false
+}
+
+// apr1 is the md5 crypt variant of apache htpasswd
+func apr1(password string, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + magic + salt))
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alternate[:])
+		} else {
+			h.Write(alternate[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write([]byte(password[:1]))
+		}
+	}
+	final := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write([]byte(password))
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write([]byte(password))
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write([]byte(password))
+		}
+		final = h.Sum(nil)
+	}
+
+	var encoded []byte
+	encode := func(value uint32, n int) {
+		for ; n > 0; n-- {
+			encoded = append(encoded, itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[group[0]])<<16|uint32(final[group[1]])<<8|uint32(final[group[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return magic + salt + "$" + string(encoded)
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"active-proxy/util"
+)
+
+// certAuthenticator takes the subject of a verified client certificate (mutual tls) as principal,
+// the user is the common name, or the first group of pattern matched against the subject (CN=alice,OU=data,O=Example)
+type certAuthenticator struct {
+	pattern *regexp.Regexp
+}
+
+func newCertAuthenticator(pattern string) (*certAuthenticator, error) {
+	authenticator := &certAuthenticator{}
+	if len(pattern) > 0 {
+		var err error
+		if authenticator.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+		if authenticator.pattern.NumSubexp() < 1 {
+			return nil, fmt.Errorf("subject pattern %s has no group to take user from", pattern)
+		}
+	}
+	return authenticator, nil
+}
+
+// Challenge is empty since certificates are asked for by the tls handshake
+func (authenticator *certAuthenticator) Challenge() string {
+	return ""
+}
+
+func (authenticator *certAuthenticator) Authenticate(r *http.Request) (*util.Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	user := subject.CommonName
+	if authenticator.pattern != nil {
+		matches := authenticator.pattern.FindStringSubmatch(subject.String())
+		if matches == nil {
+			return nil, fmt.Errorf("certificate subject %s does not match %s", subject.String(), authenticator.pattern.String())
+		}
+		user = matches[1]
+	}
+	if len(user) == 0 {
+		return nil, fmt.Errorf("no user is found in certificate subject %s", subject.String())
+	}
+	return &util.Principal{Name: subject.String(), User: user, Mechanism: AuthBackendCert}, nil
+}
@@ -0,0 +1,255 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"active-proxy/util"
+)
+
+const (
+	jwtUserClaimDefault   = "sub"
+	jwtGroupsClaimDefault = "groups"
+	jwtLeeway             = time.Minute
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// jwtAuthenticator validates bearer jwts signed with RS*, PS* or ES* against keys of a local jwks file
+type jwtAuthenticator struct {
+	keys        []jwtKey
+	issuer      string
+	audience    string
+	userClaim   string
+	groupsClaim string
+}
+
+func newJwtAuthenticator(jwksFile string, issuer string, audience string, userClaim string, groupsClaim string) (*jwtAuthenticator, error) {
+	if len(jwksFile) == 0 {
+		return nil, fmt.Errorf("jwks file is not configured")
+	}
+	data, err := ioutil.ReadFile(jwksFile)
+	if err != nil {
+		return nil, err
+	}
+	jwks := &struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, jwks); err != nil {
+		return nil, fmt.Errorf("parse jwks %s: %s", jwksFile, err.Error())
+	}
+
+	authenticator := &jwtAuthenticator{issuer: issuer, audience: audience, userClaim: userClaim, groupsClaim: groupsClaim}
+	if len(authenticator.userClaim) == 0 {
+		authenticator.userClaim = jwtUserClaimDefault
+	}
+	if len(authenticator.groupsClaim) == 0 {
+		authenticator.groupsClaim = jwtGroupsClaimDefault
+	}
+	for _, key := range jwks.Keys {
+		publicKey, err := key.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %s of jwks %s: %s", key.Kid, jwksFile, err.Error())
+		}
+		authenticator.keys = append(authenticator.keys, jwtKey{kid: key.Kid, alg: key.Alg, key: publicKey})
+	}
+	if len(authenticator.keys) == 0 {
+		return nil, fmt.Errorf("no key is found in jwks %s", jwksFile)
+	}
+	return authenticator, nil
+}
+
+func (key *jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		return new(big.Int).SetBytes(data), err
+	}
+	switch key.Kty {
+	case "RSA":
+		n, err := decode(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[key.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", key.Crv)
+		}
+		x, err := decode(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", key.Kty)
+}
+
+func (authenticator *jwtAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
+// Authenticate leaves bearer tokens which do not look like jwts to other bearer backends
+func (authenticator *jwtAuthenticator) Authenticate(r *http.Request) (*util.Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok || strings.Count(token, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+	parts := strings.Split(token, ".")
+	header := &struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJwtPart(parts[0], header); err != nil {
+		return nil, fmt.Errorf("invalid jwt header: %s", err.Error())
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt signature: %s", err.Error())
+	}
+	if err := authenticator.verify(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid jwt claims: %s", err.Error())
+	}
+	if err := authenticator.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	user, ok := claims[authenticator.userClaim].(string)
+	if !ok || len(user) == 0 {
+		return nil, fmt.Errorf("jwt lacks claim %s", authenticator.userClaim)
+	}
+	principal := &util.Principal{Name: user, User: user, Mechanism: AuthBackendJwt}
+	switch groups := claims[authenticator.groupsClaim].(type) {
+	case []interface{}:
+		for _, group := range groups {
+			principal.Groups = append(principal.Groups, fmt.Sprint(group))
+		}
+	case string:
+		principal.Groups = strings.Fields(strings.Replace(groups, ",", " ", -1))
+	}
+	return principal, nil
+}
+
+func decodeJwtPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verify tries keys matching kid (all keys if kid is absent) of the type alg asks for
+func (authenticator *jwtAuthenticator) verify(alg string, kid string, signed []byte, signature []byte) error {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if len(alg) != 5 || hashes[alg[2:]] == 0 {
+		return fmt.Errorf("unsupported jwt alg %s", alg)
+	}
+	hash := hashes[alg[2:]]
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	for _, key := range authenticator.keys {
+		if (len(kid) > 0 && key.kid != kid) || (len(key.alg) > 0 && key.alg != alg) {
+			continue
+		}
+		var err error
+		switch publicKey := key.key.(type) {
+		case *rsa.PublicKey:
+			switch alg[:2] {
+			case "RS":
+				err = rsa.VerifyPKCS1v15(publicKey, hash, digest, signature)
+			case "PS":
+				err = rsa.VerifyPSS(publicKey, hash, digest, signature, nil)
+			default:
+				continue
+			}
+		case *ecdsa.PublicKey:
+			size := (publicKey.Curve.Params().BitSize + 7) / 8
+			if alg[:2] != "ES" || len(signature) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(publicKey, digest, r, s) {
+				err = fmt.Errorf("ecdsa verification error")
+			}
+		default:
+			continue
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("jwt signature (alg %s, kid %s) is not verified by any key", alg, kid)
+}
+
+func (authenticator *jwtAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("jwt lacks exp")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return fmt.Errorf("jwt expired at %s", time.Unix(int64(exp), 0))
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("jwt is not valid before %s", time.Unix(int64(nbf), 0))
+	}
+	if len(authenticator.issuer) > 0 && claims["iss"] != authenticator.issuer {
+		return fmt.Errorf("jwt is issued by %v instead of %s", claims["iss"], authenticator.issuer)
+	}
+	if len(authenticator.audience) > 0 {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == authenticator.audience
+		case []interface{}:
+			for _, value := range aud {
+				found = found || value == authenticator.audience
+			}
+		}
+		if !found {
+			return fmt.Errorf("jwt is not issued to %s", authenticator.audience)
+		}
+	}
+	return nil
+}
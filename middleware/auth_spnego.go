@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"active-proxy/util"
+
+	"github.com/jcmturner/goidentity/v6"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// spnegoAuthenticator accepts kerberos tickets of the service principals in keytab
+type spnegoAuthenticator struct {
+	keytab    *keytab.Keytab
+	principal string
+}
+
+func newSpnegoAuthenticator(keytabFile string, principal string) (*spnegoAuthenticator, error) {
+	if len(keytabFile) == 0 {
+		return nil, fmt.Errorf("spnego keytab is not configured")
+	}
+	kt, err := keytab.Load(keytabFile)
+	if err != nil {
+		return nil, fmt.Errorf("load keytab %s: %s", keytabFile, err.Error())
+	}
+	return &spnegoAuthenticator{keytab: kt, principal: principal}, nil
+}
+
+func (authenticator *spnegoAuthenticator) Challenge() string {
+	return "Negotiate"
+}
+
+// Authenticate runs the spnego handler of gokrb5 against a discarded response,
+// the identity reaches the inner handler only if the ticket is accepted
+func (authenticator *spnegoAuthenticator) Authenticate(r *http.Request) (*util.Principal, error) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Negotiate ") {
+		return nil, ErrNoCredentials
+	}
+	var identity goidentity.Identity
+	inner := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		identity = goidentity.FromHTTPRequestContext(r)
+	})
+	var settings []func(*service.Settings)
+	if len(authenticator.principal) > 0 {
+		settings = append(settings, service.KeytabPrincipal(authenticator.principal))
+	}
+	spnego.SPNEGOKRB5Authenticate(inner, authenticator.keytab, settings...).ServeHTTP(&discardResponseWriter{header: make(http.Header)}, r)
+	if identity == nil || !identity.Authenticated() {
+		return nil, fmt.Errorf("spnego ticket is refused")
+	}
+
+	// alice/host@EXAMPLE.COM acts as alice, like the default auth_to_local rule of hadoop
+	user := identity.UserName()
+	if index := strings.Index(user, "/"); index > 0 {
+		user = user[:index]
+	}
+	return &util.Principal{Name: identity.UserName() + "@" + identity.Domain(), User: user, Mechanism: AuthBackendSpnego}, nil
+}
+
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (rw *discardResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (rw *discardResponseWriter) WriteHeader(int) {}
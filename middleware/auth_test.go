@@ -0,0 +1,223 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func tempFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "auth")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	file.WriteString(content)
+	file.Close()
+	return file.Name()
+}
+
+// serve runs r through m, and returns the response and the request reaching the proxy handler (nil if refused)
+func serve(m *AuthMiddleware, r *http.Request) (*httptest.ResponseRecorder, *http.Request) {
+	var passed *http.Request
+	rw := httptest.NewRecorder()
+	m.ServeHTTP(rw, r, func(rw http.ResponseWriter, r *http.Request) {
+		passed = r
+	})
+	return rw, passed
+}
+
+func TestTokenAndBasicAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	htpasswd := tempFile(t, "# users\n"+
+		"alice:"+string(hash)+"\n"+
+		"bob:$apr1$saltsalt$11QAx5Oiaores.cTy1Ple.\n"+
+		"carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+	defer os.Remove(htpasswd)
+	m, err := NewAuthMiddleware(AuthConf{
+		Backends:     []string{AuthBackendToken, AuthBackendBasic},
+		Tokens:       map[string]string{"t0ken": "etl"},
+		HtpasswdFile: htpasswd,
+		DoasUsers:    []string{"etl"},
+	})
+	if err != nil {
+		t.Fatal("TestTokenAndBasicAuth:", err.Error())
+	}
+
+	r := httptest.NewRequest("GET", "/webhdfs/v1/tmp?op=LISTSTATUS&user.name=hdfs&doas=alice", nil)
+	r.Header.Set("Authorization", "Bearer t0ken")
+	_, passed := serve(m, r)
+	assert.Equal(t, "doas=alice&op=LISTSTATUS&user.name=etl", passed.URL.RawQuery)
+	assert.Equal(t, &util.Principal{Name: "etl", User: "etl", Mechanism: AuthBackendToken}, util.RequestPrincipal(passed))
+
+	for user, password := range map[string]string{"alice": "secret", "bob": "p@ss word", "carol": "password"} {
+		r = httptest.NewRequest("GET", "/webhdfs/v1/tmp?op=LISTSTATUS&user.name=hdfs", nil)
+		r.SetBasicAuth(user, password)
+		rw, passed := serve(m, r)
+		if assert.NotNil(t, passed, user) {
+			assert.Equal(t, "op=LISTSTATUS&user.name="+user, passed.URL.RawQuery)
+		}
+		assert.Equal(t, http.StatusOK, rw.Code)
+
+		r.SetBasicAuth(user, password+"x")
+		rw, passed = serve(m, r)
+		assert.Nil(t, passed)
+		assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	}
+
+	// only users allowed to act for others may pass doas
+	r = httptest.NewRequest("GET", "/webhdfs/v1/tmp?op=LISTSTATUS&doas=hdfs", nil)
+	r.SetBasicAuth("alice", "secret")
+	rw, passed := serve(m, r)
+	assert.Nil(t, passed)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	r = httptest.NewRequest("GET", "/webhdfs/v1/tmp?op=LISTSTATUS", nil)
+	r.Header.Set("Authorization", "Bearer unknown")
+	rw, passed = serve(m, r)
+	assert.Nil(t, passed)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, []string{"Bearer", `Basic realm="acproxy"`}, rw.Header()["Www-Authenticate"])
+}
+
+func TestCredentialsNotForwarded(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	htpasswd := tempFile(t, "alice:"+string(hash)+"\n")
+	defer os.Remove(htpasswd)
+	m, err := NewAuthMiddleware(AuthConf{
+		Backends:     []string{AuthBackendToken, AuthBackendBasic},
+		Tokens:       map[string]string{"t0ken": "etl"},
+		HtpasswdFile: htpasswd,
+	})
+	if err != nil {
+		t.Fatal("TestCredentialsNotForwarded:", err.Error())
+	}
+
+	for _, authorization := range []string{"Bearer t0ken", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))} {
+		upstreamHeader = nil
+		r := httptest.NewRequest("GET", "/webhdfs/v1/tmp?op=LISTSTATUS", nil)
+		r.Header.Set("Authorization", authorization)
+		r.Header.Set("Proxy-Authorization", authorization)
+		r.Header.Set("X-Custom", "kept")
+		rw := httptest.NewRecorder()
+		m.ServeHTTP(rw, r, reverseProxy.ServeHTTP)
+		assert.Equal(t, http.StatusOK, rw.Code, authorization)
+		if assert.NotNil(t, upstreamHeader, authorization) {
+			assert.Empty(t, upstreamHeader.Get("Authorization"), authorization)
+			assert.Empty(t, upstreamHeader.Get("Proxy-Authorization"), authorization)
+			assert.Equal(t, "kept", upstreamHeader.Get("X-Custom"))
+		}
+		// the inbound request is left alone, for middlewares before authentication
+		assert.Equal(t, authorization, r.Header.Get("Authorization"))
+	}
+}
+
+func signJwt(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJwtAuth(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	b64 := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.Bytes())
+	}
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "alg": "RS256", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X), "y": b64(ecKey.Y)},
+	}})
+	jwksFile := tempFile(t, string(jwks))
+	defer os.Remove(jwksFile)
+	m, err := NewAuthMiddleware(AuthConf{
+		Backends:    []string{AuthBackendJwt},
+		JwksFile:    jwksFile,
+		JwtIssuer:   "https://idp.example.com",
+		JwtAudience: "acproxy",
+	})
+	if err != nil {
+		t.Fatal("TestJwtAuth:", err.Error())
+	}
+
+	claims := func(exp time.Duration, aud interface{}) map[string]interface{} {
+		return map[string]interface{}{"sub": "alice", "iss": "https://idp.example.com", "aud": aud, "exp": time.Now().Add(exp).Unix()}
+	}
+	cases := []struct {
+		token    string
+		accepted bool
+	}{
+		{signJwt(t, "RS256", "rsa1", rsaKey, claims(time.Hour, "acproxy")), true},
+		{signJwt(t, "ES256", "ec1", ecKey, claims(time.Hour, []string{"other", "acproxy"})), true},
+		{signJwt(t, "ES256", "", ecKey, claims(time.Hour, "acproxy")), true},
+		// expired, wrong audience, key of another kid, alg not allowed by the key
+		{signJwt(t, "RS256", "rsa1", rsaKey, claims(-time.Hour, "acproxy")), false},
+		{signJwt(t, "RS256", "rsa1", rsaKey, claims(time.Hour, "other")), false},
+		{signJwt(t, "RS256", "ec1", rsaKey, claims(time.Hour, "acproxy")), false},
+		{signJwt(t, "ES256", "rsa1", ecKey, claims(time.Hour, "acproxy")), false},
+		{"not.a.jwt", false},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", "/webhdfs/v1/tmp?op=LISTSTATUS", nil)
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		rw, passed := serve(m, r)
+		if c.accepted {
+			assert.Equal(t, http.StatusOK, rw.Code, i)
+			if assert.NotNil(t, passed, i) {
+				assert.Equal(t, "alice", passed.URL.Query().Get("user.name"), i)
+			}
+		} else {
+			assert.Equal(t, http.StatusUnauthorized, rw.Code, i)
+			assert.Nil(t, passed, i)
+		}
+	}
+}
+
+func TestNewAuthMiddleware(t *testing.T) {
+	m, err := NewAuthMiddleware(AuthConf{})
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+
+	_, err = NewAuthMiddleware(AuthConf{Backends: []string{"ldap"}})
+	assert.NotNil(t, err)
+	_, err = NewAuthMiddleware(AuthConf{Backends: []string{AuthBackendSpnego}, SpnegoKeytab: "/nonexistent"})
+	assert.NotNil(t, err)
+}
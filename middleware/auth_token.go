@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"active-proxy/util"
+)
+
+// tokenAuthenticator accepts static bearer tokens, tokens are kept hashed so that looking them up leaks no timing
+type tokenAuthenticator struct {
+	users map[[sha256.Size]byte]string
+}
+
+func newTokenAuthenticator(tokens map[string]string) (*tokenAuthenticator, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no token is configured")
+	}
+	authenticator := &tokenAuthenticator{users: make(map[[sha256.Size]byte]string)}
+	for token, user := range tokens {
+		authenticator.users[sha256.Sum256([]byte(token))] = user
+	}
+	return authenticator, nil
+}
+
+func (authenticator *tokenAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
+// Authenticate leaves unknown tokens to other bearer backends (jwt)
+func (authenticator *tokenAuthenticator) Authenticate(r *http.Request) (*util.Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	user, ok := authenticator.users[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	return &util.Principal{Name: user, User: user, Mechanism: AuthBackendToken}, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(authorization[7:]), true
+}
@@ -0,0 +1,240 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"active-proxy/provider"
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+)
+
+const (
+	AuthzAllow = "allow"
+	AuthzDeny  = "deny"
+
+	// AuthzAnyone in users of a rule matches every user, anonymous ones included
+	AuthzAnyone = "*"
+)
+
+// AuthzRule matches a request if all the given criteria match: the user is one of users or in one of groups,
+// the hdfs path falls under one of paths (prefixes, or globs where * is one path segment and ** any segments),
+// the op is one of ops, and query parameters have the given values
+type AuthzRule struct {
+	Name   string            `yaml:"name"`
+	Effect string            `yaml:"effect"`
+	Users  []string          `yaml:"users"`
+	Groups []string          `yaml:"groups"`
+	Paths  []string          `yaml:"paths"`
+	Ops    []string          `yaml:"ops"`
+	Params map[string]string `yaml:"params"`
+}
+
+type AuthzConf struct {
+	Rules         []AuthzRule         `description:"first matched rule decides"`
+	Groups        map[string][]string `description:"group to users, besides groups given by authentication"`
+	DefaultEffect string              `description:"effect if no rule matches, allow if empty"`
+}
+
+// AuthzMiddleware refuses requests denied by rules with AccessControlException before they reach the provider
+type AuthzMiddleware struct {
+	rules         []AuthzRule
+	userGroups    map[string][]string
+	defaultEffect string
+}
+
+// NewAuthzMiddleware returns nil if no rule is configured
+func NewAuthzMiddleware(conf AuthzConf) (*AuthzMiddleware, error) {
+	if len(conf.Rules) == 0 {
+		return nil, nil
+	}
+	m := &AuthzMiddleware{userGroups: make(map[string][]string), defaultEffect: AuthzAllow}
+	if len(conf.DefaultEffect) > 0 {
+		m.defaultEffect = strings.ToLower(conf.DefaultEffect)
+	}
+	if m.defaultEffect != AuthzAllow && m.defaultEffect != AuthzDeny {
+		return nil, fmt.Errorf("invalid default effect %s, expect %s or %s", conf.DefaultEffect, AuthzAllow, AuthzDeny)
+	}
+	for group, users := range conf.Groups {
+		for _, user := range users {
+			m.userGroups[user] = append(m.userGroups[user], group)
+		}
+	}
+	for i, rule := range conf.Rules {
+		rule.Effect = strings.ToLower(rule.Effect)
+		if rule.Effect != AuthzAllow && rule.Effect != AuthzDeny {
+			return nil, fmt.Errorf("rule %d (%s) has invalid effect %s, expect %s or %s", i, rule.Name, rule.Effect, AuthzAllow, AuthzDeny)
+		}
+		for j, pattern := range rule.Paths {
+			if !strings.HasPrefix(pattern, "/") {
+				return nil, fmt.Errorf("rule %d (%s) has relative path %s", i, rule.Name, pattern)
+			}
+			if _, err := path.Match(pattern, "/"); err != nil {
+				return nil, fmt.Errorf("rule %d (%s) has invalid path %s: %s", i, rule.Name, pattern, err.Error())
+			}
+			rule.Paths[j] = path.Clean(pattern)
+		}
+		for j, op := range rule.Ops {
+			rule.Ops[j] = strings.ToUpper(op)
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return m, nil
+}
+
+// authzRequest is what rules are matched against, destination is the other end of a RENAME
+type authzRequest struct {
+	user        string
+	groups      []string
+	path        string
+	destination string
+	op          string
+	query       url.Values
+}
+
+func (m *AuthzMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	request := m.newAuthzRequest(r)
+	effect, rule := m.decide(request)
+	// RENAME is denied if either end is denied, the destination is matched as a request on that path
+	if effect == AuthzAllow && len(request.destination) > 0 {
+		destination := *request
+		destination.path = request.destination
+		effect, rule = m.decide(&destination)
+		request = &destination
+	}
+	if effect == AuthzAllow {
+		next(rw, r)
+		return
+	}
+
+	reason := "default effect"
+	if rule != nil {
+		reason = "rule " + rule.Name
+	}
+	glog.V(1).Infof("Request %s of user %s is denied by %s", r.URL.String(), request.user, reason)
+	util.WriteRemoteException(rw, http.StatusForbidden, &util.RemoteException{
+		Exception:     "AccessControlException",
+		JavaClassName: "org.apache.hadoop.security.AccessControlException",
+		Message:       fmt.Sprintf("Permission denied by proxy (%s): user=%s, access=%s, path=\"%s\"", reason, request.user, request.op, request.path),
+	})
+}
+
+// newAuthzRequest takes the user acted as upstream (doas, user.name), which is the authenticated one
+// if authentication is on, and reads the hdfs path of datanode relays as well
+func (m *AuthzMiddleware) newAuthzRequest(r *http.Request) *authzRequest {
+	request := &authzRequest{user: util.WebHdfsUser(r), query: url.Values{}}
+	if r.URL == nil {
+		return request
+	}
+	request.query = r.URL.Query()
+	request.groups = m.userGroups[request.user]
+	if principal := util.RequestPrincipal(r); principal != nil && principal.User == request.user {
+		request.groups = append(request.groups, principal.Groups...)
+	}
+
+	urlPath := relayedUrlPath(r.URL.Path)
+	if strings.HasPrefix(urlPath, util.WebHdfsPathPrefix) {
+		request.path = path.Clean("/" + strings.TrimPrefix(urlPath, util.WebHdfsPathPrefix))
+		request.op = strings.ToUpper(request.query.Get("op"))
+		if destination := request.query.Get("destination"); len(destination) > 0 {
+			request.destination = path.Clean("/" + destination)
+		}
+	}
+	return request
+}
+
+func (m *AuthzMiddleware) decide(request *authzRequest) (string, *AuthzRule) {
+	for i := range m.rules {
+		if m.rules[i].matches(request) {
+			return m.rules[i].Effect, &m.rules[i]
+		}
+	}
+	return m.defaultEffect, nil
+}
+
+func (rule *AuthzRule) matches(request *authzRequest) bool {
+	if len(rule.Users) > 0 || len(rule.Groups) > 0 {
+		matched := false
+		for _, user := range rule.Users {
+			matched = matched || user == AuthzAnyone || user == request.user
+		}
+		for _, group := range rule.Groups {
+			for _, requestGroup := range request.groups {
+				matched = matched || group == requestGroup
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.Paths) > 0 {
+		matched := false
+		for _, pattern := range rule.Paths {
+			matched = matched || (len(request.path) > 0 && matchHdfsPath(pattern, request.path))
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.Ops) > 0 {
+		matched := false
+		for _, op := range rule.Ops {
+			matched = matched || op == request.op
+		}
+		if !matched {
+			return false
+		}
+	}
+	for key, value := range rule.Params {
+		values, ok := request.query[key]
+		if !ok || len(values) == 0 || !strings.EqualFold(values[0], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHdfsPath matches prefixes by path segments (/data matches /data/x but not /database),
+// and globs segment by segment where ** matches any number of segments
+func matchHdfsPath(pattern string, hdfsPath string) bool {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return pattern == "/" || hdfsPath == pattern || strings.HasPrefix(hdfsPath, pattern+"/")
+	}
+	return matchSegments(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(strings.Trim(hdfsPath, "/"), "/"))
+}
+
+func matchSegments(patterns []string, segments []string) bool {
+	if len(patterns) == 0 {
+		return len(segments) == 0
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(patterns[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(patterns[0], segments[0]); !matched {
+		return false
+	}
+	return matchSegments(patterns[1:], segments[1:])
+}
+
+// relayedUrlPath strips the datanode relay prefix, so that data streams are told by their webhdfs path
+func relayedUrlPath(urlPath string) string {
+	if strings.HasPrefix(urlPath, provider.DatanodePathPrefix) {
+		rest := strings.TrimPrefix(urlPath, provider.DatanodePathPrefix)
+		if index := strings.Index(rest, "/"); index >= 0 {
+			return rest[index:]
+		}
+	}
+	return urlPath
+}
@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchHdfsPath(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		matched bool
+	}{
+		{"/data", "/data", true},
+		{"/data", "/data/x/y", true},
+		{"/data", "/database", false},
+		{"/", "/anything", true},
+		{"/user/*/tmp", "/user/alice/tmp", true},
+		{"/user/*/tmp", "/user/alice/x/tmp", false},
+		{"/prod/**", "/prod", true},
+		{"/prod/**", "/prod/a/b", true},
+		{"/prod/**/_SUCCESS", "/prod/a/b/_SUCCESS", true},
+		{"/prod/**/_SUCCESS", "/prod/a/b/part-0", false},
+		{"/logs/202?-*", "/logs/2024-01", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.matched, matchHdfsPath(c.pattern, c.path), c.pattern+" "+c.path)
+	}
+}
+
+func TestAuthzMiddleware(t *testing.T) {
+	m, err := NewAuthzMiddleware(AuthzConf{
+		Rules: []AuthzRule{
+			{Name: "admins", Effect: "allow", Groups: []string{"admin"}},
+			{Name: "no-recursive-delete", Effect: "deny", Users: []string{"*"}, Paths: []string{"/prod/**"}, Ops: []string{"delete"}, Params: map[string]string{"recursive": "true"}},
+			{Name: "read-only-archive", Effect: "deny", Paths: []string{"/archive"}, Ops: []string{"CREATE", "APPEND", "DELETE", "RENAME"}},
+		},
+		Groups: map[string][]string{"admin": {"root"}},
+	})
+	if err != nil {
+		t.Fatal("TestAuthzMiddleware:", err.Error())
+	}
+
+	cases := []struct {
+		method  string
+		uri     string
+		groups  []string
+		allowed bool
+	}{
+		{"DELETE", "/webhdfs/v1/prod/db/t1?op=DELETE&recursive=true&user.name=etl", nil, false},
+		{"DELETE", "/webhdfs/v1/prod/db/t1?op=DELETE&recursive=false&user.name=etl", nil, true},
+		{"DELETE", "/webhdfs/v1/prod/db/t1?op=DELETE&recursive=true&user.name=root", nil, true},
+		{"DELETE", "/webhdfs/v1/prod/db/t1?op=DELETE&recursive=TRUE&user.name=alice", []string{"admin"}, true},
+		{"DELETE", "/webhdfs/v1/staging/t1?op=DELETE&recursive=true&user.name=etl", nil, true},
+		{"PUT", "/webhdfs/v1/archive/2020?op=RENAME&destination=/tmp/x", nil, false},
+		// renames are denied if a deny rule matches either end
+		{"PUT", "/webhdfs/v1/tmp/x?op=RENAME&destination=/archive/2020", nil, false},
+		{"PUT", "/webhdfs/v1/tmp/x?op=RENAME&destination=/archive/../tmp/y", nil, true},
+		{"PUT", "/webhdfs/v1/tmp/x?op=RENAME&destination=/archive/2020&user.name=root", nil, true},
+		{"GET", "/webhdfs/v1/archive/2020?op=OPEN", nil, true},
+		// creates relayed to datanodes are judged by their hdfs path as well
+		{"PUT", "/_datanode/dn1:9864/webhdfs/v1/archive/x?op=CREATE&namenoderpcaddress=nn1:8020", nil, false},
+		{"GET", "/ws/v1/cluster/info", nil, true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.uri, nil)
+		if c.groups != nil {
+			r = util.WithPrincipal(r, &util.Principal{Name: "alice", User: "alice", Groups: c.groups})
+		}
+		rw := httptest.NewRecorder()
+		passed := false
+		m.ServeHTTP(rw, r, func(http.ResponseWriter, *http.Request) {
+			passed = true
+		})
+		assert.Equal(t, c.allowed, passed, c.uri)
+		if !c.allowed {
+			assert.Equal(t, http.StatusForbidden, rw.Code)
+			exception := util.ParseRemoteException(rw.Body.Bytes())
+			if assert.NotNil(t, exception, c.uri) {
+				assert.Equal(t, "AccessControlException", exception.Exception)
+				assert.Equal(t, "org.apache.hadoop.security.AccessControlException", exception.JavaClassName)
+			}
+			assert.True(t, json.Valid(rw.Body.Bytes()))
+		}
+	}
+
+	// with default deny, the destination has to be allowed as well, and the denied end is told
+	m, err = NewAuthzMiddleware(AuthzConf{
+		Rules:         []AuthzRule{{Name: "etl-home", Effect: "allow", Users: []string{"etl"}, Paths: []string{"/user/etl"}}},
+		DefaultEffect: "deny",
+	})
+	if err != nil {
+		t.Fatal("TestAuthzMiddleware:", err.Error())
+	}
+	for uri, allowed := range map[string]bool{
+		"/webhdfs/v1/user/etl/a?op=RENAME&destination=/user/etl/b&user.name=etl": true,
+		"/webhdfs/v1/user/etl/a?op=RENAME&destination=/user/bob/b&user.name=etl": false,
+	} {
+		rw := httptest.NewRecorder()
+		passed := false
+		m.ServeHTTP(rw, httptest.NewRequest("PUT", uri, nil), func(http.ResponseWriter, *http.Request) {
+			passed = true
+		})
+		assert.Equal(t, allowed, passed, uri)
+		if !allowed {
+			assert.Contains(t, rw.Body.String(), `path=\"/user/bob/b\"`)
+		}
+	}
+
+	_, err = NewAuthzMiddleware(AuthzConf{Rules: []AuthzRule{{Effect: "maybe"}}})
+	assert.NotNil(t, err)
+	_, err = NewAuthzMiddleware(AuthzConf{Rules: []AuthzRule{{Effect: "deny", Paths: []string{"prod"}}}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"active-proxy/util"
+)
+
+// upper bounds in seconds of request latency buckets, data streams may last long
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// methods kept as metric labels, others are counted as OTHER so that clients cannot grow the label set
+var metricMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPut:     true,
+	http.MethodPost:    true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// MetricsMiddleware counts requests and observes their latency by method, webhdfs op and status class
+type MetricsMiddleware struct {
+	mutex    sync.Mutex
+	requests map[requestLabels]*requestMetrics
+}
+
+type requestLabels struct {
+	method      string
+	op          string
+	statusClass string
+}
+
+type requestMetrics struct {
+	buckets []uint64 `description:"requests within each of latencyBuckets, not cumulative"`
+	count   uint64
+	sum     float64
+}
+
+func NewMetricsMiddleware() *MetricsMiddleware {
+	return &MetricsMiddleware{requests: make(map[requestLabels]*requestMetrics)}
+}
+
+func (m *MetricsMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	recorder := &responseRecorder{rw, http.StatusOK}
+	begin := time.Now()
+	next(recorder, r)
+	m.observe(metricLabels(r, recorder.statusCode), time.Since(begin).Seconds())
+}
+
+func (m *MetricsMiddleware) observe(labels requestLabels, seconds float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	metrics, ok := m.requests[labels]
+	if !ok {
+		metrics = &requestMetrics{buckets: make([]uint64, len(latencyBuckets))}
+		m.requests[labels] = metrics
+	}
+	metrics.count++
+	metrics.sum += seconds
+	if i := sort.SearchFloat64s(latencyBuckets, seconds); i < len(latencyBuckets) {
+		metrics.buckets[i]++
+	}
+}
+
+// metricLabels keeps op of webhdfs requests, datanode relays included, and "" for other requests
+func metricLabels(r *http.Request, statusCode int) requestLabels {
+	labels := requestLabels{method: r.Method, statusClass: fmt.Sprintf("%dxx", statusCode/100)}
+	if !metricMethods[labels.method] {
+		labels.method = "OTHER"
+	}
+	if strings.HasPrefix(relayedUrlPath(r.URL.Path), util.WebHdfsPathPrefix) {
+		labels.op = strings.ToUpper(r.URL.Query().Get("op"))
+		if !util.IsWebHdfsOp(labels.op) {
+			labels.op = "OTHER"
+		}
+	}
+	return labels
+}
+
+// WriteMetrics writes acproxy_requests_total and acproxy_request_duration_seconds
+func (m *MetricsMiddleware) WriteMetrics(metrics *util.MetricsWriter) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]requestLabels, 0, len(m.requests))
+	for labels := range m.requests {
+		keys = append(keys, labels)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		if keys[i].op != keys[j].op {
+			return keys[i].op < keys[j].op
+		}
+		return keys[i].statusClass < keys[j].statusClass
+	})
+
+	metrics.Header("acproxy_requests_total", "counter", "Requests served by the proxy.")
+	for _, labels := range keys {
+		metrics.Sample("acproxy_requests_total", float64(m.requests[labels].count),
+			"method", labels.method, "op", labels.op, "status_class", labels.statusClass)
+	}
+	metrics.Header("acproxy_request_duration_seconds", "histogram", "Latency of requests served by the proxy.")
+	for _, labels := range keys {
+		requests := m.requests[labels]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += requests.buckets[i]
+			metrics.Sample("acproxy_request_duration_seconds_bucket", float64(cumulative),
+				"method", labels.method, "op", labels.op, "status_class", labels.statusClass, "le", util.FormatMetricValue(bound))
+		}
+		metrics.Sample("acproxy_request_duration_seconds_bucket", float64(requests.count),
+			"method", labels.method, "op", labels.op, "status_class", labels.statusClass, "le", "+Inf")
+		metrics.Sample("acproxy_request_duration_seconds_sum", requests.sum,
+			"method", labels.method, "op", labels.op, "status_class", labels.statusClass)
+		metrics.Sample("acproxy_request_duration_seconds_count", float64(requests.count),
+			"method", labels.method, "op", labels.op, "status_class", labels.statusClass)
+	}
+}
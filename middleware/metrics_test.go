@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	m := NewMetricsMiddleware()
+	serve := func(method string, target string, statusCode int) {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, target, nil), func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(statusCode)
+		})
+	}
+	serve("GET", "/webhdfs/v1/tmp?op=liststatus", http.StatusOK)
+	serve("GET", "/webhdfs/v1/tmp?op=LISTSTATUS", http.StatusOK)
+	serve("PUT", "/_datanode/dn1:9864/webhdfs/v1/tmp/a?op=CREATE", http.StatusCreated)
+	serve("GET", "/webhdfs/v1/tmp?op=NOSUCHOP", http.StatusBadRequest)
+	serve("PATCH", "/ws/v1/cluster/apps", http.StatusMethodNotAllowed)
+	m.observe(requestLabels{method: "GET", op: "OPEN", statusClass: "2xx"}, 0.3)
+
+	buf := &bytes.Buffer{}
+	m.WriteMetrics(util.NewMetricsWriter(buf))
+	metrics := buf.String()
+	for _, line := range []string{
+		"# TYPE acproxy_requests_total counter",
+		`acproxy_requests_total{method="GET",op="LISTSTATUS",status_class="2xx"} 2`,
+		`acproxy_requests_total{method="PUT",op="CREATE",status_class="2xx"} 1`,
+		`acproxy_requests_total{method="GET",op="OTHER",status_class="4xx"} 1`,
+		`acproxy_requests_total{method="OTHER",op="",status_class="4xx"} 1`,
+		"# TYPE acproxy_request_duration_seconds histogram",
+		`acproxy_request_duration_seconds_bucket{method="GET",op="OPEN",status_class="2xx",le="0.25"} 0`,
+		`acproxy_request_duration_seconds_bucket{method="GET",op="OPEN",status_class="2xx",le="0.5"} 1`,
+		`acproxy_request_duration_seconds_bucket{method="GET",op="OPEN",status_class="2xx",le="+Inf"} 1`,
+		`acproxy_request_duration_seconds_sum{method="GET",op="OPEN",status_class="2xx"} 0.3`,
+		`acproxy_request_duration_seconds_count{method="GET",op="OPEN",status_class="2xx"} 1`,
+	} {
+		assert.True(t, strings.Contains(metrics, line+"\n"), line)
+	}
+}
+
+func TestMetricsMiddlewareFlush(t *testing.T) {
+	m := NewMetricsMiddleware()
+	rw := httptest.NewRecorder()
+	m.ServeHTTP(rw, httptest.NewRequest("GET", "/webhdfs/v1/tmp/a?op=OPEN", nil), func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("0123"))
+		// streamed responses reach the client as they are flushed
+		flusher, ok := rw.(http.Flusher)
+		if assert.True(t, ok) {
+			flusher.Flush()
+		}
+	})
+	assert.True(t, rw.Flushed)
+	assert.Equal(t, "0123", rw.Body.String())
+}
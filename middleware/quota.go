@@ -0,0 +1,342 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+)
+
+// webhdfs ops uploading data, to the namenode and then to the datanode it redirects to
+var uploadOps = map[string]bool{
+	"CREATE": true,
+	"APPEND": true,
+}
+
+// PathQuota limits bytes of files under path, counting what the proxy has uploaded since the usage was last refreshed
+type PathQuota struct {
+	Path  string `yaml:"path" json:"path"`
+	Bytes int64  `yaml:"bytes" json:"bytes"`
+}
+
+type QuotaConf struct {
+	MaxUploadSize   int64       `description:"bytes of a single CREATE or APPEND, 0 means no limit"`
+	Quotas          []PathQuota `description:"directories whose bytes are limited by the proxy"`
+	RefreshInterval int         `description:"ms between refreshes of quota usage from GETCONTENTSUMMARY, 0 disables refreshes"`
+	User            string      `description:"user.name of GETCONTENTSUMMARY refreshing quota usage, none if empty"`
+}
+
+// QuotaMiddleware refuses uploads larger than the maximum upload size, and uploads under directories out of quota;
+// the size is known from Content-Length, or counted as the body is read, so that chunked uploads are cut off as well
+type QuotaMiddleware struct {
+	maxUploadSize int64
+	quotas        []*quotaUsage
+	contentLength func(hdfsPath string) (int64, error)
+
+	mutex sync.Mutex
+}
+
+type quotaUsage struct {
+	PathQuota
+	used     int64 `description:"bytes by the last refresh plus bytes uploaded since"`
+	reserved int64 `description:"bytes of uploads in flight, settled into used once they finish"`
+}
+
+// errUploadRefused is returned to readers of a body cut off by the proxy
+var errUploadRefused = errors.New("upload is refused by the proxy")
+
+// Enabled tells whether upload size or quotas are limited
+func (conf QuotaConf) Enabled() bool {
+	return conf.MaxUploadSize > 0 || len(conf.Quotas) > 0
+}
+
+// NewQuotaMiddleware returns nil if neither upload size nor quotas are limited; contentLength reads the usage of
+// a quota directory (or the length of a file overwritten) from upstream, usage is only counted by the proxy if it is nil
+func NewQuotaMiddleware(conf QuotaConf, contentLength func(hdfsPath string) (int64, error)) (*QuotaMiddleware, error) {
+	if !conf.Enabled() {
+		return nil, nil
+	}
+	m := &QuotaMiddleware{maxUploadSize: conf.MaxUploadSize, contentLength: contentLength}
+	for _, quota := range conf.Quotas {
+		if !strings.HasPrefix(quota.Path, "/") || strings.ContainsAny(quota.Path, "*?[") {
+			return nil, fmt.Errorf("quota path %q is not an absolute directory", quota.Path)
+		}
+		if quota.Bytes <= 0 {
+			return nil, fmt.Errorf("quota of %s has no positive bytes", quota.Path)
+		}
+		quota.Path = path.Clean(quota.Path)
+		m.quotas = append(m.quotas, &quotaUsage{PathQuota: quota})
+	}
+	if len(m.quotas) > 0 && contentLength != nil && conf.RefreshInterval > 0 {
+		go m.monitorUsage(time.Millisecond * time.Duration(conf.RefreshInterval))
+	}
+	return m, nil
+}
+
+func (m *QuotaMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	urlPath := relayedUrlPath(r.URL.Path)
+	if !uploadOps[strings.ToUpper(r.URL.Query().Get("op"))] || !strings.HasPrefix(urlPath, util.WebHdfsPathPrefix) {
+		next(rw, r)
+		return
+	}
+	hdfsPath := path.Clean("/" + strings.TrimPrefix(urlPath, util.WebHdfsPathPrefix))
+
+	// bytes of Content-Length are reserved up front, those of chunked uploads as they are read, so that
+	// concurrent uploads do not each see the room left before any of them has finished; bytes of a file
+	// overwritten are freed by the upload and need no reservation
+	replaced := m.replacedLength(hdfsPath, r)
+	reserved := int64(0)
+	if r.ContentLength > replaced {
+		reserved = r.ContentLength - replaced
+	}
+	if m.maxUploadSize > 0 && r.ContentLength > m.maxUploadSize {
+		m.refuse(hdfsPath, r.ContentLength).write(rw, r)
+		return
+	}
+	if refusal := m.reserve(hdfsPath, reserved); refusal != nil {
+		refusal.write(rw, r)
+		return
+	}
+
+	body := &limitedBody{ReadCloser: r.Body, limit: -1, reserved: replaced + reserved, reserve: func(size int64) bool {
+		return m.reserve(hdfsPath, size) == nil
+	}}
+	if m.maxUploadSize > 0 {
+		body.limit = m.maxUploadSize
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = body
+	}
+	writer := &quotaResponseWriter{ResponseWriter: rw, body: body}
+	next(writer, r)
+
+	read, exceeded := body.state()
+	reserved = body.reservation() - replaced
+	if exceeded {
+		m.settle(hdfsPath, reserved, 0)
+		// what the proxy answers to the cut off body is replaced by the reason
+		if !writer.written {
+			m.refuse(hdfsPath, read).write(rw, r)
+		}
+		return
+	}
+	if writer.statusCode >= 300 || read == 0 {
+		m.settle(hdfsPath, reserved, 0)
+		return
+	}
+	m.settle(hdfsPath, reserved, read-replaced)
+}
+
+type uploadRefusal struct {
+	statusCode int
+	exception  *util.RemoteException
+}
+
+func (refusal *uploadRefusal) write(rw http.ResponseWriter, r *http.Request) {
+	glog.V(1).Infof("Upload %s is refused: %s", r.URL.String(), refusal.exception.Message)
+	util.WriteRemoteException(rw, refusal.statusCode, refusal.exception)
+}
+
+// reserve holds size bytes more of every quota of hdfsPath for an upload in flight, or returns the refusal if
+// they do not fit; a quota already used up refuses even size 0
+func (m *QuotaMiddleware) reserve(hdfsPath string, size int64) *uploadRefusal {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, quota := range m.quotas {
+		if !matchHdfsPath(quota.Path, hdfsPath) {
+			continue
+		}
+		if quota.used+quota.reserved >= quota.Bytes || quota.used+quota.reserved+size > quota.Bytes {
+			return quotaExceeded(quota, size)
+		}
+	}
+	for _, quota := range m.quotas {
+		if matchHdfsPath(quota.Path, hdfsPath) {
+			quota.reserved += size
+		}
+	}
+	return nil
+}
+
+// settle releases reserved bytes of an upload which has finished, and counts the size it has changed usage by
+func (m *QuotaMiddleware) settle(hdfsPath string, reserved int64, size int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, quota := range m.quotas {
+		if !matchHdfsPath(quota.Path, hdfsPath) {
+			continue
+		}
+		quota.reserved -= reserved
+		if quota.used += size; quota.used < 0 {
+			quota.used = 0
+		}
+	}
+}
+
+// replacedLength returns the length of the file a CREATE with overwrite=true replaces, so that it is taken off
+// usage once the upload succeeds; 0 if the length is unknown, usage then waits for the next refresh
+func (m *QuotaMiddleware) replacedLength(hdfsPath string, r *http.Request) int64 {
+	query := r.URL.Query()
+	if m.contentLength == nil || len(m.quotas) == 0 || r.ContentLength == 0 ||
+		!strings.EqualFold(query.Get("op"), "CREATE") || !strings.EqualFold(query.Get("overwrite"), "true") {
+		return 0
+	}
+	length, err := m.contentLength(hdfsPath)
+	if err != nil {
+		glog.V(3).Infof("Length of %s overwritten is unknown: %s", hdfsPath, err.Error())
+		return 0
+	}
+	return length
+}
+
+// refuse explains why size bytes may not be uploaded to hdfsPath
+func (m *QuotaMiddleware) refuse(hdfsPath string, size int64) *uploadRefusal {
+	if m.maxUploadSize > 0 && size > m.maxUploadSize {
+		return &uploadRefusal{statusCode: http.StatusRequestEntityTooLarge, exception: &util.RemoteException{
+			Exception:     "IOException",
+			JavaClassName: "java.io.IOException",
+			Message:       fmt.Sprintf("Upload to %s exceeds the maximum upload size of %d bytes", hdfsPath, m.maxUploadSize),
+		}}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, quota := range m.quotas {
+		if matchHdfsPath(quota.Path, hdfsPath) && quota.used+quota.reserved+size > quota.Bytes {
+			return quotaExceeded(quota, size)
+		}
+	}
+	// the quota was refreshed meanwhile, the limit the upload was cut off by is gone
+	return &uploadRefusal{statusCode: http.StatusServiceUnavailable, exception: &util.RemoteException{
+		Exception:     "RetriableException",
+		JavaClassName: "org.apache.hadoop.ipc.RetriableException",
+		Message:       fmt.Sprintf("Upload to %s is cut off by a quota which has changed, retry", hdfsPath),
+	}}
+}
+
+// quotaExceeded answers as the namenode does for hdfs space quotas, webhdfs maps them to 403; bytes of uploads
+// in flight are counted as consumed
+func quotaExceeded(quota *quotaUsage, size int64) *uploadRefusal {
+	return &uploadRefusal{statusCode: http.StatusForbidden, exception: &util.RemoteException{
+		Exception:     "DSQuotaExceededException",
+		JavaClassName: "org.apache.hadoop.hdfs.protocol.DSQuotaExceededException",
+		Message: fmt.Sprintf("The DiskSpace quota of %s is exceeded: quota = %d B but diskspace consumed = %d B",
+			quota.Path, quota.Bytes, quota.used+quota.reserved+size),
+	}}
+}
+
+// monitorUsage replaces usage counted by the proxy with the length upstream reports, which covers deletes,
+// overwrites and writes bypassing the proxy
+func (m *QuotaMiddleware) monitorUsage(interval time.Duration) {
+	for {
+		m.refreshUsage()
+		time.Sleep(interval)
+	}
+}
+
+func (m *QuotaMiddleware) refreshUsage() {
+	for _, quota := range m.quotas {
+		length, err := m.contentLength(quota.Path)
+		if err != nil {
+			glog.Warningf("Refresh usage of quota %s fails, keep counting by the proxy: %s", quota.Path, err.Error())
+			continue
+		}
+		m.mutex.Lock()
+		quota.used = length
+		m.mutex.Unlock()
+		glog.V(3).Infof("Usage of quota %s is refreshed to %d/%d bytes", quota.Path, length, quota.Bytes)
+	}
+}
+
+// limitedBody fails reads once more than limit bytes are read (limit < 0 means no limit), or once bytes read
+// past reserved, those the upload may reach without reserving more, may not be reserved
+type limitedBody struct {
+	io.ReadCloser
+	limit   int64
+	reserve func(size int64) bool
+
+	mutex    sync.Mutex
+	read     int64
+	reserved int64
+	over     bool
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	body.read += int64(n)
+	if body.limit >= 0 && body.read > body.limit {
+		body.over = true
+		return n, errUploadRefused
+	}
+	if body.read > body.reserved {
+		if !body.reserve(body.read - body.reserved) {
+			body.over = true
+			return n, errUploadRefused
+		}
+		body.reserved = body.read
+	}
+	return n, err
+}
+
+// reservation returns bytes the body may reach without reserving more
+func (body *limitedBody) reservation() int64 {
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	return body.reserved
+}
+
+func (body *limitedBody) exceeded() bool {
+	_, over := body.state()
+	return over
+}
+
+// state returns bytes read so far and whether they are over the limit
+func (body *limitedBody) state() (int64, bool) {
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	return body.read, body.over
+}
+
+// quotaResponseWriter drops the response once the body is cut off, the refusal is answered instead
+type quotaResponseWriter struct {
+	http.ResponseWriter
+	body       *limitedBody
+	statusCode int
+	written    bool
+}
+
+func (w *quotaResponseWriter) WriteHeader(statusCode int) {
+	if w.body.exceeded() && !w.written {
+		return
+	}
+	if !w.written {
+		w.statusCode = statusCode
+		w.written = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *quotaResponseWriter) Write(p []byte) (int, error) {
+	if w.body.exceeded() && !w.written {
+		return len(p), nil
+	}
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *quotaResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaMiddleware(t *testing.T) {
+	m, err := NewQuotaMiddleware(QuotaConf{MaxUploadSize: 10, Quotas: []PathQuota{{Path: "/sandbox/", Bytes: 16}}}, nil)
+	if err != nil {
+		t.Fatal("TestQuotaMiddleware:", err.Error())
+	}
+	// the handler reads the whole body like the proxy does before sending it upstream
+	upload := func(target string, body string, chunked bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", target, strings.NewReader(body))
+		if chunked {
+			r.ContentLength = -1
+		}
+		rw := httptest.NewRecorder()
+		m.ServeHTTP(rw, r, func(rw http.ResponseWriter, r *http.Request) {
+			if _, err := ioutil.ReadAll(r.Body); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rw.WriteHeader(http.StatusCreated)
+		})
+		return rw
+	}
+	exception := func(rw *httptest.ResponseRecorder) string {
+		if e := util.ParseRemoteException(rw.Body.Bytes()); e != nil {
+			return e.Exception
+		}
+		return ""
+	}
+
+	// uploads over the maximum size are refused by Content-Length, or cut off as they stream
+	rw := upload("/webhdfs/v1/tmp/a?op=CREATE", "0123456789a", false)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	rw = upload("/_datanode/dn1:9864/webhdfs/v1/tmp/a?op=APPEND", "0123456789a", true)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Equal(t, "IOException", exception(rw))
+	assert.Equal(t, http.StatusCreated, upload("/webhdfs/v1/tmp/a?op=CREATE", "0123456789", true).Code)
+	// other ops are not limited
+	assert.Equal(t, http.StatusCreated, upload("/webhdfs/v1/tmp/a?op=SETOWNER", "0123456789a", false).Code)
+
+	// the quota counts uploads under /sandbox only
+	assert.Equal(t, http.StatusCreated, upload("/_datanode/dn1:9864/webhdfs/v1/sandbox/a?op=CREATE", "0123456789", false).Code)
+	rw = upload("/webhdfs/v1/sandbox/b?op=CREATE", "0123456", true)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "DSQuotaExceededException", exception(rw))
+	assert.Equal(t, http.StatusCreated, upload("/webhdfs/v1/sandbox/b?op=CREATE", "012345", false).Code)
+	rw = upload("/webhdfs/v1/sandbox/c?op=CREATE", "", false)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "DSQuotaExceededException", exception(rw))
+
+	// usage refreshed from upstream replaces what the proxy counted
+	m.contentLength = func(hdfsPath string) (int64, error) { return 4, nil }
+	m.refreshUsage()
+	assert.Equal(t, http.StatusCreated, upload("/webhdfs/v1/sandbox/c?op=CREATE", "012345678", false).Code)
+
+	_, err = NewQuotaMiddleware(QuotaConf{Quotas: []PathQuota{{Path: "/sandbox/*", Bytes: 1}}}, nil)
+	assert.NotNil(t, err)
+	_, err = NewQuotaMiddleware(QuotaConf{Quotas: []PathQuota{{Path: "/sandbox"}}}, nil)
+	assert.NotNil(t, err)
+	m, err = NewQuotaMiddleware(QuotaConf{}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+}
+
+func TestQuotaConcurrentUploads(t *testing.T) {
+	m, err := NewQuotaMiddleware(QuotaConf{Quotas: []PathQuota{{Path: "/sandbox", Bytes: 16}}}, nil)
+	if err != nil {
+		t.Fatal("TestQuotaConcurrentUploads:", err.Error())
+	}
+	// the first upload is held upstream until the second one is answered
+	held, release := make(chan struct{}), make(chan struct{})
+	upload := func(target string, body string, chunked bool, hold bool) int {
+		r := httptest.NewRequest("PUT", target, strings.NewReader(body))
+		if chunked {
+			r.ContentLength = -1
+		}
+		rw := httptest.NewRecorder()
+		m.ServeHTTP(rw, r, func(rw http.ResponseWriter, r *http.Request) {
+			if _, err := ioutil.ReadAll(r.Body); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if hold {
+				held <- struct{}{}
+				<-release
+			}
+			rw.WriteHeader(http.StatusCreated)
+		})
+		return rw.Code
+	}
+
+	for _, chunked := range []bool{false, true} {
+		m.quotas[0].used = 0
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, http.StatusCreated, upload("/webhdfs/v1/sandbox/a?op=CREATE", "0123456789", chunked, true))
+		}()
+		<-held
+		// bytes of the upload in flight are reserved, both would not fit in the quota
+		assert.Equal(t, http.StatusForbidden, upload("/webhdfs/v1/sandbox/b?op=CREATE", "0123456789", chunked, false))
+		assert.Equal(t, http.StatusCreated, upload("/webhdfs/v1/sandbox/b?op=CREATE", "012345", chunked, false))
+		close(release)
+		wg.Wait()
+		release = make(chan struct{})
+		assert.Equal(t, int64(16), m.quotas[0].used, "chunked=%v", chunked)
+		assert.Equal(t, int64(0), m.quotas[0].reserved, "chunked=%v", chunked)
+	}
+
+	// a failed upload releases its reservation and counts nothing
+	m.quotas[0].used = 0
+	r := httptest.NewRequest("PUT", "/webhdfs/v1/sandbox/a?op=CREATE", strings.NewReader("0123456789"))
+	m.ServeHTTP(httptest.NewRecorder(), r, func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	})
+	assert.Equal(t, int64(0), m.quotas[0].used)
+	assert.Equal(t, int64(0), m.quotas[0].reserved)
+
+	// an overwrite takes the length of the file replaced off usage, and needs room for the difference only
+	m.quotas[0].used = 12
+	m.contentLength = func(hdfsPath string) (int64, error) { return 10, nil }
+	assert.Equal(t, http.StatusCreated, upload("/webhdfs/v1/sandbox/a?op=CREATE&overwrite=true", "01234567", false, false))
+	assert.Equal(t, int64(10), m.quotas[0].used)
+	assert.Equal(t, http.StatusCreated, upload("/webhdfs/v1/sandbox/a?op=CREATE&overwrite=true", "0123456789abcdef", true, false))
+	assert.Equal(t, int64(16), m.quotas[0].used)
+	assert.Equal(t, int64(0), m.quotas[0].reserved)
+}
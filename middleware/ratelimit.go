@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"active-proxy/provider"
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+)
+
+const (
+	RateLimitByIp   = "ip"
+	RateLimitByUser = "user"
+
+	OpClassMetadata = "metadata"
+	OpClassData     = "data"
+	OpClassAll      = "all"
+
+	// buckets refilled to full are swept once so many keys are tracked by a rule
+	rateLimitSweepSize = 4096
+)
+
+// webhdfs ops streaming file data, the others only touch metadata
+var dataOps = map[string]bool{
+	"OPEN":   true,
+	"CREATE": true,
+	"APPEND": true,
+}
+
+// RateLimitRule gives every client ip or user of requests in class a token bucket,
+// which holds up to burst requests and is refilled by rate requests per second
+type RateLimitRule struct {
+	Name  string  `yaml:"name"`
+	By    string  `yaml:"by"`
+	Class string  `yaml:"class"`
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+type RateLimitConf struct {
+	Rules []RateLimitRule `description:"a request passes only if every rule of its class lets it"`
+}
+
+// RateLimitMiddleware answers 429 with Retry-After to requests over their limits
+type RateLimitMiddleware struct {
+	limiters    []*rateLimiter
+	onThrottled func(rule string)
+	now         func() time.Time
+
+	mutex sync.Mutex
+}
+
+type rateLimiter struct {
+	rule    RateLimitRule
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimitMiddleware returns nil if no rule is configured, onThrottled (may be nil) is told the rule
+// refusing a request
+func NewRateLimitMiddleware(conf RateLimitConf, onThrottled func(rule string)) (*RateLimitMiddleware, error) {
+	if len(conf.Rules) == 0 {
+		return nil, nil
+	}
+	m := &RateLimitMiddleware{onThrottled: onThrottled, now: time.Now}
+	for i, rule := range conf.Rules {
+		if len(rule.Name) == 0 {
+			rule.Name = fmt.Sprintf("rule%d", i)
+		}
+		if rule.By != RateLimitByIp && rule.By != RateLimitByUser {
+			return nil, fmt.Errorf("rate limit %s has invalid by %s, expect %s or %s", rule.Name, rule.By, RateLimitByIp, RateLimitByUser)
+		}
+		rule.Class = strings.ToLower(rule.Class)
+		if len(rule.Class) == 0 {
+			rule.Class = OpClassAll
+		}
+		if rule.Class != OpClassMetadata && rule.Class != OpClassData && rule.Class != OpClassAll {
+			return nil, fmt.Errorf("rate limit %s has invalid class %s, expect %s, %s or %s",
+				rule.Name, rule.Class, OpClassMetadata, OpClassData, OpClassAll)
+		}
+		if rule.Rate <= 0 {
+			return nil, fmt.Errorf("rate limit %s has no positive rate", rule.Name)
+		}
+		if rule.Burst <= 0 {
+			rule.Burst = int(math.Ceil(rule.Rate))
+		}
+		m.limiters = append(m.limiters, &rateLimiter{rule: rule, buckets: make(map[string]*tokenBucket)})
+	}
+	return m, nil
+}
+
+func (m *RateLimitMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	wait, rule, ok := m.take(r)
+	if ok {
+		next(rw, r)
+		return
+	}
+
+	if m.onThrottled != nil {
+		m.onThrottled(rule.Name)
+	}
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	glog.V(2).Infof("Request %s is throttled by rate limit %s, retry after %ds", r.URL.String(), rule.Name, retryAfter)
+	rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	util.WriteRemoteException(rw, http.StatusTooManyRequests, &util.RemoteException{
+		Exception:     "RetriableException",
+		JavaClassName: "org.apache.hadoop.ipc.RetriableException",
+		Message:       fmt.Sprintf("Rate limit %s (%g requests/s per %s) is exceeded, retry after %ds", rule.Name, rule.Rate, rule.By, retryAfter),
+	})
+}
+
+// take consumes a token of every bucket r falls in, or none of them if one is empty;
+// it returns how long to wait for the empty bucket then
+func (m *RateLimitMiddleware) take(r *http.Request) (time.Duration, *RateLimitRule, bool) {
+	class := opClass(r)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	var buckets []*tokenBucket
+	for _, limiter := range m.limiters {
+		if limiter.rule.Class != OpClassAll && limiter.rule.Class != class {
+			continue
+		}
+		key := rateLimitKey(r, limiter.rule.By)
+		if len(key) == 0 {
+			continue
+		}
+		bucket := limiter.bucket(key, now)
+		if bucket.tokens < 1 {
+			return time.Duration((1 - bucket.tokens) / limiter.rule.Rate * float64(time.Second)), &limiter.rule, false
+		}
+		buckets = append(buckets, bucket)
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return 0, nil, true
+}
+
+// bucket returns the bucket of key refilled up to now
+func (limiter *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	burst := float64(limiter.rule.Burst)
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		if len(limiter.buckets) >= rateLimitSweepSize {
+			limiter.sweep(now)
+		}
+		bucket = &tokenBucket{tokens: burst, last: now}
+		limiter.buckets[key] = bucket
+		return bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rule.Rate)
+	bucket.last = now
+	return bucket
+}
+
+// sweep forgets keys whose buckets are full again, they are the same as new ones
+func (limiter *rateLimiter) sweep(now time.Time) {
+	burst := float64(limiter.rule.Burst)
+	for key, bucket := range limiter.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*limiter.rule.Rate >= burst {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// opClass tells data streams (including datanode relays) from metadata ops, requests other than webhdfs are metadata
+func opClass(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, provider.DatanodePathPrefix) || dataOps[strings.ToUpper(r.URL.Query().Get("op"))] {
+		return OpClassData
+	}
+	return OpClassMetadata
+}
+
+// rateLimitKey is the client ip, or the authenticated user (user.name or doas without authentication)
+func rateLimitKey(r *http.Request, by string) string {
+	if by == RateLimitByIp {
+		return util.ClientAddress(r)
+	}
+	if principal := util.RequestPrincipal(r); principal != nil {
+		return principal.User
+	}
+	return util.WebHdfsUser(r)
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	throttled := make(map[string]int)
+	m, err := NewRateLimitMiddleware(RateLimitConf{Rules: []RateLimitRule{
+		{Name: "user-metadata", By: RateLimitByUser, Class: OpClassMetadata, Rate: 1, Burst: 2},
+		{Name: "ip-data", By: RateLimitByIp, Class: OpClassData, Rate: 0.5},
+	}}, func(rule string) { throttled[rule]++ })
+	if err != nil {
+		t.Fatal("TestRateLimitMiddleware:", err.Error())
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+
+	serve := func(target string, principal string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if len(principal) > 0 {
+			r = util.WithPrincipal(r, &util.Principal{User: principal, Mechanism: AuthBackendJwt})
+		}
+		rw := httptest.NewRecorder()
+		m.ServeHTTP(rw, r, func(http.ResponseWriter, *http.Request) {})
+		return rw
+	}
+
+	// alice lists twice in a burst, the third listing waits for a token
+	assert.Equal(t, http.StatusOK, serve("/webhdfs/v1/tmp?op=LISTSTATUS", "alice").Code)
+	assert.Equal(t, http.StatusOK, serve("/webhdfs/v1/tmp?op=LISTSTATUS&user.name=alice", "").Code)
+	rw := serve("/webhdfs/v1/tmp?op=LISTSTATUS", "alice")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+	assert.True(t, strings.Contains(rw.Body.String(), "RetriableException"), rw.Body.String())
+	// others and data ops of alice are not limited by her metadata bucket
+	assert.Equal(t, http.StatusOK, serve("/webhdfs/v1/tmp?op=LISTSTATUS", "bob").Code)
+	assert.Equal(t, http.StatusOK, serve("/webhdfs/v1/tmp/a?op=OPEN", "alice").Code)
+
+	// data ops share the bucket of the client ip, datanode relays included
+	rw = serve("/_datanode/dn1:9864/webhdfs/v1/tmp/a?op=OPEN", "carol")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "2", rw.Header().Get("Retry-After"))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, serve("/webhdfs/v1/tmp?op=LISTSTATUS", "alice").Code)
+	assert.Equal(t, map[string]int{"user-metadata": 1, "ip-data": 1}, throttled)
+
+	// a throttled request takes no token of other buckets
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, serve("/webhdfs/v1/tmp/a?op=OPEN", "alice").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve("/webhdfs/v1/tmp/a?op=CREATE", "alice").Code)
+
+	m, err = NewRateLimitMiddleware(RateLimitConf{}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+	_, err = NewRateLimitMiddleware(RateLimitConf{Rules: []RateLimitRule{{By: "host", Rate: 1}}}, nil)
+	assert.NotNil(t, err)
+	_, err = NewRateLimitMiddleware(RateLimitConf{Rules: []RateLimitRule{{By: RateLimitByIp, Class: "write", Rate: 1}}}, nil)
+	assert.NotNil(t, err)
+	_, err = NewRateLimitMiddleware(RateLimitConf{Rules: []RateLimitRule{{By: RateLimitByIp}}}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	m, _ := NewRateLimitMiddleware(RateLimitConf{Rules: []RateLimitRule{{By: RateLimitByUser, Rate: 10}}}, nil)
+	now := time.Now()
+	limiter := m.limiters[0]
+	for i := 0; i < rateLimitSweepSize; i++ {
+		limiter.bucket(fmt.Sprintf("user%d", i), now).tokens--
+	}
+	// every bucket is refilled a second later, so the new key finds only itself
+	limiter.bucket("new", now.Add(time.Second))
+	assert.Equal(t, 1, len(limiter.buckets))
+}
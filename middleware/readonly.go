@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+)
+
+// MaintenanceWindow makes paths (or the whole proxy if none) read-only from start until end, times in RFC 3339
+type MaintenanceWindow struct {
+	Start  string   `yaml:"start" json:"start"`
+	End    string   `yaml:"end" json:"end"`
+	Paths  []string `yaml:"paths" json:"paths,omitempty"`
+	Reason string   `yaml:"reason" json:"reason,omitempty"`
+
+	start time.Time
+	end   time.Time
+}
+
+// ReadOnlyConf is both the configuration and the runtime state of read-only mode
+type ReadOnlyConf struct {
+	Enabled bool                `json:"enabled"`
+	Paths   []string            `json:"paths,omitempty" description:"prefixes or globs made read-only, the whole proxy if empty"`
+	Reason  string              `json:"reason,omitempty"`
+	Windows []MaintenanceWindow `json:"windows,omitempty"`
+}
+
+// ReadOnlyMiddleware refuses mutating ops under read-only paths, while reads keep working;
+// it is switched at runtime through AdminHandler
+type ReadOnlyMiddleware struct {
+	mutex sync.RWMutex
+	conf  ReadOnlyConf
+	now   func() time.Time
+}
+
+func NewReadOnlyMiddleware(conf ReadOnlyConf) (*ReadOnlyMiddleware, error) {
+	m := &ReadOnlyMiddleware{now: time.Now}
+	if err := m.SetConf(conf); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Conf returns the current read-only state, ended windows are dropped
+func (m *ReadOnlyMiddleware) Conf() ReadOnlyConf {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	conf := m.conf
+	conf.Windows = nil
+	now := m.now()
+	for _, window := range m.conf.Windows {
+		if now.Before(window.end) {
+			conf.Windows = append(conf.Windows, window)
+		}
+	}
+	return conf
+}
+
+// SetConf replaces the read-only state
+func (m *ReadOnlyMiddleware) SetConf(conf ReadOnlyConf) error {
+	windows := make([]MaintenanceWindow, 0, len(conf.Windows))
+	for _, window := range conf.Windows {
+		var err error
+		if window.start, err = time.Parse(time.RFC3339, window.Start); err != nil {
+			return fmt.Errorf("invalid start of maintenance window: %s", err.Error())
+		}
+		if window.end, err = time.Parse(time.RFC3339, window.End); err != nil {
+			return fmt.Errorf("invalid end of maintenance window: %s", err.Error())
+		}
+		if !window.end.After(window.start) {
+			return fmt.Errorf("maintenance window ends at %s before it starts at %s", window.End, window.Start)
+		}
+		windows = append(windows, window)
+	}
+	conf.Windows = windows
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.conf = conf
+	return nil
+}
+
+func (m *ReadOnlyMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	op := strings.ToUpper(r.URL.Query().Get("op"))
+	if !util.IsMutatingOp(r.Method, op) {
+		next(rw, r)
+		return
+	}
+	// RENAME is refused if either end is read-only
+	var paths []string
+	if urlPath := relayedUrlPath(r.URL.Path); strings.HasPrefix(urlPath, util.WebHdfsPathPrefix) {
+		paths = append(paths, path.Clean("/"+strings.TrimPrefix(urlPath, util.WebHdfsPathPrefix)))
+		if destination := r.URL.Query().Get("destination"); len(destination) > 0 {
+			paths = append(paths, path.Clean("/"+destination))
+		}
+	}
+	reason, readOnly := m.readOnly(paths)
+	if !readOnly {
+		next(rw, r)
+		return
+	}
+
+	glog.V(1).Infof("Request %s is refused in read-only mode: %s", r.URL.String(), reason)
+	util.WriteRemoteException(rw, http.StatusForbidden, &util.RemoteException{
+		Exception:     "ReadOnlyModeException",
+		JavaClassName: "java.io.IOException",
+		Message:       fmt.Sprintf("Operation %s on %s is refused, the proxy is read-only (%s)", op, strings.Join(paths, " -> "), reason),
+	})
+}
+
+// readOnly tells whether a mutation of paths (none for requests other than webhdfs) is refused, and why
+func (m *ReadOnlyMiddleware) readOnly(paths []string) (string, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.conf.Enabled && coversPaths(m.conf.Paths, paths) {
+		return reasonOrDefault(m.conf.Reason, "read-only mode"), true
+	}
+	now := m.now()
+	for _, window := range m.conf.Windows {
+		if !now.Before(window.start) && now.Before(window.end) && coversPaths(window.Paths, paths) {
+			return reasonOrDefault(window.Reason, "maintenance window until "+window.End), true
+		}
+	}
+	return "", false
+}
+
+// coversPaths is true if prefixes are empty (everything), or one of paths falls under one of prefixes
+func coversPaths(prefixes []string, paths []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		for _, hdfsPath := range paths {
+			if matchHdfsPath(prefix, hdfsPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func reasonOrDefault(reason string, defaultReason string) string {
+	if len(reason) > 0 {
+		return reason
+	}
+	return defaultReason
+}
+
+// AdminHandler shows the read-only state on GET, and replaces it with the json body on PUT
+func (m *ReadOnlyMiddleware) AdminHandler(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		conf := ReadOnlyConf{}
+		if err := json.NewDecoder(r.Body).Decode(&conf); err != nil {
+			http.Error(rw, fmt.Sprintf("invalid read-only state: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if err := m.SetConf(conf); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		glog.Infof("Read-only state is changed by %s: %+v", util.ClientAddress(r), conf)
+	default:
+		rw.Header().Set("Allow", "GET, PUT")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	data, _ := json.Marshal(m.Conf())
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(data)
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyMiddleware(t *testing.T) {
+	m, err := NewReadOnlyMiddleware(ReadOnlyConf{
+		Enabled: true,
+		Paths:   []string{"/warehouse"},
+		Windows: []MaintenanceWindow{{Start: "2030-01-01T00:00:00Z", End: "2030-01-01T02:00:00Z", Reason: "upgrade"}},
+	})
+	if err != nil {
+		t.Fatal("TestReadOnlyMiddleware:", err.Error())
+	}
+	m.now = func() time.Time { return time.Date(2029, 12, 31, 0, 0, 0, 0, time.UTC) }
+	status := func(method string, uri string) int {
+		rw := httptest.NewRecorder()
+		m.ServeHTTP(rw, httptest.NewRequest(method, uri, nil), func(http.ResponseWriter, *http.Request) {})
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, status("GET", "/webhdfs/v1/warehouse/t1?op=OPEN"))
+	assert.Equal(t, http.StatusForbidden, status("PUT", "/webhdfs/v1/warehouse/t1?op=MKDIRS"))
+	assert.Equal(t, http.StatusForbidden, status("DELETE", "/webhdfs/v1/warehouse?op=DELETE"))
+	assert.Equal(t, http.StatusForbidden, status("PUT", "/webhdfs/v1/tmp/t1?op=RENAME&destination=/warehouse/t1"))
+	assert.Equal(t, http.StatusForbidden, status("PUT", "/_datanode/dn1:9864/webhdfs/v1/warehouse/f?op=CREATE"))
+	assert.Equal(t, http.StatusOK, status("PUT", "/webhdfs/v1/warehouse2?op=MKDIRS"))
+	assert.Equal(t, http.StatusOK, status("POST", "/ws/v1/cluster/apps"))
+
+	// within the window every mutation is refused, yarn included
+	m.now = func() time.Time { return time.Date(2030, 1, 1, 1, 0, 0, 0, time.UTC) }
+	assert.Equal(t, http.StatusForbidden, status("PUT", "/webhdfs/v1/tmp?op=MKDIRS"))
+	assert.Equal(t, http.StatusForbidden, status("POST", "/ws/v1/cluster/apps"))
+	assert.Equal(t, http.StatusOK, status("GET", "/webhdfs/v1/tmp?op=LISTSTATUS"))
+	m.now = func() time.Time { return time.Date(2030, 1, 1, 2, 0, 0, 0, time.UTC) }
+	assert.Equal(t, http.StatusOK, status("PUT", "/webhdfs/v1/tmp?op=MKDIRS"))
+	assert.Equal(t, 0, len(m.Conf().Windows))
+
+	rw := httptest.NewRecorder()
+	m.ServeHTTP(rw, httptest.NewRequest("PUT", "/webhdfs/v1/warehouse?op=SETOWNER", nil), nil)
+	exception := util.ParseRemoteException(rw.Body.Bytes())
+	assert.Equal(t, "ReadOnlyModeException", exception.Exception)
+	assert.Contains(t, exception.Message, "SETOWNER on /warehouse")
+
+	_, err = NewReadOnlyMiddleware(ReadOnlyConf{Windows: []MaintenanceWindow{{Start: "2030-01-01T02:00:00Z", End: "2030-01-01T00:00:00Z"}}})
+	assert.NotNil(t, err)
+}
+
+func TestReadOnlyAdminHandler(t *testing.T) {
+	m, _ := NewReadOnlyMiddleware(ReadOnlyConf{})
+	rw := httptest.NewRecorder()
+	m.AdminHandler(rw, httptest.NewRequest("PUT", "/readonly", strings.NewReader(`{"enabled": true, "reason": "namenode upgrade"}`)))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, `{"enabled":true,"reason":"namenode upgrade"}`, rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	m.ServeHTTP(rw, httptest.NewRequest("PUT", "/webhdfs/v1/tmp?op=MKDIRS", nil), nil)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, rw.Body.String(), "namenode upgrade")
+
+	rw = httptest.NewRecorder()
+	m.AdminHandler(rw, httptest.NewRequest("PUT", "/readonly", strings.NewReader(`{"windows": [{"start": "tomorrow"}]}`)))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+	rw = httptest.NewRecorder()
+	m.AdminHandler(rw, httptest.NewRequest("DELETE", "/readonly", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+}
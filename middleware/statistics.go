@@ -3,24 +3,38 @@ package middleware
 import (
 	"encoding/json"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"sync"
 	"time"
+
+	"active-proxy/util"
+)
+
+const (
+	// TimeseriesStep is the span of a point of timeseries
+	TimeseriesStep = time.Minute
+	// TimeseriesMaxSpan is the longest timeseries, as long as the sliding window
+	TimeseriesMaxSpan = windowSlots * windowSlotDuration
 )
 
+// credentialParams carry delegation tokens (of the request, or renewed and cancelled by it), records of recent
+// requests keep them out since /statistics is served without authentication
+var credentialParams = map[string]bool{
+	"delegation": true,
+	"token":      true,
+}
+
 type StatisticsMiddleware struct {
 	mutex             sync.RWMutex
 	totalRequests     int
-	numRecentRequests int
-	recentRequests    []RequestsRecord
-}
-
-type RequestsRecord struct {
-	Method     string        `json:"method"`
-	Host       string        `json:"host"`
-	Path       string        `json:"path"`
-	StatusCode int           `json:"status_code"`
-	Status     string        `json:"status"`
-	Delay      time.Duration `json:"delay"`
+	numRecentRequests int `description:"records returned by default"`
+	recentRequests    requestLog
+	throttledRequests map[string]int `description:"requests refused by rate limits, keyed by rule"`
+	window            slidingWindow  `description:"latency histograms of the last hour by webhdfs op and status class"`
+	started           time.Time
+	now               func() time.Time
 }
 
 type responseRecorder struct {
@@ -33,42 +47,157 @@ func (rr *responseRecorder) WriteHeader(statusCode int) {
 	rr.statusCode = statusCode
 }
 
-func NewStatisticsMiddleware(numRecentRequests int) *StatisticsMiddleware {
+// Flush passes flushes on, so that streamed responses are not held by the recorder
+func (rr *responseRecorder) Flush() {
+	if flusher, ok := rr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// NewStatisticsMiddleware keeps records of recent requests within recentRequestMemory bytes
+// (RecentRequestMemoryDefault if not positive), numRecentRequests of them are returned if a query sets no limit
+func NewStatisticsMiddleware(numRecentRequests int, recentRequestMemory int64) *StatisticsMiddleware {
+	if recentRequestMemory <= 0 {
+		recentRequestMemory = RecentRequestMemoryDefault
+	}
 	return &StatisticsMiddleware{
 		numRecentRequests: numRecentRequests,
-		recentRequests:    []RequestsRecord{},
+		recentRequests:    requestLog{budget: recentRequestMemory},
+		throttledRequests: make(map[string]int),
+		started:           time.Now(),
+		now:               time.Now,
 	}
 }
 
 func (m *StatisticsMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	r, info := util.WithRequestInfo(r)
+	info.Id = util.RequestId(r)
+	rw.Header().Set(util.RequestIdHeader, info.Id)
 	respRecorder := &responseRecorder{rw, http.StatusOK}
-	begin := time.Now()
+	begin := m.now()
 	next(respRecorder, r)
+	end := m.now()
+
+	labels := metricLabels(r, respRecorder.statusCode)
+	record := newRequestsRecord(r, info, labels.op, respRecorder.statusCode)
+	record.Time = begin
+	record.Delay = end.Sub(begin)
 
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	m.totalRequests++
-	m.recentRequests = append(m.recentRequests, RequestsRecord{
-		StatusCode: respRecorder.statusCode,
-		Status:     http.StatusText(respRecorder.statusCode),
+	m.window.observe(end, labels.op, labels.statusClass, end.Sub(begin), respRecorder.statusCode >= 500)
+	m.recentRequests.add(record)
+}
+
+func newRequestsRecord(r *http.Request, info *util.RequestInfo, op string, statusCode int) RequestsRecord {
+	record := RequestsRecord{
+		RequestId:  info.Id,
 		Method:     r.Method,
 		Host:       r.Host,
-		Path:       r.URL.String(),
-		Delay:      time.Now().Sub(begin),
-	})
-	if len(m.recentRequests) > m.numRecentRequests {
-		m.recentRequests = m.recentRequests[len(m.recentRequests)-m.numRecentRequests:]
+		Path:       recordedUrl(r.URL),
+		Op:         op,
+		ClientIp:   util.ClientAddress(r),
+		User:       util.WebHdfsUser(r),
+		Upstream:   info.Upstream,
+		StatusCode: statusCode,
+		Status:     http.StatusText(statusCode),
+		hdfsPath:   r.URL.Path,
+	}
+	if info.Principal != nil {
+		record.User = info.Principal.User
+	}
+	if info.Attempts > 1 {
+		record.Retries = info.Attempts - 1
+	}
+	if urlPath := relayedUrlPath(r.URL.Path); strings.HasPrefix(urlPath, util.WebHdfsPathPrefix) {
+		record.hdfsPath = path.Clean("/" + strings.TrimPrefix(urlPath, util.WebHdfsPathPrefix))
+	}
+	return record
+}
+
+// recordedUrl is u without credentialParams, other params are kept as they are given
+func recordedUrl(u *url.URL) string {
+	if len(u.RawQuery) == 0 {
+		return u.String()
 	}
+	params := strings.Split(u.RawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		key := strings.SplitN(param, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if !credentialParams[strings.ToLower(key)] {
+			kept = append(kept, param)
+		}
+	}
+	recorded := *u
+	recorded.RawQuery = strings.Join(kept, "&")
+	return recorded.String()
+}
+
+// RecordThrottled counts a request refused by rate limit rule
+func (m *StatisticsMiddleware) RecordThrottled(rule string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.throttledRequests[rule]++
 }
 
-func (m *StatisticsMiddleware) Json() string {
+// Json returns totals and the recent requests picked by query, numRecentRequests of them if query sets no limit
+func (m *StatisticsMiddleware) Json(query RequestsQuery) string {
+	if query.Limit <= 0 {
+		query.Limit = m.numRecentRequests
+	}
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
 	statisticsMap := make(map[string]interface{})
 	statisticsMap["totalRequests"] = m.totalRequests
-	statisticsMap["recentRequests"] = m.recentRequests
+	recentRequests, matched := m.recentRequests.find(&query)
+	statisticsMap["recentRequests"] = recentRequests
+	statisticsMap["matchedRequests"] = matched
+	statisticsMap["keptRequests"] = m.recentRequests.len()
+	totalThrottled := 0
+	for _, count := range m.throttledRequests {
+		totalThrottled += count
+	}
+	statisticsMap["totalThrottledRequests"] = totalThrottled
+	statisticsMap["throttledRequests"] = m.throttledRequests
 
 	buf, _ := json.Marshal(statisticsMap)
 	return string(buf)
 }
+
+// Summary returns latency percentiles, request and error rates over the last 1, 5 and 60 minutes,
+// in total, by webhdfs op and by status class
+func (m *StatisticsMiddleware) Summary() string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	now := m.now()
+	summaries := make(map[string]WindowSummary)
+	for _, window := range summaryWindows {
+		summaries[window.name] = m.window.summary(now, window.span, m.started)
+	}
+	buf, _ := json.Marshal(map[string]interface{}{"windows": summaries})
+	return string(buf)
+}
+
+// Timeseries returns a point per TimeseriesStep over span, of requests of op or of status class, or all requests if neither
+func (m *StatisticsMiddleware) Timeseries(op string, statusClass string, span time.Duration) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	points := m.window.timeseries(m.now(), span, TimeseriesStep, func(slot *windowSlot) *latencyHistogram {
+		switch {
+		case len(op) > 0:
+			return slot.byOp[op]
+		case len(statusClass) > 0:
+			return slot.byStatusClass[statusClass]
+		}
+		return &slot.total
+	})
+	buf, _ := json.Marshal(map[string]interface{}{"op": op, "statusClass": statusClass, "step": TimeseriesStep.String(), "points": points})
+	return string(buf)
+}
@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+const (
+	// RecentRequestMemoryDefault is bytes of recent request records kept if no budget is configured
+	RecentRequestMemoryDefault = 64 << 20
+	// RecentRequestMaxLimit is the most records returned by one query
+	RecentRequestMaxLimit = 10000
+
+	// bytes of a record besides its strings
+	requestsRecordSize = int64(unsafe.Sizeof(RequestsRecord{}))
+)
+
+type RequestsRecord struct {
+	Time       time.Time     `json:"time"`
+	RequestId  string        `json:"request_id"`
+	Method     string        `json:"method"`
+	Host       string        `json:"host"`
+	Path       string        `json:"path"`
+	Op         string        `json:"op,omitempty"`
+	ClientIp   string        `json:"client_ip"`
+	User       string        `json:"user,omitempty"`
+	Upstream   string        `json:"upstream,omitempty"`
+	Retries    int           `json:"retries"`
+	StatusCode int           `json:"status_code"`
+	Status     string        `json:"status"`
+	Delay      time.Duration `json:"delay"`
+
+	hdfsPath string `description:"path of webhdfs requests in hdfs, url path of others"`
+}
+
+func (record *RequestsRecord) size() int64 {
+	return requestsRecordSize + int64(len(record.RequestId)+len(record.Method)+len(record.Host)+len(record.Path)+
+		len(record.Op)+len(record.ClientIp)+len(record.User)+len(record.Upstream)+len(record.Status)+len(record.hdfsPath))
+}
+
+// RequestsQuery picks recent requests, zero fields pick all
+type RequestsQuery struct {
+	StatusCode  int
+	StatusClass string `description:"e.g. 5xx"`
+	Method      string
+	Op          string
+	PathPrefix  string `description:"hdfs path of webhdfs requests, matched by path segments"`
+	ClientIp    string
+	User        string
+	RequestId   string
+	MinLatency  time.Duration
+	Since       time.Time
+	Until       time.Time
+	// the newest Offset matching records are skipped, then Limit are returned
+	Offset int
+	Limit  int
+}
+
+func (query *RequestsQuery) match(record *RequestsRecord) bool {
+	switch {
+	case query.StatusCode > 0 && record.StatusCode != query.StatusCode,
+		len(query.StatusClass) > 0 && fmt.Sprintf("%dxx", record.StatusCode/100) != query.StatusClass,
+		len(query.Method) > 0 && !strings.EqualFold(record.Method, query.Method),
+		len(query.Op) > 0 && record.Op != query.Op,
+		len(query.PathPrefix) > 0 && !matchHdfsPath(query.PathPrefix, record.hdfsPath),
+		len(query.ClientIp) > 0 && record.ClientIp != query.ClientIp,
+		len(query.User) > 0 && record.User != query.User,
+		len(query.RequestId) > 0 && record.RequestId != query.RequestId,
+		record.Delay < query.MinLatency,
+		!query.Since.IsZero() && record.Time.Before(query.Since),
+		!query.Until.IsZero() && !record.Time.Before(query.Until):
+		return false
+	}
+	return true
+}
+
+// requestLog keeps the latest records within a memory budget, the oldest are dropped first
+type requestLog struct {
+	budget  int64
+	records []RequestsRecord `description:"records before head are dropped"`
+	head    int
+	size    int64
+}
+
+func (log *requestLog) add(record RequestsRecord) {
+	log.records = append(log.records, record)
+	log.size += record.size()
+	for log.size > log.budget && len(log.records)-log.head > 1 {
+		log.size -= log.records[log.head].size()
+		log.records[log.head] = RequestsRecord{}
+		log.head++
+	}
+	// move records down once half of the slice is dropped, so that it does not grow forever
+	if log.head > len(log.records)/2 {
+		n := copy(log.records, log.records[log.head:])
+		for i := n; i < len(log.records); i++ {
+			log.records[i] = RequestsRecord{}
+		}
+		log.records = log.records[:n]
+		log.head = 0
+	}
+}
+
+func (log *requestLog) len() int {
+	return len(log.records) - log.head
+}
+
+// find returns a page of records matching query, oldest first, and how many records match in all
+func (log *requestLog) find(query *RequestsQuery) ([]RequestsRecord, int) {
+	page := []RequestsRecord{}
+	matched := 0
+	for i := len(log.records) - 1; i >= log.head; i-- {
+		if !query.match(&log.records[i]) {
+			continue
+		}
+		if matched >= query.Offset && matched < query.Offset+query.Limit {
+			page = append(page, log.records[i])
+		}
+		matched++
+	}
+	for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+		page[i], page[j] = page[j], page[i]
+	}
+	return page, matched
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatisticsWindow(t *testing.T) {
+	m := NewStatisticsMiddleware(10, 0)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	m.started = now.Add(-2 * time.Hour)
+	m.now = func() time.Time { return now }
+	// every request takes latency, from the clock of the middleware
+	serve := func(target string, statusCode int, latency time.Duration) {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil), func(rw http.ResponseWriter, r *http.Request) {
+			now = now.Add(latency)
+			rw.WriteHeader(statusCode)
+		})
+	}
+
+	// 10 minutes ago OPEN streams were slow
+	now = now.Add(-10 * time.Minute)
+	for i := 0; i < 10; i++ {
+		serve("/webhdfs/v1/tmp/a?op=OPEN", http.StatusOK, 2*time.Second)
+	}
+	// the last minute LISTSTATUS is slow and fails at times
+	now = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC).Add(-30 * time.Second)
+	for i := 0; i < 100; i++ {
+		statusCode := http.StatusOK
+		if i%10 == 0 {
+			statusCode = http.StatusServiceUnavailable
+		}
+		serve("/webhdfs/v1/tmp?op=LISTSTATUS", statusCode, 100*time.Millisecond)
+	}
+	serve("/ws/v1/cluster/apps", http.StatusOK, 10*time.Millisecond)
+	now = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	summary := struct {
+		Windows map[string]WindowSummary `json:"windows"`
+	}{}
+	assert.Nil(t, json.Unmarshal([]byte(m.Summary()), &summary))
+	lastMinute := summary.Windows["1m"]
+	assert.Equal(t, uint64(101), lastMinute.Total.Requests)
+	assert.Equal(t, uint64(0), lastMinute.ByOp["OPEN"].Requests)
+	listStatus := lastMinute.ByOp["LISTSTATUS"]
+	assert.Equal(t, uint64(100), listStatus.Requests)
+	assert.InDelta(t, 0.1, listStatus.ErrorRate, 0.001)
+	assert.InDelta(t, 100.0/60, listStatus.RatePerSecond, 0.001)
+	// percentiles are within the growth of latency buckets
+	assert.InDelta(t, 100, listStatus.P50Ms, 25)
+	assert.InDelta(t, 100, listStatus.P99Ms, 25)
+	assert.Equal(t, uint64(10), lastMinute.ByStatusClass["5xx"].Requests)
+	assert.Equal(t, uint64(91), lastMinute.ByStatusClass["2xx"].Requests)
+
+	hour := summary.Windows["60m"]
+	assert.Equal(t, uint64(111), hour.Total.Requests)
+	assert.InDelta(t, 2000, hour.ByOp["OPEN"].P90Ms, 500)
+
+	timeseries := struct {
+		Points []TimeseriesPoint `json:"points"`
+	}{}
+	assert.Nil(t, json.Unmarshal([]byte(m.Timeseries("OPEN", "", 15*time.Minute)), &timeseries))
+	assert.Equal(t, 15, len(timeseries.Points))
+	var requests uint64
+	for _, point := range timeseries.Points {
+		requests += point.Requests
+	}
+	assert.Equal(t, uint64(10), requests)
+	assert.Equal(t, now.Add(-14*time.Minute), timeseries.Points[0].Time)
+	assert.Nil(t, json.Unmarshal([]byte(m.Timeseries("", "5xx", time.Minute)), &timeseries))
+	assert.Equal(t, uint64(0), timeseries.Points[0].Requests)
+	assert.Nil(t, json.Unmarshal([]byte(m.Timeseries("", "5xx", 2*time.Minute)), &timeseries))
+	assert.Equal(t, uint64(10), timeseries.Points[0].Requests)
+}
+
+func TestStatisticsRecentRequests(t *testing.T) {
+	m := NewStatisticsMiddleware(2, 0)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	serve := func(method string, target string, statusCode int, latency time.Duration) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = "10.0.0.1:40000"
+		m.ServeHTTP(rw, r, func(rw http.ResponseWriter, r *http.Request) {
+			info := util.RequestInfoOf(r)
+			info.Attempts = 2
+			info.Upstream = "nn1:50070"
+			now = now.Add(latency)
+			rw.WriteHeader(statusCode)
+		})
+		return rw
+	}
+	recentRequests := func(query RequestsQuery) ([]RequestsRecord, int) {
+		statistics := struct {
+			RecentRequests  []RequestsRecord `json:"recentRequests"`
+			MatchedRequests int              `json:"matchedRequests"`
+		}{}
+		assert.Nil(t, json.Unmarshal([]byte(m.Json(query)), &statistics))
+		return statistics.RecentRequests, statistics.MatchedRequests
+	}
+
+	serve("GET", "/webhdfs/v1/data/a?op=OPEN&user.name=bob", http.StatusOK, time.Second)
+	now = now.Add(20 * time.Minute)
+	for i := 0; i < 5; i++ {
+		serve("PUT", "/webhdfs/v1/data/b?op=CREATE&user.name=bob", http.StatusServiceUnavailable, time.Duration(i)*time.Second)
+	}
+	serve("PUT", "/webhdfs/v1/database/c?op=CREATE&user.name=bob", http.StatusServiceUnavailable, time.Second)
+	rw := serve("GET", "/ws/v1/cluster/apps", http.StatusOK, time.Millisecond)
+
+	// records tell who asked, where it was sent and by which id it was answered
+	records, matched := recentRequests(RequestsQuery{})
+	assert.Equal(t, 8, matched)
+	assert.Equal(t, 2, len(records))
+	latest := records[1]
+	assert.Equal(t, "/ws/v1/cluster/apps", latest.Path)
+	assert.Equal(t, rw.Header().Get(util.RequestIdHeader), latest.RequestId)
+	assert.Equal(t, 32, len(latest.RequestId))
+	assert.Equal(t, "10.0.0.1", latest.ClientIp)
+	assert.Equal(t, "nn1:50070", latest.Upstream)
+	assert.Equal(t, 1, latest.Retries)
+	assert.Equal(t, "bob", records[0].User)
+	assert.Equal(t, "CREATE", records[0].Op)
+
+	// 5xx PUTs under /data in the last 10 minutes, slower than a second, the newest first skipped
+	query := RequestsQuery{StatusClass: "5xx", Method: "put", PathPrefix: "/data", Since: now.Add(-10 * time.Minute),
+		MinLatency: time.Second, Offset: 1, Limit: 10}
+	records, matched = recentRequests(query)
+	assert.Equal(t, 4, matched)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, time.Second, records[0].Delay)
+	assert.Equal(t, 3*time.Second, records[2].Delay)
+	_, matched = recentRequests(RequestsQuery{StatusCode: http.StatusOK, Until: now.Add(-10 * time.Minute), Limit: 10})
+	assert.Equal(t, 1, matched)
+
+	// a client's request id is kept, the oldest records are dropped once the memory budget is spent
+	m = NewStatisticsMiddleware(10, 4*requestsRecordSize)
+	r := httptest.NewRequest("GET", "/webhdfs/v1/?op=LISTSTATUS", nil)
+	r.Header.Set(util.RequestIdHeader, "client-id")
+	m.ServeHTTP(httptest.NewRecorder(), r, func(rw http.ResponseWriter, r *http.Request) {})
+	records, _ = recentRequests(RequestsQuery{RequestId: "client-id"})
+	assert.Equal(t, 1, len(records))
+	for i := 0; i < 10; i++ {
+		serve("GET", "/webhdfs/v1/?op=GETFILESTATUS", http.StatusOK, time.Millisecond)
+	}
+	records, matched = recentRequests(RequestsQuery{})
+	assert.True(t, matched < 4 && matched > 0)
+	assert.Equal(t, matched, m.recentRequests.len())
+	assert.Equal(t, "GETFILESTATUS", records[len(records)-1].Op)
+	assert.True(t, m.recentRequests.size <= m.recentRequests.budget)
+}
+
+func TestStatisticsRecordsNoCredentials(t *testing.T) {
+	m := NewStatisticsMiddleware(10, 0)
+	for _, target := range []string{
+		"/webhdfs/v1/data/a?op=OPEN&delegation=SECRET&offset=8",
+		"/webhdfs/v1/?op=CANCELDELEGATIONTOKEN&Token=SECRET",
+		"/webhdfs/v1/data/a?Delegation=SECRET",
+		"/webhdfs/v1/data/a?op=OPEN&%64elegation=SECRET",
+	} {
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil), func(rw http.ResponseWriter, r *http.Request) {
+			assert.Contains(t, r.URL.RawQuery, "SECRET")
+		})
+	}
+
+	statistics := struct {
+		RecentRequests []RequestsRecord `json:"recentRequests"`
+	}{}
+	assert.Nil(t, json.Unmarshal([]byte(m.Json(RequestsQuery{})), &statistics))
+	paths := make([]string, 0, len(statistics.RecentRequests))
+	for _, record := range statistics.RecentRequests {
+		paths = append(paths, record.Path)
+	}
+	assert.Equal(t, []string{
+		"/webhdfs/v1/data/a?op=OPEN&offset=8",
+		"/webhdfs/v1/?op=CANCELDELEGATIONTOKEN",
+		"/webhdfs/v1/data/a",
+		"/webhdfs/v1/data/a?op=OPEN",
+	}, paths)
+}
+
+func TestStatisticsMiddlewareFlush(t *testing.T) {
+	m := NewStatisticsMiddleware(10, 0)
+	rw := httptest.NewRecorder()
+	m.ServeHTTP(rw, httptest.NewRequest("GET", "/webhdfs/v1/tmp/a?op=OPEN", nil), func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("0123"))
+		flusher, ok := rw.(http.Flusher)
+		if assert.True(t, ok) {
+			flusher.Flush()
+		}
+	})
+	assert.True(t, rw.Flushed)
+}
@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	windowSlotDuration = 10 * time.Second
+	// slots of an hour, the longest window summarized
+	windowSlots = 360
+
+	// latency buckets grow by a quarter from 1ms, percentiles are off by at most that much
+	latencyBucketBase   = float64(time.Millisecond)
+	latencyBucketGrowth = 1.25
+	latencyBucketCount  = 64
+)
+
+// summaryWindows are the spans summarized by /statistics/summary, keyed by their names
+var summaryWindows = []struct {
+	name string
+	span time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"60m", time.Hour},
+}
+
+// latencyBounds are upper bounds of latency buckets in ns, the last bucket is unbounded
+var latencyBounds = func() []float64 {
+	bounds := make([]float64, latencyBucketCount-1)
+	for i := range bounds {
+		bounds[i] = latencyBucketBase * math.Pow(latencyBucketGrowth, float64(i))
+	}
+	return bounds
+}()
+
+// latencyHistogram counts requests by latency bucket
+type latencyHistogram struct {
+	buckets [latencyBucketCount]uint32
+	count   uint64
+	errors  uint64 `description:"requests answered 5xx"`
+}
+
+func (h *latencyHistogram) observe(latency time.Duration, failed bool) {
+	h.buckets[sort.SearchFloat64s(latencyBounds, float64(latency))]++
+	h.count++
+	if failed {
+		h.errors++
+	}
+}
+
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	for i := range h.buckets {
+		h.buckets[i] += other.buckets[i]
+	}
+	h.count += other.count
+	h.errors += other.errors
+}
+
+// percentile interpolates the latency in ms below which q of requests are, within its bucket
+func (h *latencyHistogram) percentile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var cumulative float64
+	for i, n := range h.buckets {
+		if n == 0 || cumulative+float64(n) < rank {
+			cumulative += float64(n)
+			continue
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+		if i == len(latencyBounds) {
+			return lower / float64(time.Millisecond)
+		}
+		return (lower + (latencyBounds[i]-lower)*(rank-cumulative)/float64(n)) / float64(time.Millisecond)
+	}
+	return latencyBounds[len(latencyBounds)-1] / float64(time.Millisecond)
+}
+
+// WindowStats summarizes requests over a span, latency in ms
+type WindowStats struct {
+	Requests      uint64  `json:"requests"`
+	RatePerSecond float64 `json:"ratePerSecond"`
+	ErrorRate     float64 `json:"errorRate"`
+	P50Ms         float64 `json:"p50Ms"`
+	P90Ms         float64 `json:"p90Ms"`
+	P99Ms         float64 `json:"p99Ms"`
+}
+
+func (h *latencyHistogram) stats(span time.Duration) WindowStats {
+	stats := WindowStats{Requests: h.count}
+	if h.count == 0 {
+		return stats
+	}
+	stats.RatePerSecond = float64(h.count) / span.Seconds()
+	stats.ErrorRate = float64(h.errors) / float64(h.count)
+	stats.P50Ms = h.percentile(0.5)
+	stats.P90Ms = h.percentile(0.9)
+	stats.P99Ms = h.percentile(0.99)
+	return stats
+}
+
+// windowSlot holds requests served within windowSlotDuration from start
+type windowSlot struct {
+	start         time.Time
+	total         latencyHistogram
+	byOp          map[string]*latencyHistogram
+	byStatusClass map[string]*latencyHistogram
+}
+
+// slidingWindow keeps histograms of the last hour in a ring of slots, the oldest one is reused for a new slot
+type slidingWindow struct {
+	slots [windowSlots]*windowSlot
+}
+
+func (w *slidingWindow) observe(now time.Time, op string, statusClass string, latency time.Duration, failed bool) {
+	start := now.Truncate(windowSlotDuration)
+	index := int(start.Unix()/int64(windowSlotDuration/time.Second)) % windowSlots
+	slot := w.slots[index]
+	if slot == nil || !slot.start.Equal(start) {
+		slot = &windowSlot{start: start, byOp: make(map[string]*latencyHistogram), byStatusClass: make(map[string]*latencyHistogram)}
+		w.slots[index] = slot
+	}
+	slot.total.observe(latency, failed)
+	if len(op) > 0 {
+		observeKey(slot.byOp, op, latency, failed)
+	}
+	observeKey(slot.byStatusClass, statusClass, latency, failed)
+}
+
+func observeKey(histograms map[string]*latencyHistogram, key string, latency time.Duration, failed bool) {
+	h, ok := histograms[key]
+	if !ok {
+		h = &latencyHistogram{}
+		histograms[key] = h
+	}
+	h.observe(latency, failed)
+}
+
+// slotsSince returns slots starting at from or later, oldest first
+func (w *slidingWindow) slotsSince(from time.Time) []*windowSlot {
+	var slots []*windowSlot
+	for _, slot := range w.slots {
+		if slot != nil && !slot.start.Before(from) {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i].start.Before(slots[j].start) })
+	return slots
+}
+
+// WindowSummary is requests of a window in total, by webhdfs op and by status class
+type WindowSummary struct {
+	Total         WindowStats            `json:"total"`
+	ByOp          map[string]WindowStats `json:"byOp"`
+	ByStatusClass map[string]WindowStats `json:"byStatusClass"`
+}
+
+// summary merges the slots within span, rates of a span longer than the window has lived (since started)
+// are over the time lived
+func (w *slidingWindow) summary(now time.Time, span time.Duration, started time.Time) WindowSummary {
+	total := &latencyHistogram{}
+	byOp := make(map[string]*latencyHistogram)
+	byStatusClass := make(map[string]*latencyHistogram)
+	for _, slot := range w.slotsSince(now.Add(-span).Truncate(windowSlotDuration).Add(windowSlotDuration)) {
+		total.merge(&slot.total)
+		mergeKeys(byOp, slot.byOp)
+		mergeKeys(byStatusClass, slot.byStatusClass)
+	}
+
+	rateSpan := span
+	if lived := now.Sub(started); lived < span {
+		rateSpan = lived
+		if rateSpan < time.Second {
+			rateSpan = time.Second
+		}
+	}
+	summary := WindowSummary{
+		Total:         total.stats(rateSpan),
+		ByOp:          make(map[string]WindowStats),
+		ByStatusClass: make(map[string]WindowStats),
+	}
+	for op, h := range byOp {
+		summary.ByOp[op] = h.stats(rateSpan)
+	}
+	for statusClass, h := range byStatusClass {
+		summary.ByStatusClass[statusClass] = h.stats(rateSpan)
+	}
+	return summary
+}
+
+func mergeKeys(merged map[string]*latencyHistogram, histograms map[string]*latencyHistogram) {
+	for key, h := range histograms {
+		if _, ok := merged[key]; !ok {
+			merged[key] = &latencyHistogram{}
+		}
+		merged[key].merge(h)
+	}
+}
+
+// TimeseriesPoint is requests of one step starting at Time
+type TimeseriesPoint struct {
+	Time time.Time `json:"time"`
+	WindowStats
+}
+
+// timeseries returns a point per step over span, of requests picked by pick (e.g. one op) from every slot
+func (w *slidingWindow) timeseries(now time.Time, span time.Duration, step time.Duration, pick func(slot *windowSlot) *latencyHistogram) []TimeseriesPoint {
+	end := now.Truncate(step).Add(step)
+	points := make([]TimeseriesPoint, 0, int(span/step))
+	histograms := make([]latencyHistogram, int(span/step))
+	from := end.Add(-span)
+	for _, slot := range w.slotsSince(from) {
+		if h := pick(slot); h != nil {
+			histograms[int(slot.start.Sub(from)/step)].merge(h)
+		}
+	}
+	for i := range histograms {
+		points = append(points, TimeseriesPoint{Time: from.Add(time.Duration(i) * step), WindowStats: histograms[i].stats(step)})
+	}
+	return points
+}
@@ -1,9 +1,11 @@
 package provider
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	"active-proxy/util"
 )
@@ -14,6 +16,8 @@ const (
 	INIT = ProviderState(iota)
 	RUN
 	PEND
+	// zookeeper refuses the credentials of the proxy
+	AUTH_FAIL
 )
 
 func (state ProviderState) String() string {
@@ -24,6 +28,8 @@ func (state ProviderState) String() string {
 		return "running"
 	case PEND:
 		return "pending"
+	case AUTH_FAIL:
+		return "auth_failed"
 	default:
 		return "unknown"
 	}
@@ -33,6 +39,7 @@ type ProviderType int
 
 const (
 	HDFS = ProviderType(iota)
+	YARN
 	DEFAULT
 )
 
@@ -40,6 +47,8 @@ func (providerType ProviderType) String() string {
 	switch providerType {
 	case HDFS:
 		return "hdfs_proxy_provider"
+	case YARN:
+		return "yarn_proxy_provider"
 	default:
 		return "unknown_proxy_provider"
 	}
@@ -66,21 +75,156 @@ func (providerConf ProviderConf) GetString(key string) string {
 	return providerConf[key].(string)
 }
 
+func (providerConf ProviderConf) GetStringOrDefault(key string, defaultVal string) string {
+	if _, ok := providerConf[key]; ok || len(os.Getenv(key)) > 0 {
+		return providerConf.GetString(key)
+	}
+	return defaultVal
+}
+
+func (providerConf ProviderConf) GetIntOrDefault(key string, defaultVal int) int {
+	if _, ok := providerConf[key]; ok || len(os.Getenv(key)) > 0 {
+		return providerConf.GetInt(key)
+	}
+	return defaultVal
+}
+
+func (providerConf ProviderConf) GetBoolOrDefault(key string, defaultVal bool) bool {
+	if boolVal, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return boolVal
+	}
+	if value, ok := providerConf[key]; ok {
+		switch v := value.(type) {
+		case bool:
+			return v
+		case string:
+			if boolVal, err := strconv.ParseBool(v); err == nil {
+				return boolVal
+			}
+		}
+	}
+	return defaultVal
+}
+
+// GetStringSlice reads a yaml list, or a comma separated string
+func (providerConf ProviderConf) GetStringSlice(key string) []string {
+	var items []string
+	if envVal := os.Getenv(key); len(envVal) > 0 {
+		items = strings.Split(envVal, ",")
+	} else {
+		switch v := providerConf[key].(type) {
+		case string:
+			items = strings.Split(v, ",")
+		case []interface{}:
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+		}
+	}
+	values := []string{}
+	for _, item := range items {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// GetConf returns the nested configuration under key, or nil if key is absent
+func (providerConf ProviderConf) GetConf(key string) ProviderConf {
+	value, ok := providerConf[key]
+	if !ok || value == nil {
+		return nil
+	}
+	conf := make(map[string]interface{})
+	switch m := value.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			conf[fmt.Sprint(k)] = v
+		}
+	case map[string]interface{}:
+		for k, v := range m {
+			conf[k] = v
+		}
+	}
+	return ProviderConf(conf)
+}
+
 type ProviderStats struct {
-	State   string `json:"provider_state"`
-	Explain string `json:"state_explanation"`
+	State        string             `json:"provider_state"`
+	Explain      string             `json:"state_explanation"`
+	Nameservices []NameserviceStats `json:"nameservices,omitempty"`
+}
+
+type NameserviceStats struct {
+	Name           string          `json:"name"`
+	State          string          `json:"state"`
+	ActiveNamenode string          `json:"active_namenode"`
+	ActiveChanges  int             `json:"active_changes"`
+	ZkSessionState string          `json:"zk_session_state,omitempty"`
+	Namenodes      []NamenodeStats `json:"namenodes,omitempty"`
+}
+
+type NamenodeStats struct {
+	HttpAddress string `json:"http_address"`
+	HAState     string `json:"ha_state"`
 }
 
 func (stats ProviderStats) Json() string {
 	return util.JsonMarshal(stats)
 }
 
+// providerStates are written as gauges, 1 for the current state and 0 for the others
+var providerStates = []ProviderState{INIT, RUN, PEND, AUTH_FAIL}
+
+// WriteMetrics writes provider and nameservice states, active namenodes and zookeeper sessions
+func (stats ProviderStats) WriteMetrics(metrics *util.MetricsWriter) {
+	metrics.Header("acproxy_provider_state", "gauge", "State of the proxy provider, 1 for the current one.")
+	for _, state := range providerStates {
+		metrics.Sample("acproxy_provider_state", util.BoolMetric(stats.State == state.String()), "state", state.String())
+	}
+	if len(stats.Nameservices) == 0 {
+		return
+	}
+
+	metrics.Header("acproxy_nameservice_state", "gauge", "State of the nameservice, 1 for the current one.")
+	for _, ns := range stats.Nameservices {
+		for _, state := range providerStates {
+			metrics.Sample("acproxy_nameservice_state", util.BoolMetric(ns.State == state.String()), "nameservice", ns.Name, "state", state.String())
+		}
+	}
+	metrics.Header("acproxy_active_namenode", "gauge", "Active namenode of the nameservice, by label.")
+	for _, ns := range stats.Nameservices {
+		if len(ns.ActiveNamenode) > 0 {
+			metrics.Sample("acproxy_active_namenode", 1, "nameservice", ns.Name, "namenode", ns.ActiveNamenode)
+		}
+	}
+	metrics.Header("acproxy_active_namenode_changes_total", "counter", "Times the active namenode of the nameservice has changed.")
+	for _, ns := range stats.Nameservices {
+		metrics.Sample("acproxy_active_namenode_changes_total", float64(ns.ActiveChanges), "nameservice", ns.Name)
+	}
+	metrics.Header("acproxy_zk_session_state", "gauge", "State of the zookeeper session watching the nameservice, by label.")
+	for _, ns := range stats.Nameservices {
+		if len(ns.ZkSessionState) > 0 {
+			metrics.Sample("acproxy_zk_session_state", 1, "nameservice", ns.Name, "state", ns.ZkSessionState)
+		}
+	}
+}
+
 // ProxyProvider defines methods of a provider
 type ProxyProvider interface {
 	Proxy(rw http.ResponseWriter, r *http.Request) int
 	GetStats() ProviderStats
 }
 
+// HealthChecker is implemented by providers which tell more than their state about liveness and readiness
+type HealthChecker interface {
+	// Healthy returns why the provider cannot recover by itself, nil if it is alive
+	Healthy() error
+	// Ready returns why requests should not be sent to the provider now, nil if they may
+	Ready() error
+}
+
 // BaseProxyProvider should be inherited by providers
 type BaseProxyProvider struct {
 	Conf      ProviderConf
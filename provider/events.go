@@ -0,0 +1,118 @@
+package provider
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventHistorySizeConfKey = "HDFS_EVENT_HISTORY_SIZE"
+
+	eventHistorySizeDefault = 1000
+	// events a subscriber may fall behind, a slower one is dropped and reconnects with Last-Event-ID
+	eventSubscriberBuffer = 64
+
+	EventProviderState    = "provider_state"
+	EventNameserviceState = "nameservice_state"
+	EventActiveNamenode   = "active_namenode"
+
+	ReasonStarted         = "proxy started"
+	ReasonZnodeDeleted    = "znode deleted"
+	ReasonZnodeChanged    = "znode changed"
+	ReasonPollRecovered   = "poll recovered"
+	ReasonZkAuthFailed    = "zookeeper auth failed"
+	ReasonStandby         = "active namenode turns out standby"
+	ReasonProbeActive     = "probe found active namenode"
+	ReasonProbeLostActive = "probe found no active namenode"
+)
+
+// ProviderEvent is a transition of the provider state, a nameservice state or the active namenode of a nameservice
+type ProviderEvent struct {
+	Id          int64     `json:"id"`
+	Time        time.Time `json:"time"`
+	Kind        string    `json:"kind"`
+	Nameservice string    `json:"nameservice,omitempty"`
+	Old         string    `json:"old"`
+	New         string    `json:"new"`
+	Reason      string    `json:"reason"`
+	PendingMs   int64     `json:"pending_ms,omitempty" description:"time spent in pending, for transitions leaving it"`
+}
+
+// EventSource is implemented by providers which keep a history of their transitions
+type EventSource interface {
+	EventHistory() []ProviderEvent
+	// SubscribeEvents returns the history and a channel of later events, which is closed if the subscriber
+	// falls behind; cancel stops the subscription
+	SubscribeEvents() (history []ProviderEvent, events <-chan ProviderEvent, cancel func())
+}
+
+// eventLog keeps the latest events and passes new ones to subscribers, a nil eventLog records nothing
+type eventLog struct {
+	mutex       sync.Mutex
+	size        int
+	events      []ProviderEvent
+	lastId      int64
+	subscribers map[chan ProviderEvent]struct{}
+}
+
+func newEventLog(size int) *eventLog {
+	if size <= 0 {
+		size = eventHistorySizeDefault
+	}
+	return &eventLog{size: size, subscribers: make(map[chan ProviderEvent]struct{})}
+}
+
+func (log *eventLog) record(event ProviderEvent) {
+	if log == nil {
+		return
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.lastId++
+	event.Id = log.lastId
+	log.events = append(log.events, event)
+	if len(log.events) > log.size {
+		log.events = log.events[len(log.events)-log.size:]
+	}
+	for subscriber := range log.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(log.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+func (log *eventLog) history() []ProviderEvent {
+	if log == nil {
+		return nil
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return append([]ProviderEvent{}, log.events...)
+}
+
+func (log *eventLog) subscribe() ([]ProviderEvent, <-chan ProviderEvent, func()) {
+	subscriber := make(chan ProviderEvent, eventSubscriberBuffer)
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.subscribers[subscriber] = struct{}{}
+	cancel := func() {
+		log.mutex.Lock()
+		defer log.mutex.Unlock()
+		if _, ok := log.subscribers[subscriber]; ok {
+			delete(log.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return append([]ProviderEvent{}, log.events...), subscriber, cancel
+}
+
+// pendingMs is the time spent in pending since since, if old is pending
+func pendingMs(old ProviderState, since time.Time, now time.Time) int64 {
+	if old != PEND || since.IsZero() {
+		return 0
+	}
+	return int64(now.Sub(since) / time.Millisecond)
+}
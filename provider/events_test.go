@@ -0,0 +1,49 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventLog(t *testing.T) {
+	log := newEventLog(2)
+	history, events, cancel := log.subscribe()
+	assert.Equal(t, 0, len(history))
+
+	for _, state := range []ProviderState{RUN, PEND, RUN} {
+		log.record(ProviderEvent{Kind: EventProviderState, New: state.String()})
+	}
+	// the history keeps the latest events only, subscribers get every one
+	history = log.history()
+	assert.Equal(t, 2, len(history))
+	assert.Equal(t, int64(2), history[0].Id)
+	assert.Equal(t, int64(3), history[1].Id)
+	for id := int64(1); id <= 3; id++ {
+		assert.Equal(t, id, (<-events).Id)
+	}
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+	cancel()
+
+	// a subscriber falling behind is dropped
+	_, events, cancel = log.subscribe()
+	defer cancel()
+	for i := 0; i <= eventSubscriberBuffer; i++ {
+		log.record(ProviderEvent{Kind: EventActiveNamenode})
+	}
+	for range events {
+	}
+	assert.Equal(t, 0, len(log.subscribers))
+
+	var nilLog *eventLog
+	nilLog.record(ProviderEvent{})
+	assert.Nil(t, nilLog.history())
+
+	since := time.Now()
+	assert.Equal(t, int64(1500), pendingMs(PEND, since, since.Add(1500*time.Millisecond)))
+	assert.Equal(t, int64(0), pendingMs(RUN, since, since.Add(time.Second)))
+	assert.Equal(t, int64(0), pendingMs(PEND, time.Time{}, since))
+}
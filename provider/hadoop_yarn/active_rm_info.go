@@ -0,0 +1,40 @@
+// Package hadoop_yarn holds ActiveRMInfoProto of yarn_server_resourcemanager_service_protos.proto, the data of the
+// leader election znode of resourcemanagers; it is written by hand after what protoc-gen-go would generate,
+// without the file descriptor, which the proxy never reads
+package hadoop_yarn
+
+import proto "github.com/golang/protobuf/proto"
+
+// ActiveRMInfoProto is
+//
+//	message ActiveRMInfoProto {
+//	  optional string clusterId = 1;
+//	  optional string rmId = 2;
+//	}
+type ActiveRMInfoProto struct {
+	ClusterId        *string `protobuf:"bytes,1,opt,name=clusterId" json:"clusterId,omitempty"`
+	RmId             *string `protobuf:"bytes,2,opt,name=rmId" json:"rmId,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ActiveRMInfoProto) Reset()         { *m = ActiveRMInfoProto{} }
+func (m *ActiveRMInfoProto) String() string { return proto.CompactTextString(m) }
+func (*ActiveRMInfoProto) ProtoMessage()    {}
+
+func (m *ActiveRMInfoProto) GetClusterId() string {
+	if m != nil && m.ClusterId != nil {
+		return *m.ClusterId
+	}
+	return ""
+}
+
+func (m *ActiveRMInfoProto) GetRmId() string {
+	if m != nil && m.RmId != nil {
+		return *m.RmId
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*ActiveRMInfoProto)(nil), "hadoop.yarn.ActiveRMInfoProto")
+}
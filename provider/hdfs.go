@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,19 +21,83 @@ import (
 
 type HdfsProxyProvider struct {
 	BaseProxyProvider
-	activeNNAddress string `description:"active namenode address"`
-	zkLockPath      string `description:"zkPath which contains active namenode info"`
+	nameservices       []*hdfsNameservice `description:"nameservices ordered by name"`
+	defaultNameservice *hdfsNameservice   `description:"nameservice of paths out of mount table"`
+	mountTable         MountTable         `description:"path prefixes linked to nameservices"`
+	readRouter         *readRouter        `description:"routes reads to observer namenodes, nil if disabled"`
+	datanodeGateway    *datanodeGateway   `description:"relays data streams to datanodes, nil if disabled"`
+
+	fsDefaultNameservice string          `description:"nameservice of fs.defaultFS in hadoop configuration"`
+	transport            *http.Transport `description:"shared by proxying and probing, carries tls settings"`
+	upstreamTLS          bool            `description:"namenodes are reached through https"`
+	kerberos             *kerberosAuth   `description:"spnego authentication to namenodes, nil if disabled"`
+	tokens               *tokenManager   `description:"delegation tokens got on behalf of users, nil if disabled"`
+	events               *eventLog       `description:"history of state transitions and active namenode changes"`
+	pendingSince         time.Time       `description:"when the overall state last became pending"`
 
 	initWg sync.WaitGroup
 	mutex  sync.RWMutex
 }
 
+// hdfsNameservice tracks the active namenode of one nameservice, its fields are guarded by provider mutex
+type hdfsNameservice struct {
+	name                string
+	haDetection         string `description:"how to find active namenode, zk or http"`
+	zkServers           []string
+	zkLockPath          string                    `description:"zkPath which contains active namenode info"`
+	zkOptions           []zkClient.ZKClientOption `description:"auth and acl of zookeeper sessions"`
+	zkSaslSpn           string                    `description:"zookeeper principal of kerberos sasl, empty if sasl is off"`
+	webHdfsPort         string
+	namenodes           []*hdfsNamenode
+	activeNNAddress     string `description:"active namenode address"`
+	activeNNHttpAddress string `description:"host:port serving webhdfs of active namenode"`
+	state               ProviderState
+	stateChan           chan stateChange
+	resolveChan         chan struct{}      `description:"asks the monitor to find active namenode again at once"`
+	activeChanges       int                `description:"times the active namenode has changed to another one"`
+	zkSession           *zkClient.ZKClient `description:"session watching zkLockPath, nil until connected"`
+	pendingSince        time.Time          `description:"when the state last became pending"`
+	lockRead            *lockRead          `description:"read of zkLockPath zookeeper has not answered yet, used by the monitor only"`
+	monitorBeat         time.Time          `description:"when the monitor of the active namenode last went round its loop"`
+}
+
+// lockWatcher reads zkLockPath and watches it, it is a zookeeper client
+type lockWatcher interface {
+	GetW(zkPath string) ([]byte, <-chan zk.Event, error)
+}
+
+// lockRead is a GetW of zkLockPath, whose results are set once done is closed
+type lockRead struct {
+	done  chan struct{}
+	data  []byte
+	watch <-chan zk.Event
+	err   error
+}
+
+// stateChange is a state a nameservice enters and why
+type stateChange struct {
+	state  ProviderState
+	reason string
+}
+
 const (
-	ZkServersConfKey      = "HDFS_ZK_SERVERS"
-	ZkLockPathConfKey     = "HDFS_ZK_LOCK_PATH"
-	MaxConnectionsConfKey = "HDFS_MAX_CONNECTIONS"
-	WebHdfsPortConfKey    = "HDFS_WEBHDFS_PORT"
-	RequestTimeoutConfKey = "HDFS_REQUEST_TIMEOUT"
+	ZkServersConfKey          = "HDFS_ZK_SERVERS"
+	ZkLockPathConfKey         = "HDFS_ZK_LOCK_PATH"
+	ZkAuthConfKey             = "HDFS_ZK_AUTH"
+	ZkACLConfKey              = "HDFS_ZK_ACL"
+	MaxConnectionsConfKey     = "HDFS_MAX_CONNECTIONS"
+	WebHdfsPortConfKey        = "HDFS_WEBHDFS_PORT"
+	RequestTimeoutConfKey     = "HDFS_REQUEST_TIMEOUT"
+	NameservicesConfKey       = "HDFS_NAMESERVICES"
+	DefaultNameserviceConfKey = "HDFS_DEFAULT_NAMESERVICE"
+	MountTableConfKey         = "HDFS_MOUNT_TABLE"
+	MountTableFileConfKey     = "HDFS_MOUNT_TABLE_FILE"
+	MountTableNameConfKey     = "HDFS_MOUNT_TABLE_NAME"
+
+	zkRetryInterval = time.Duration(3) * time.Second
+
+	defaultNameserviceName = "default"
+	defaultMountTableName  = "default"
 )
 
 func NewHdfsProxyProvider(conf ProviderConf) (*HdfsProxyProvider, error) {
@@ -42,66 +108,451 @@ func NewHdfsProxyProvider(conf ProviderConf) (*HdfsProxyProvider, error) {
 			State:     INIT,
 			StateChan: make(chan ProviderState),
 		},
-		zkLockPath: conf.GetString(ZkLockPathConfKey),
+		events: newEventLog(conf.GetIntOrDefault(EventHistorySizeConfKey, eventHistorySizeDefault)),
+	}
+	if err := provider.initUpstreamTransport(); err != nil {
+		return nil, err
+	}
+	var err error
+	if provider.kerberos, err = newKerberosAuth(conf); err != nil {
+		return nil, err
+	}
+	if err := provider.initNameservices(); err != nil {
+		return nil, err
+	}
+	if err := provider.initZkSasl(); err != nil {
+		return nil, err
 	}
-	provider.Pool, _ = util.NewProxyTaskPool(conf.GetInt(MaxConnectionsConfKey))
+	if err := provider.initMountTable(); err != nil {
+		return nil, err
+	}
+	if provider.tokens, err = newTokenManager(provider); err != nil {
+		return nil, err
+	}
+	provider.readRouter = newReadRouter(conf)
+	provider.datanodeGateway = newDatanodeGateway(conf)
+	provider.Pool, _ = util.NewProxyTaskPool(conf.GetInt(MaxConnectionsConfKey),
+		util.WithResponseModifier(provider.modifyResponse), util.WithTransport(provider.transport))
 	go provider.Pool.Do()
 
-	provider.initWg.Add(2)
-	go provider.monitorZkLockPath()
+	provider.initWg.Add(1 + 2*len(provider.nameservices))
+	for _, ns := range provider.nameservices {
+		if ns.haDetection == HADetectionHttp {
+			go provider.monitorNamenodeStates(ns)
+		} else {
+			go provider.monitorZkLockPath(ns)
+			// zookeeper tells only the active one, observers are found by polling
+			if provider.readRouter != nil && len(ns.namenodes) > 0 {
+				go provider.monitorReadNamenodes(ns)
+			}
+		}
+		go provider.monitorNameserviceState(ns)
+	}
 	go provider.monitorProviderState()
-	// wait until two monitor goroutines finish initialization
+	if provider.tokens != nil {
+		go provider.tokens.monitorTokens()
+	}
+	// wait until all monitor goroutines finish initialization
 	provider.initWg.Wait()
 
 	return provider, nil
 }
 
-func (provider *HdfsProxyProvider) resolveActiveNodeInfo(client *zkClient.ZKClient) (bool, <-chan zk.Event) {
-	data, ch, _ := client.GetW(provider.zkLockPath)
+// initNameservices reads HDFS_NAMESERVICES, entries of which fall back to the top level keys
+// (HDFS_ZK_SERVERS, HDFS_WEBHDFS_PORT, HDFS_HA_DETECTION...); without it a single nameservice is built from the top level keys
+func (provider *HdfsProxyProvider) initNameservices() error {
+	conf := provider.Conf
+	nsConfs := conf.GetConf(NameservicesConfKey)
+	var hadoopConf *hadoopHdfsConf
+	if confDir := os.ExpandEnv(conf.GetStringOrDefault(HadoopConfDirConfKey, "")); len(confDir) > 0 {
+		var err error
+		if hadoopConf, err = loadHadoopHdfsConf(confDir, provider.upstreamScheme() == "https"); err != nil {
+			return fmt.Errorf("load hadoop configuration from %s: %s", confDir, err.Error())
+		}
+		provider.fsDefaultNameservice = hadoopConf.defaultNameservice
+	}
+	if len(nsConfs) == 0 && hadoopConf == nil {
+		ns, err := newHdfsNameservice(defaultNameserviceName, ProviderConf{}, nil, conf)
+		if err != nil {
+			return err
+		}
+		provider.nameservices = []*hdfsNameservice{ns}
+		return nil
+	}
+
+	// nameservices of HDFS_NAMESERVICES are added to those of hadoop configuration, and override their keys
+	derived := make(map[string]*hadoopNameservice)
+	if hadoopConf != nil {
+		derived = hadoopConf.nameservices
+	}
+	names := make([]string, 0, len(nsConfs)+len(derived))
+	for name := range nsConfs {
+		names = append(names, name)
+	}
+	for name := range derived {
+		if _, ok := nsConfs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ns, err := newHdfsNameservice(name, nsConfs.GetConf(name), derived[name], conf)
+		if err != nil {
+			return err
+		}
+		provider.nameservices = append(provider.nameservices, ns)
+	}
+	return nil
+}
+
+// nameserviceKeys differ between nameservices, what hadoop configuration tells of a nameservice wins over
+// top-level values of them, which apply to every nameservice alike
+var nameserviceKeys = map[string]bool{
+	ZkServersConfKey:             true,
+	ZkLockPathConfKey:            true,
+	NamenodeHttpAddressesConfKey: true,
+}
+
+// newHdfsNameservice builds a nameservice from its own configuration, missing keys are looked up in parentConf
+// (keys given there or by environment variables) and in what hadoop configuration tells (derived, may be nil),
+// derived values coming first for nameserviceKeys; keys of the nameservice are read without environment
+// overrides, which could not tell nameservices apart
+func newHdfsNameservice(name string, nsConf ProviderConf, derived *hadoopNameservice, parentConf ProviderConf) (*hdfsNameservice, error) {
+	lookup := func(key string) string {
+		if value, ok := nsConf[key]; ok {
+			return fmt.Sprint(value)
+		}
+		if value, ok := derived.lookup(key); ok && nameserviceKeys[key] {
+			return value
+		}
+		if value := parentConf.GetStringOrDefault(key, ""); len(value) > 0 {
+			return value
+		}
+		if value, ok := derived.lookup(key); ok {
+			return value
+		}
+		return ""
+	}
+	ns := &hdfsNameservice{
+		name:        name,
+		haDetection: lookup(HADetectionConfKey),
+		zkServers:   strings.Split(lookup(ZkServersConfKey), ","),
+		zkLockPath:  lookup(ZkLockPathConfKey),
+		webHdfsPort: lookup(WebHdfsPortConfKey),
+		state:       INIT,
+		stateChan:   make(chan stateChange),
+		resolveChan: make(chan struct{}, 1),
+	}
+	// derived namenodes are known by id, they give way to addresses of the nameservice only
+	addresses := lookup(NamenodeHttpAddressesConfKey)
+	if _, ok := nsConf[NamenodeHttpAddressesConfKey]; !ok && derived != nil && len(derived.namenodes) > 0 {
+		ns.namenodes, addresses = derived.namenodes, ""
+	}
+	for _, address := range strings.Split(addresses, ",") {
+		if address = strings.TrimSpace(address); len(address) > 0 {
+			ns.namenodes = append(ns.namenodes, &hdfsNamenode{httpAddress: address, haState: haStateUnknown})
+		}
+	}
+
+	if auth := lookup(ZkAuthConfKey); len(auth) > 0 {
+		auths, err := zkClient.ParseAuths(auth)
+		if err != nil {
+			return nil, fmt.Errorf("hdfs nameservice %s has invalid %s: %s", name, ZkAuthConfKey, err.Error())
+		}
+		ns.zkOptions = append(ns.zkOptions, zkClient.WithAuth(auths...))
+	}
+	if acl := lookup(ZkACLConfKey); len(acl) > 0 {
+		zkACL, err := zkClient.ParseACL(acl)
+		if err != nil {
+			return nil, fmt.Errorf("hdfs nameservice %s has invalid %s: %s", name, ZkACLConfKey, err.Error())
+		}
+		ns.zkOptions = append(ns.zkOptions, zkClient.WithACL(zkACL))
+	}
+
+	if sasl := lookup(ZkSaslConfKey); len(sasl) > 0 {
+		enabled, err := strconv.ParseBool(sasl)
+		if err != nil {
+			return nil, fmt.Errorf("hdfs nameservice %s has invalid %s %s", name, ZkSaslConfKey, sasl)
+		}
+		if enabled {
+			ns.zkSaslSpn = lookup(ZkSaslSpnConfKey)
+			if len(ns.zkSaslSpn) == 0 {
+				ns.zkSaslSpn = zkSaslSpnDefault
+			}
+		}
+	}
+
+	required := make(map[string]string)
+	switch ns.haDetection {
+	case "", HADetectionZk:
+		ns.haDetection = HADetectionZk
+		required[ZkServersConfKey] = lookup(ZkServersConfKey)
+		required[ZkLockPathConfKey] = ns.zkLockPath
+		// namenodes known by id are reached at their own http address
+		if !ns.namenodesIdentified() {
+			required[WebHdfsPortConfKey] = ns.webHdfsPort
+		}
+	case HADetectionHttp:
+		if len(ns.namenodes) == 0 {
+			required[NamenodeHttpAddressesConfKey] = ""
+		}
+	default:
+		return nil, fmt.Errorf("hdfs nameservice %s has invalid %s %s, expect %s or %s",
+			name, HADetectionConfKey, ns.haDetection, HADetectionZk, HADetectionHttp)
+	}
+	for key, value := range required {
+		if len(value) == 0 {
+			return nil, fmt.Errorf("hdfs nameservice %s lacks %s", name, key)
+		}
+	}
+	return ns, nil
+}
+
+// initMountTable merges links of HDFS_MOUNT_TABLE_FILE (viewfs mounttable xml) and HDFS_MOUNT_TABLE,
+// then decides the default nameservice
+func (provider *HdfsProxyProvider) initMountTable() error {
+	conf := provider.Conf
+	links := make(map[string]string)
+	fallback := ""
+	if file := conf.GetStringOrDefault(MountTableFileConfKey, ""); len(file) > 0 {
+		var err error
+		links, fallback, err = LoadViewFsMountLinks(file, conf.GetStringOrDefault(MountTableNameConfKey, defaultMountTableName))
+		if err != nil {
+			return fmt.Errorf("load mount table %s: %s", file, err.Error())
+		}
+	}
+	for prefix, target := range conf.GetConf(MountTableConfKey) {
+		links[prefix] = fmt.Sprint(target)
+	}
+	mountTable, err := NewMountTable(links)
+	if err != nil {
+		return err
+	}
+	for _, mountPoint := range mountTable {
+		if provider.nameservice(mountPoint.Nameservice) == nil {
+			return fmt.Errorf("mount point %s links to unknown nameservice %s", mountPoint.Prefix, mountPoint.Nameservice)
+		}
+	}
+	provider.mountTable = mountTable
+
+	defaultName := conf.GetStringOrDefault(DefaultNameserviceConfKey, fallback)
+	switch {
+	case len(defaultName) == 0 && len(provider.fsDefaultNameservice) > 0:
+		provider.defaultNameservice = provider.nameservice(provider.fsDefaultNameservice)
+	case len(defaultName) > 0:
+		provider.defaultNameservice = provider.nameservice(defaultName)
+		if provider.defaultNameservice == nil {
+			return fmt.Errorf("unknown default nameservice %s", defaultName)
+		}
+	case len(provider.nameservices) == 1:
+		provider.defaultNameservice = provider.nameservices[0]
+	default:
+		return fmt.Errorf("%s is required when several nameservices are configured", DefaultNameserviceConfKey)
+	}
+	return nil
+}
+
+func (provider *HdfsProxyProvider) nameservice(name string) *hdfsNameservice {
+	for _, ns := range provider.nameservices {
+		if ns.name == name {
+			return ns
+		}
+	}
+	return nil
+}
+
+// zkReadTimeout bounds how long the monitor waits for zookeeper to answer a read of zkLockPath
+var zkReadTimeout = 10 * time.Second
+
+// errZkReadTimeout is neither an auth failure nor a missing lock, the state of the nameservice is kept
+var errZkReadTimeout = fmt.Errorf("zookeeper does not answer the read of the lock in time")
+
+// readLock reads zkLockPath within zkReadTimeout: go-zookeeper holds requests until the session is back, which
+// would stall the monitor all along a zookeeper outage; a read left unanswered is waited for again instead of
+// sending another, it is called by the monitor of ns only
+func readLock(ns *hdfsNameservice, client lockWatcher) ([]byte, <-chan zk.Event, error) {
+	if ns.lockRead == nil {
+		read := &lockRead{done: make(chan struct{})}
+		go func() {
+			read.data, read.watch, read.err = client.GetW(ns.zkLockPath)
+			close(read.done)
+		}()
+		ns.lockRead = read
+	}
+	select {
+	case <-ns.lockRead.done:
+		read := ns.lockRead
+		ns.lockRead = nil
+		return read.data, read.watch, read.err
+	case <-time.After(zkReadTimeout):
+		return nil, nil, errZkReadTimeout
+	}
+}
+
+// resolveActiveNodeInfo returns the error of reading zkLockPath as well, which tells auth failures from a missing lock
+func (provider *HdfsProxyProvider) resolveActiveNodeInfo(ns *hdfsNameservice, client lockWatcher) (bool, <-chan zk.Event, error) {
+	data, ch, err := readLock(ns, client)
 	provider.mutex.Lock()
 	defer provider.mutex.Unlock()
 
 	if data != nil && len(data) != 0 {
 		activeNNInfo := &hadoop_hdfs.ActiveNodeInfo{}
 		proto.Unmarshal(data, activeNNInfo)
-		if provider.activeNNAddress != activeNNInfo.GetHostname() {
-			glog.V(2).Infof("hdfs proxy provider: active namenode address changes from %s to %s.", provider.activeNNAddress, activeNNInfo.GetHostname())
-			provider.activeNNAddress = activeNNInfo.GetHostname()
+		httpAddress := ns.namenodeHttpAddress(activeNNInfo)
+		if len(httpAddress) == 0 {
+			glog.Errorf("hdfs proxy provider: active namenode %s (%s) of %s is not configured and %s is not set.",
+				activeNNInfo.GetNamenodeId(), activeNNInfo.GetHostname(), ns.name, WebHdfsPortConfKey)
+			return false, ch, nil
+		}
+		if ns.activeNNHttpAddress != httpAddress {
+			glog.V(2).Infof("hdfs proxy provider: active namenode address of %s changes from %s to %s.", ns.name, ns.activeNNHttpAddress, httpAddress)
+			provider.setActiveNamenode(ns, activeNNInfo.GetHostname(), httpAddress, ReasonZnodeChanged)
 		}
-		return true, ch
+		return true, ch, nil
 	}
-	return false, ch
+	return false, ch, err
 }
 
-func (provider *HdfsProxyProvider) monitorZkLockPath() {
-	zkServers := strings.Split(provider.Conf.GetString(ZkServersConfKey), ",")
-	client, err := zkClient.NewZKClient(zkServers, 1)
-	if err != nil {
-		glog.Errorln("hdfs proxy provider: init zkclient fail,", err.Error())
-		os.Exit(-1)
+// setActiveNamenode switches ns to a newly found active namenode, provider mutex is held by callers
+func (provider *HdfsProxyProvider) setActiveNamenode(ns *hdfsNameservice, address string, httpAddress string, reason string) {
+	if len(ns.activeNNHttpAddress) > 0 {
+		ns.activeChanges++
 	}
-	success, ch := provider.resolveActiveNodeInfo(client)
-	if success {
-		provider.StateChan <- RUN
+	provider.events.record(ProviderEvent{
+		Time:        time.Now(),
+		Kind:        EventActiveNamenode,
+		Nameservice: ns.name,
+		Old:         ns.activeNNHttpAddress,
+		New:         httpAddress,
+		Reason:      reason,
+	})
+	ns.activeNNAddress = address
+	ns.activeNNHttpAddress = httpAddress
+}
+
+func (provider *HdfsProxyProvider) monitorZkLockPath(ns *hdfsNameservice) {
+	var success bool
+	var ch <-chan zk.Event
+	var resolveErr error
+	provider.beat(ns)
+	client, err := zkClient.NewZKClient(ns.zkServers, 1, ns.zkOptions...)
+	if err == nil {
+		success, ch, resolveErr = provider.resolveActiveNodeInfo(ns, client)
 	}
+	provider.ensureRunning(ns, success, resolveErr, ReasonStarted)
 	provider.initWg.Done()
+	// keep the proxy alive and retry, nameservice stays out of service meanwhile
+	for err != nil {
+		glog.Errorf("hdfs proxy provider: init zkclient of %s fail, retry in %s: %s", ns.name, zkRetryInterval, err.Error())
+		provider.ensureRunning(ns, false, err, ReasonPollRecovered)
+		time.Sleep(zkRetryInterval)
+		provider.beat(ns)
+		client, err = zkClient.NewZKClient(ns.zkServers, 1, ns.zkOptions...)
+	}
+	provider.mutex.Lock()
+	ns.zkSession = client
+	provider.mutex.Unlock()
 	for {
+		provider.beat(ns)
 		select {
 		case e := <-ch:
 			if e.Type == zk.EventNodeDeleted {
-				provider.StateChan <- PEND
+				ns.stateChan <- stateChange{PEND, ReasonZnodeDeleted}
 			}
-			_, ch = provider.resolveActiveNodeInfo(client)
+			_, ch, _ = provider.resolveActiveNodeInfo(ns, client)
+
+		case <-time.After(zkRetryInterval):
+			success, ch, resolveErr = provider.resolveActiveNodeInfo(ns, client)
+			provider.ensureRunning(ns, success, resolveErr, ReasonPollRecovered)
+
+		case <-ns.resolveChan:
+			success, ch, resolveErr = provider.resolveActiveNodeInfo(ns, client)
+			provider.ensureRunning(ns, success, resolveErr, ReasonPollRecovered)
+		}
+	}
+}
+
+// ensureRunning brings ns back into service for reason once its active namenode is resolved,
+// or marks it auth failed while zookeeper refuses the credentials of HDFS_ZK_AUTH
+func (provider *HdfsProxyProvider) ensureRunning(ns *hdfsNameservice, resolved bool, err error, reason string) {
+	provider.mutex.RLock()
+	state := ns.state
+	provider.mutex.RUnlock()
+	// never send with mutex held, or it deadlocks with monitorNameserviceState
+	switch {
+	case resolved && state != RUN:
+		ns.stateChan <- stateChange{RUN, reason}
+	case zkClient.IsAuthError(err) && state != AUTH_FAIL:
+		glog.Errorf("hdfs proxy provider: zookeeper refuses to let %s read %s, check %s and acl of the lock: %s",
+			ns.name, ns.zkLockPath, ZkAuthConfKey, err.Error())
+		ns.stateChan <- stateChange{AUTH_FAIL, ReasonZkAuthFailed}
+	}
+}
 
-		case <-time.After(time.Duration(3) * time.Second):
-			success, ch = provider.resolveActiveNodeInfo(client)
-			provider.mutex.RLock()
-			if success && provider.State != RUN {
-				provider.StateChan <- RUN
+// monitorNameserviceState applies state changes of one nameservice, and passes the overall state on to StateChan;
+// transitions of both are recorded here, where their reason is known
+func (provider *HdfsProxyProvider) monitorNameserviceState(ns *hdfsNameservice) {
+	provider.initWg.Done()
+	for {
+		change := <-ns.stateChan
+		provider.mutex.Lock()
+		oldProviderState := provider.overallState()
+		now := time.Now()
+		if ns.state != change.state {
+			glog.V(2).Infof("hdfs proxy provider: state of %s changes from %s to %s, %s.", ns.name, ns.state, change.state, change.reason)
+			provider.events.record(ProviderEvent{
+				Time:        now,
+				Kind:        EventNameserviceState,
+				Nameservice: ns.name,
+				Old:         ns.state.String(),
+				New:         change.state.String(),
+				Reason:      change.reason,
+				PendingMs:   pendingMs(ns.state, ns.pendingSince, now),
+			})
+			if change.state == PEND {
+				ns.pendingSince = now
 			}
-			provider.mutex.RUnlock()
+			ns.state = change.state
+		}
+		providerState := provider.overallState()
+		if providerState != oldProviderState {
+			provider.events.record(ProviderEvent{
+				Time:      now,
+				Kind:      EventProviderState,
+				Old:       oldProviderState.String(),
+				New:       providerState.String(),
+				Reason:    ns.name + ": " + change.reason,
+				PendingMs: pendingMs(oldProviderState, provider.pendingSince, now),
+			})
+			if providerState == PEND {
+				provider.pendingSince = now
+			}
+		}
+		provider.mutex.Unlock()
+		provider.StateChan <- providerState
+	}
+}
+
+func (provider *HdfsProxyProvider) EventHistory() []ProviderEvent {
+	return provider.events.history()
+}
+
+func (provider *HdfsProxyProvider) SubscribeEvents() ([]ProviderEvent, <-chan ProviderEvent, func()) {
+	return provider.events.subscribe()
+}
+
+// overallState is running only if every nameservice is running
+func (provider *HdfsProxyProvider) overallState() ProviderState {
+	state := RUN
+	for _, ns := range provider.nameservices {
+		if ns.state == PEND {
+			return PEND
+		}
+		if ns.state != RUN {
+			state = ns.state
 		}
 	}
+	return state
 }
 
 func (provider *HdfsProxyProvider) monitorProviderState() {
@@ -117,21 +568,121 @@ func (provider *HdfsProxyProvider) monitorProviderState() {
 	}
 }
 
+// route picks the nameservice of a webhdfs request through mount table, and translates
+// its path (and the destination of RENAME) into that nameservice when they differ; a destination
+// on another nameservice is refused as ViewFs does, since no namenode can move files there
+func (provider *HdfsProxyProvider) route(r *http.Request) (*hdfsNameservice, *http.Request, *util.RemoteException) {
+	if len(provider.mountTable) == 0 || r.URL == nil || !strings.HasPrefix(r.URL.Path, util.WebHdfsPathPrefix) {
+		return provider.defaultNameservice, r, nil
+	}
+	hdfsPath := strings.TrimPrefix(r.URL.Path, util.WebHdfsPathPrefix)
+	ns, nsPath, translated := provider.resolveMount(hdfsPath)
+
+	query := r.URL.Query()
+	destination := query.Get("destination")
+	if len(destination) > 0 {
+		destNs, destPath, destTranslated := provider.resolveMount(destination)
+		if destNs != ns {
+			return ns, r, &util.RemoteException{
+				Exception:     "IOException",
+				JavaClassName: "java.io.IOException",
+				Message:       fmt.Sprintf("Renames across Mount points not supported: %s is on %s but %s is on %s", cleanHdfsPath(hdfsPath), ns.name, cleanHdfsPath(destination), destNs.name),
+			}
+		}
+		if destTranslated {
+			query.Set("destination", destPath)
+		}
+		translated = translated || destTranslated
+	}
+	if !translated {
+		return ns, r, nil
+	}
+
+	routedUrl := *r.URL
+	routedUrl.Path = util.WebHdfsPathPrefix + nsPath
+	routedUrl.RawPath = ""
+	routedUrl.RawQuery = query.Encode()
+	routed := r.WithContext(r.Context())
+	routed.URL = &routedUrl
+	return ns, routed, nil
+}
+
+// resolveMount returns the nameservice of hdfsPath and the path in it, translated tells whether the path differs
+func (provider *HdfsProxyProvider) resolveMount(hdfsPath string) (*hdfsNameservice, string, bool) {
+	mountPoint, nsPath, ok := provider.mountTable.Resolve(hdfsPath)
+	if !ok {
+		return provider.defaultNameservice, hdfsPath, false
+	}
+	return provider.nameservice(mountPoint.Nameservice), nsPath, mountPoint.Prefix != mountPoint.Target
+}
+
 func (provider *HdfsProxyProvider) Proxy(rw http.ResponseWriter, r *http.Request) int {
+	if provider.datanodeGateway != nil && r.URL != nil {
+		// data streams do not depend on namenodes
+		if strings.HasPrefix(r.URL.Path, DatanodePathPrefix) {
+			return provider.relayDatanode(rw, r)
+		}
+		r = withProxyBase(r)
+	}
+
+	// mutex is not held while proxying, so that a slow request never delays failover
 	provider.mutex.RLock()
-	defer provider.mutex.RUnlock()
+	ns, r, refusal := provider.route(r)
+	state := ns.state
+	address := ns.activeNNHttpAddress
+	if state == RUN && provider.readRouter != nil {
+		if readAddress := provider.readRouter.readTarget(ns, r); len(readAddress) > 0 {
+			address = readAddress
+		}
+	}
+	provider.mutex.RUnlock()
 
-	if provider.State != RUN {
+	if refusal != nil {
+		glog.V(2).Infof("hdfs proxy provider: refuse %s, %s.", r.URL.String(), refusal.Message)
+		util.WriteRemoteException(rw, http.StatusForbidden, refusal)
+		return http.StatusOK
+	}
+	if state != RUN {
 		return http.StatusServiceUnavailable
 	}
+	var injected *injectedToken
+	if provider.tokens != nil {
+		r, injected = provider.tokens.inject(ns, r)
+	}
+	// a request carrying a managed token needs no spnego
+	if provider.kerberos != nil && injected == nil {
+		authenticated, err := provider.kerberos.authenticate(r, address)
+		if err == errAnonymousRequest {
+			util.WriteRemoteException(rw, http.StatusUnauthorized, &util.RemoteException{
+				Exception:     "SecurityException",
+				JavaClassName: "java.lang.SecurityException",
+				Message:       "Failed to obtain user group information: " + err.Error(),
+			})
+			return http.StatusOK
+		}
+		if err != nil {
+			glog.Errorf("hdfs proxy provider: authenticate to namenode %s fail: %s", address, err.Error())
+			return http.StatusBadGateway
+		}
+		r = authenticated
+	}
 
-	port := provider.Conf.GetString(WebHdfsPortConfKey)
-	url := fmt.Sprintf("%s://%s:%s", "http", provider.activeNNAddress, port)
+	util.SetUpstream(r, address)
+	url := fmt.Sprintf("%s://%s", provider.upstreamScheme(), address)
 	select {
 	case <-time.After(time.Millisecond * time.Duration(provider.Conf.GetInt(RequestTimeoutConfKey))):
 		return http.StatusRequestTimeout
 
-	case <-provider.Pool.Push(url, rw, r):
+	case err := <-provider.Pool.Push(url, rw, r):
+		if _, ok := err.(*util.RetryableError); ok && injected != nil && injected.invalid {
+			// the refused token is dropped, and the request is replayed with a new one
+			provider.tokens.invalidate(ns, injected.user, injected.token)
+			return http.StatusServiceUnavailable
+		} else if ok {
+			// StandbyException is kept from client, the request is replayed once active namenode is found
+			provider.handleStandby(ns, address, err)
+			return http.StatusServiceUnavailable
+		}
 		return http.StatusOK
 	}
 }
@@ -146,8 +697,25 @@ func (provider *HdfsProxyProvider) GetStats() ProviderStats {
 		stats.Explain = "hdfs proxy is in service"
 	case PEND:
 		stats.Explain = "perhaps namenode election is taking place, or all namenodes are dead"
+	case AUTH_FAIL:
+		stats.Explain = "zookeeper refuses the credentials of " + ZkAuthConfKey + ", the active namenode is unknown"
 	default:
 		stats.Explain = "perhaps all namenodes are dead"
 	}
+	for _, ns := range provider.nameservices {
+		nsStats := NameserviceStats{
+			Name:           ns.name,
+			State:          ns.state.String(),
+			ActiveNamenode: ns.activeNNAddress,
+			ActiveChanges:  ns.activeChanges,
+		}
+		if ns.zkSession != nil {
+			nsStats.ZkSessionState = strings.TrimPrefix(ns.zkSession.State().String(), "State")
+		}
+		for _, namenode := range ns.namenodes {
+			nsStats.Namenodes = append(nsStats.Namenodes, NamenodeStats{HttpAddress: namenode.httpAddress, HAState: namenode.haState})
+		}
+		stats.Nameservices = append(stats.Nameservices, nsStats)
+	}
 	return stats
 }
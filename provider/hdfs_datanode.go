@@ -0,0 +1,147 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+)
+
+const (
+	DatanodeGatewayConfKey = "HDFS_DATANODE_GATEWAY"
+	DatanodeTimeoutConfKey = "HDFS_DATANODE_TIMEOUT"
+
+	// DatanodePathPrefix is followed by host:port of the datanode and the original request uri
+	DatanodePathPrefix = "/_datanode/"
+
+	// datanodes not redirected to for so long are forgotten
+	datanodeExpiration = time.Duration(24) * time.Hour
+)
+
+type proxyBaseKey struct{}
+
+// datanodeGateway rewrites the datanode redirects of OPEN, CREATE and APPEND to the proxy itself,
+// and relays the data stream to datanodes, so that clients never need to reach datanodes
+type datanodeGateway struct {
+	timeout time.Duration `description:"timeout of data streams, 0 means no timeout"`
+
+	mutex     sync.Mutex
+	datanodes map[string]*datanodeEntry `description:"datanodes which redirects were rewritten to, keyed by host:port"`
+}
+
+type datanodeEntry struct {
+	scheme   string
+	lastSeen time.Time
+}
+
+// newDatanodeGateway returns nil unless HDFS_DATANODE_GATEWAY is enabled
+func newDatanodeGateway(conf ProviderConf) *datanodeGateway {
+	if !conf.GetBoolOrDefault(DatanodeGatewayConfKey, false) {
+		return nil
+	}
+	return &datanodeGateway{
+		timeout:   time.Millisecond * time.Duration(conf.GetIntOrDefault(DatanodeTimeoutConfKey, 0)),
+		datanodes: make(map[string]*datanodeEntry),
+	}
+}
+
+// RelaysDatanodes tells whether data streams pass through the proxy, instead of going to datanodes directly
+func (provider *HdfsProxyProvider) RelaysDatanodes() bool {
+	return provider.datanodeGateway != nil
+}
+
+// withProxyBase remembers how the client reaches the proxy, redirects of r are rewritten against it
+func withProxyBase(r *http.Request) *http.Request {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return r.WithContext(context.WithValue(r.Context(), proxyBaseKey{}, scheme+"://"+r.Host))
+}
+
+// rewriteRedirect serves as response modifier of the proxy task pool
+func (gateway *datanodeGateway) rewriteRedirect(resp *http.Response) error {
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Request == nil {
+		return nil
+	}
+	base, ok := resp.Request.Context().Value(proxyBaseKey{}).(string)
+	if !ok {
+		return nil
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || (location.Scheme != "http" && location.Scheme != "https") || len(location.Host) == 0 {
+		return nil
+	}
+
+	gateway.mutex.Lock()
+	now := time.Now()
+	gateway.datanodes[location.Host] = &datanodeEntry{scheme: location.Scheme, lastSeen: now}
+	for host, entry := range gateway.datanodes {
+		if now.Sub(entry.lastSeen) > datanodeExpiration {
+			delete(gateway.datanodes, host)
+		}
+	}
+	gateway.mutex.Unlock()
+
+	rewritten := base + DatanodePathPrefix + location.Host + location.RequestURI()
+	glog.V(3).Infof("hdfs proxy provider: rewrite datanode redirect %s to %s.", location.String(), rewritten)
+	resp.Header.Set("Location", rewritten)
+	return nil
+}
+
+// resolve splits /_datanode/<host:port>/<uri> into the datanode target and the request relayed to it,
+// only datanodes which the proxy has redirected clients to are relayed
+func (gateway *datanodeGateway) resolve(r *http.Request) (string, *http.Request, bool) {
+	rest := strings.TrimPrefix(r.URL.Path, DatanodePathPrefix)
+	index := strings.Index(rest, "/")
+	if index <= 0 {
+		return "", nil, false
+	}
+	host := rest[:index]
+
+	gateway.mutex.Lock()
+	entry, ok := gateway.datanodes[host]
+	if ok {
+		entry.lastSeen = time.Now()
+	}
+	gateway.mutex.Unlock()
+	if !ok {
+		return "", nil, false
+	}
+
+	relayedUrl := *r.URL
+	relayedUrl.Path = rest[index:]
+	relayedUrl.RawPath = ""
+	relayed := r.WithContext(r.Context())
+	relayed.URL = &relayedUrl
+	relayed.Host = host
+	return entry.scheme + "://" + host, relayed, true
+}
+
+func (provider *HdfsProxyProvider) relayDatanode(rw http.ResponseWriter, r *http.Request) int {
+	target, relayed, ok := provider.datanodeGateway.resolve(r)
+	if !ok {
+		glog.V(2).Infof("hdfs proxy provider: refuse to relay %s to unknown datanode.", r.URL.Path)
+		return http.StatusForbidden
+	}
+
+	util.SetUpstream(r, relayed.Host)
+	respChan := provider.Pool.Push(target, rw, relayed)
+	if provider.datanodeGateway.timeout <= 0 {
+		<-respChan
+		return http.StatusOK
+	}
+	select {
+	case <-time.After(provider.datanodeGateway.timeout):
+		return http.StatusRequestTimeout
+
+	case <-respChan:
+		return http.StatusOK
+	}
+}
@@ -0,0 +1,69 @@
+package provider
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatanodeGateway(t *testing.T) {
+	datanode := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("data of " + r.URL.Path + " from datanode"))
+	}))
+	defer datanode.Close()
+	datanodeAddress := strings.TrimPrefix(datanode.URL, "http://")
+	namenode := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, datanode.URL+r.URL.Path+"?op=OPEN&namenoderpcaddress=nn1:8020&offset=0", http.StatusTemporaryRedirect)
+	}))
+	defer namenode.Close()
+
+	conf := ProviderConf{RequestTimeoutConfKey: 1000, DatanodeGatewayConfKey: true}
+	ns := &hdfsNameservice{name: "default", state: RUN, activeNNHttpAddress: strings.TrimPrefix(namenode.URL, "http://")}
+	provider := &HdfsProxyProvider{
+		BaseProxyProvider:  BaseProxyProvider{Conf: conf, State: RUN},
+		nameservices:       []*hdfsNameservice{ns},
+		defaultNameservice: ns,
+		datanodeGateway:    newDatanodeGateway(conf),
+	}
+	provider.Pool, _ = util.NewProxyTaskPool(4, util.WithResponseModifier(provider.modifyResponse))
+	go provider.Pool.Do()
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if statusCode := provider.Proxy(rw, r); statusCode >= 400 {
+			rw.WriteHeader(statusCode)
+		}
+	}))
+	defer proxyServer.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(proxyServer.URL + "/webhdfs/v1/tmp/a?op=OPEN")
+	if err != nil {
+		t.Fatal("TestDatanodeGateway:", err.Error())
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	assert.Equal(t, proxyServer.URL+DatanodePathPrefix+datanodeAddress+"/webhdfs/v1/tmp/a?op=OPEN&namenoderpcaddress=nn1:8020&offset=0", location)
+
+	resp, err = http.Get(location)
+	if err != nil {
+		t.Fatal("TestDatanodeGateway:", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "data of /webhdfs/v1/tmp/a from datanode", string(body))
+
+	// the proxy is not an open relay
+	resp, err = http.Get(proxyServer.URL + DatanodePathPrefix + "example.com:80/webhdfs/v1/tmp/a?op=OPEN")
+	if err != nil {
+		t.Fatal("TestDatanodeGateway:", err.Error())
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+)
+
+// error bodies larger than this are passed through without inspection
+const remoteExceptionPeekSize = 64 * 1024
+
+// exceptions meaning the namenode answering is not the one to serve the request
+var standbyExceptions = map[string]bool{
+	"StandbyException":               true,
+	"ObserverRetryOnActiveException": true,
+}
+
+// modifyResponse inspects upstream responses before anything is written to clients
+func (provider *HdfsProxyProvider) modifyResponse(resp *http.Response) error {
+	if exception := peekRemoteException(resp); exception != nil {
+		if standbyExceptions[exception.Exception] {
+			return &util.RetryableError{Reason: exception.Exception + ": " + exception.Message}
+		}
+		// a managed token refused by the namenode is replaced before clients notice
+		if injected := injectedTokenOf(resp.Request); injected != nil && exception.Exception == invalidTokenException {
+			injected.invalid = true
+			return &util.RetryableError{Reason: exception.Exception + ": " + exception.Message}
+		}
+	}
+	if provider.datanodeGateway != nil {
+		return provider.datanodeGateway.rewriteRedirect(resp)
+	}
+	return nil
+}
+
+// peekRemoteException peeks json error bodies, the peeked part is put back so that the body is passed on as is
+func peekRemoteException(resp *http.Response) *util.RemoteException {
+	if resp.StatusCode < 400 || resp.Body == nil || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, remoteExceptionPeekSize))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+	if err != nil {
+		return nil
+	}
+
+	return util.ParseRemoteException(data)
+}
+
+// handleStandby reacts to a StandbyException from address: the nameservice is suspended and resolved again
+// if address is taken as active namenode, otherwise the observer or standby namenode is just not read from any more
+func (provider *HdfsProxyProvider) handleStandby(ns *hdfsNameservice, address string, err error) {
+	provider.mutex.Lock()
+	isActive := address == ns.activeNNHttpAddress
+	if !isActive {
+		for _, namenode := range ns.namenodes {
+			if namenode.httpAddress == address {
+				namenode.haState = haStateUnknown
+			}
+		}
+	}
+	provider.mutex.Unlock()
+
+	if !isActive {
+		glog.V(2).Infof("hdfs proxy provider: namenode %s of %s refuses reads, %s.", address, ns.name, err.Error())
+		return
+	}
+	glog.V(1).Infof("hdfs proxy provider: active namenode %s of %s turns out standby, %s.", address, ns.name, err.Error())
+	ns.stateChan <- stateChange{PEND, ReasonStandby}
+	select {
+	case ns.resolveChan <- struct{}{}:
+	default:
+		// a resolution is already requested
+	}
+}
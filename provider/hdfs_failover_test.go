@@ -0,0 +1,50 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderStandbyFailover(t *testing.T) {
+	nn1 := newMockNamenode(haStateActive, true)
+	defer nn1.Close()
+	nn2 := newMockNamenode(haStateStandby, true)
+	defer nn2.Close()
+
+	confMap := make(map[string]interface{})
+	confMap[HADetectionConfKey] = HADetectionHttp
+	confMap[NamenodeHttpAddressesConfKey] = nn1.httpAddress() + "," + nn2.httpAddress()
+	// far longer than the test, so only StandbyException can trigger probing again
+	confMap[ProbeIntervalConfKey] = 60000
+	confMap[MaxConnectionsConfKey] = 16
+	confMap[RequestTimeoutConfKey] = 1000
+	provider, err := NewHdfsProxyProvider(ProviderConf(confMap))
+	if err != nil {
+		t.Fatal("TestProviderStandbyFailover:", err.Error())
+	}
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	assert.Equal(t, RUN, provider.State)
+	assert.Equal(t, nn1.httpAddress(), provider.defaultNameservice.activeNNHttpAddress)
+
+	nn1.setHAState(haStateStandby)
+	nn2.setHAState(haStateActive)
+
+	request, _ := http.NewRequest("GET", "http://localhost:8080/webhdfs/v1/tmp?op=LISTSTATUS", nil)
+	recorder := httptest.NewRecorder()
+	assert.Equal(t, http.StatusServiceUnavailable, provider.Proxy(recorder, request))
+	// nothing of StandbyException reaches client
+	assert.Equal(t, 0, recorder.Body.Len())
+
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	assert.Equal(t, RUN, provider.State)
+	assert.Equal(t, nn2.httpAddress(), provider.defaultNameservice.activeNNHttpAddress)
+
+	recorder = httptest.NewRecorder()
+	assert.Equal(t, http.StatusOK, provider.Proxy(recorder, request))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `{"FileStatuses":{"FileStatus":[]}}`, recorder.Body.String())
+}
@@ -0,0 +1,173 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"active-proxy/provider/hadoop_hdfs"
+	"active-proxy/util"
+)
+
+const (
+	HadoopConfDirConfKey = "HDFS_HADOOP_CONF_DIR"
+
+	defaultHAZkParentZnode   = "/hadoop-ha"
+	activeStandbyElectorLock = "ActiveStandbyElectorLock"
+)
+
+// hadoop configuration files read from HDFS_HADOOP_CONF_DIR, hdfs-site.xml overrides core-site.xml
+var hadoopConfFiles = []string{"core-site.xml", "hdfs-site.xml"}
+
+// hadoopNameservice is what hadoop configuration tells about one nameservice,
+// conf holds provider keys derived from hadoop properties
+type hadoopNameservice struct {
+	conf      ProviderConf
+	namenodes []*hdfsNamenode
+}
+
+// hadoopHdfsConf is the hdfs part of a hadoop configuration directory
+type hadoopHdfsConf struct {
+	nameservices       map[string]*hadoopNameservice
+	defaultNameservice string `description:"nameservice of fs.defaultFS, empty if it is not one of nameservices"`
+}
+
+// loadHadoopHdfsConf derives ha nameservices from core-site.xml and hdfs-site.xml under confDir,
+// missing files are skipped but at least one ha nameservice is expected;
+// namenodes are reached at dfs.namenode.https-address instead of dfs.namenode.http-address if https
+func loadHadoopHdfsConf(confDir string, https bool) (*hadoopHdfsConf, error) {
+	var files []string
+	for _, name := range hadoopConfFiles {
+		file := filepath.Join(confDir, name)
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("neither of %s is found in %s", strings.Join(hadoopConfFiles, ", "), confDir)
+	}
+	properties, err := util.LoadHadoopConf(files...)
+	if err != nil {
+		return nil, err
+	}
+	return parseHadoopHdfsConf(properties, https)
+}
+
+func parseHadoopHdfsConf(properties map[string]string, https bool) (*hadoopHdfsConf, error) {
+	get := func(keys ...string) string {
+		for _, key := range keys {
+			if value := properties[key]; len(value) > 0 {
+				return value
+			}
+		}
+		return ""
+	}
+
+	// dfs.internal.nameservices narrows dfs.nameservices to the local cluster
+	names := splitHadoopList(get("dfs.internal.nameservices", "dfs.nameservices"))
+	if len(names) == 0 {
+		return nil, fmt.Errorf("dfs.nameservices is not configured")
+	}
+	addressKey := "dfs.namenode.http-address."
+	if https {
+		addressKey = "dfs.namenode.https-address."
+	}
+	hdfsConf := &hadoopHdfsConf{nameservices: make(map[string]*hadoopNameservice)}
+	for _, name := range names {
+		nnIds := splitHadoopList(get("dfs.ha.namenodes." + name))
+		if len(nnIds) == 0 {
+			return nil, fmt.Errorf("nameservice %s lacks dfs.ha.namenodes.%s, only ha nameservices are supported", name, name)
+		}
+		ns := &hadoopNameservice{conf: ProviderConf{}}
+		for _, nnId := range nnIds {
+			suffix := name + "." + nnId
+			address := get(addressKey + suffix)
+			if len(address) == 0 {
+				return nil, fmt.Errorf("namenode %s lacks %s%s", suffix, addressKey, suffix)
+			}
+			// a wildcard http address binds all interfaces, take the host of rpc address instead
+			if host, port, err := net.SplitHostPort(address); err == nil && (host == "0.0.0.0" || host == "") {
+				rpcHost, _, err := net.SplitHostPort(get("dfs.namenode.rpc-address." + suffix))
+				if err != nil {
+					return nil, fmt.Errorf("namenode %s has wildcard http address %s but no dfs.namenode.rpc-address.%s", suffix, address, suffix)
+				}
+				address = net.JoinHostPort(rpcHost, port)
+			}
+			ns.namenodes = append(ns.namenodes, &hdfsNamenode{id: nnId, httpAddress: address, haState: haStateUnknown})
+		}
+
+		// zkfc reads ha.zookeeper.* with the nameservice suffix first
+		if quorum := get("ha.zookeeper.quorum."+name, "ha.zookeeper.quorum"); len(quorum) > 0 {
+			ns.conf[ZkServersConfKey] = quorum
+		}
+		parentZnode := get("ha.zookeeper.parent-znode."+name, "ha.zookeeper.parent-znode")
+		if len(parentZnode) == 0 {
+			parentZnode = defaultHAZkParentZnode
+		}
+		ns.conf[ZkLockPathConfKey] = strings.TrimSuffix(parentZnode, "/") + "/" + name + "/" + activeStandbyElectorLock
+		if auth := get("ha.zookeeper.auth."+name, "ha.zookeeper.auth"); len(auth) > 0 {
+			ns.conf[ZkAuthConfKey] = auth
+		}
+		if acl := get("ha.zookeeper.acl."+name, "ha.zookeeper.acl"); len(acl) > 0 {
+			ns.conf[ZkACLConfKey] = acl
+		}
+		hdfsConf.nameservices[name] = ns
+	}
+
+	if defaultFS, err := url.Parse(get("fs.defaultFS", "fs.default.name")); err == nil && defaultFS.Scheme == "hdfs" {
+		if _, ok := hdfsConf.nameservices[defaultFS.Host]; ok {
+			hdfsConf.defaultNameservice = defaultFS.Host
+		}
+	}
+	return hdfsConf, nil
+}
+
+func (ns *hadoopNameservice) lookup(key string) (string, bool) {
+	if ns == nil {
+		return "", false
+	}
+	value, ok := ns.conf[key]
+	return fmt.Sprint(value), ok
+}
+
+// namenodesIdentified tells whether every namenode of ns is known by its id
+func (ns *hdfsNameservice) namenodesIdentified() bool {
+	for _, namenode := range ns.namenodes {
+		if len(namenode.id) == 0 {
+			return false
+		}
+	}
+	return len(ns.namenodes) > 0
+}
+
+// namenodeHttpAddress maps the active node info written by zkfc to http address of the namenode,
+// the namenode is looked up by id and then by hostname, HDFS_WEBHDFS_PORT is the last resort
+func (ns *hdfsNameservice) namenodeHttpAddress(info *hadoop_hdfs.ActiveNodeInfo) string {
+	for _, namenode := range ns.namenodes {
+		if len(namenode.id) > 0 && namenode.id == info.GetNamenodeId() {
+			return namenode.httpAddress
+		}
+	}
+	for _, namenode := range ns.namenodes {
+		if host, _, err := net.SplitHostPort(namenode.httpAddress); err == nil && host == info.GetHostname() {
+			return namenode.httpAddress
+		}
+	}
+	if len(ns.webHdfsPort) == 0 {
+		return ""
+	}
+	return net.JoinHostPort(info.GetHostname(), ns.webHdfsPort)
+}
+
+func splitHadoopList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
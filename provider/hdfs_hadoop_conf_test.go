@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"active-proxy/provider/hadoop_hdfs"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+const coreSiteXml = `<?xml version="1.0"?>
+<configuration>
+  <property>
+    <name>fs.defaultFS</name>
+    <value>hdfs://ns1</value>
+  </property>
+  <property>
+    <name>ha.zookeeper.quorum</name>
+    <value>zk1:2181,zk2:2181</value>
+  </property>
+</configuration>`
+
+const hdfsSiteXml = `<?xml version="1.0"?>
+<configuration>
+  <property><name>dfs.nameservices</name><value>ns1, ns2</value></property>
+  <property><name>dfs.ha.namenodes.ns1</name><value>nn1,nn2</value></property>
+  <property><name>dfs.namenode.http-address.ns1.nn1</name><value>host1:9870</value></property>
+  <property><name>dfs.namenode.http-address.ns1.nn2</name><value>host2:9871</value></property>
+  <property><name>dfs.ha.namenodes.ns2</name><value>nn3</value></property>
+  <property><name>dfs.namenode.http-address.ns2.nn3</name><value>0.0.0.0:50070</value></property>
+  <property><name>dfs.namenode.rpc-address.ns2.nn3</name><value>host3:8020</value></property>
+  <property><name>ha.zookeeper.parent-znode.ns2</name><value>/ha-ns2/</value></property>
+</configuration>`
+
+func TestLoadHadoopHdfsConf(t *testing.T) {
+	confDir, err := ioutil.TempDir("", "hadoop-conf")
+	if err != nil {
+		t.Fatal("TestLoadHadoopHdfsConf:", err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	ioutil.WriteFile(filepath.Join(confDir, "core-site.xml"), []byte(coreSiteXml), 0644)
+	ioutil.WriteFile(filepath.Join(confDir, "hdfs-site.xml"), []byte(hdfsSiteXml), 0644)
+
+	hdfsConf, err := loadHadoopHdfsConf(confDir, false)
+	if err != nil {
+		t.Fatal("TestLoadHadoopHdfsConf:", err.Error())
+	}
+	assert.Equal(t, "ns1", hdfsConf.defaultNameservice)
+	assert.Equal(t, 2, len(hdfsConf.nameservices))
+
+	ns1 := hdfsConf.nameservices["ns1"]
+	assert.Equal(t, "zk1:2181,zk2:2181", ns1.conf[ZkServersConfKey])
+	assert.Equal(t, "/hadoop-ha/ns1/ActiveStandbyElectorLock", ns1.conf[ZkLockPathConfKey])
+	assert.Equal(t, []*hdfsNamenode{
+		{id: "nn1", httpAddress: "host1:9870", haState: haStateUnknown},
+		{id: "nn2", httpAddress: "host2:9871", haState: haStateUnknown},
+	}, ns1.namenodes)
+
+	ns2 := hdfsConf.nameservices["ns2"]
+	assert.Equal(t, "/ha-ns2/ns2/ActiveStandbyElectorLock", ns2.conf[ZkLockPathConfKey])
+	assert.Equal(t, "host3:50070", ns2.namenodes[0].httpAddress)
+
+	// nameservices without ha are refused
+	_, err = parseHadoopHdfsConf(map[string]string{"dfs.nameservices": "ns1"}, false)
+	assert.NotNil(t, err)
+}
+
+func TestNewHdfsNameserviceFromHadoopConf(t *testing.T) {
+	hdfsConf, err := parseHadoopHdfsConf(map[string]string{
+		"dfs.nameservices":                  "ns1",
+		"dfs.ha.namenodes.ns1":              "nn1,nn2",
+		"dfs.namenode.http-address.ns1.nn1": "host1:9870",
+		"dfs.namenode.http-address.ns1.nn2": "host2:9871",
+		"ha.zookeeper.quorum":               "zk1:2181",
+		"ha.zookeeper.auth":                 "digest:hdfs-zkfcs:secret",
+		"ha.zookeeper.acl.ns1":              "digest:hdfs-zkfcs:mJ8Dm+mG0cOgvrrAXTlGnwsDYmU=:rwcda",
+	}, false)
+	if err != nil {
+		t.Fatal("TestNewHdfsNameserviceFromHadoopConf:", err.Error())
+	}
+
+	// HDFS_WEBHDFS_PORT is not required since namenodes are known by id, yaml keys win over hadoop ones
+	ns, err := newHdfsNameservice("ns1", ProviderConf{ZkLockPathConfKey: "/custom/lock"}, hdfsConf.nameservices["ns1"], ProviderConf{})
+	if err != nil {
+		t.Fatal("TestNewHdfsNameserviceFromHadoopConf:", err.Error())
+	}
+	assert.Equal(t, []string{"zk1:2181"}, ns.zkServers)
+	assert.Equal(t, "/custom/lock", ns.zkLockPath)
+	assert.Equal(t, "digest:hdfs-zkfcs:secret", hdfsConf.nameservices["ns1"].conf[ZkAuthConfKey])
+	assert.Equal(t, 2, len(ns.zkOptions))
+	// derived keys of the nameservice win over top-level ones, which still win over other derived keys
+	derivedNs, err := newHdfsNameservice("ns1", ProviderConf{}, hdfsConf.nameservices["ns1"], ProviderConf{
+		ZkServersConfKey: "zk9:2181", ZkLockPathConfKey: "/top/lock", NamenodeHttpAddressesConfKey: "host9:9870",
+		ZkACLConfKey: "world:anyone:r",
+	})
+	if err != nil {
+		t.Fatal("TestNewHdfsNameserviceFromHadoopConf:", err.Error())
+	}
+	assert.Equal(t, []string{"zk1:2181"}, derivedNs.zkServers)
+	assert.Equal(t, "/hadoop-ha/ns1/ActiveStandbyElectorLock", derivedNs.zkLockPath)
+	assert.Equal(t, hdfsConf.nameservices["ns1"].namenodes, derivedNs.namenodes)
+	assert.Equal(t, 2, len(derivedNs.zkOptions))
+	// top-level keys fill in nameservices hadoop configuration does not know
+	topNs, err := newHdfsNameservice("ns9", ProviderConf{}, nil, ProviderConf{
+		ZkServersConfKey: "zk9:2181", ZkLockPathConfKey: "/top/lock", NamenodeHttpAddressesConfKey: "host9:9870",
+		WebHdfsPortConfKey: "9870",
+	})
+	if err != nil {
+		t.Fatal("TestNewHdfsNameserviceFromHadoopConf:", err.Error())
+	}
+	assert.Equal(t, []string{"zk9:2181"}, topNs.zkServers)
+	assert.Equal(t, "/top/lock", topNs.zkLockPath)
+	assert.Equal(t, []*hdfsNamenode{{httpAddress: "host9:9870", haState: haStateUnknown}}, topNs.namenodes)
+	// namenodes of the nameservice win over derived ones
+	ownNs, err := newHdfsNameservice("ns1", ProviderConf{NamenodeHttpAddressesConfKey: "host8:9870", WebHdfsPortConfKey: "9870"}, hdfsConf.nameservices["ns1"], ProviderConf{})
+	if err != nil {
+		t.Fatal("TestNewHdfsNameserviceFromHadoopConf:", err.Error())
+	}
+	assert.Equal(t, []*hdfsNamenode{{httpAddress: "host8:9870", haState: haStateUnknown}}, ownNs.namenodes)
+	// zookeeper sasl is refused rather than failing to read the lock later
+	_, err = newHdfsNameservice("ns1", ProviderConf{ZkAuthConfKey: "sasl:hdfs"}, hdfsConf.nameservices["ns1"], ProviderConf{})
+	assert.NotNil(t, err)
+
+	info := &hadoop_hdfs.ActiveNodeInfo{
+		NameserviceId: proto.String("ns1"),
+		NamenodeId:    proto.String("nn2"),
+		Hostname:      proto.String("host2"),
+		Port:          proto.Int32(8020),
+		ZkfcPort:      proto.Int32(8019),
+	}
+	assert.Equal(t, "host2:9871", ns.namenodeHttpAddress(info))
+	// unknown ids fall back to hostname, and then to HDFS_WEBHDFS_PORT
+	info.NamenodeId = proto.String("nn9")
+	assert.Equal(t, "host2:9871", ns.namenodeHttpAddress(info))
+	info.Hostname = proto.String("host9")
+	assert.Equal(t, "", ns.namenodeHttpAddress(info))
+	ns.webHdfsPort = "50070"
+	assert.Equal(t, "host9:50070", ns.namenodeHttpAddress(info))
+}
@@ -0,0 +1,90 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MonitorStaleTimeoutConfKey = "HDFS_MONITOR_STALE_TIMEOUT"
+
+	monitorStaleTimeoutDefault = 30000
+)
+
+// beat tells the monitor of the active namenode of ns is still going round its loop
+func (provider *HdfsProxyProvider) beat(ns *hdfsNameservice) {
+	provider.mutex.Lock()
+	ns.monitorBeat = time.Now()
+	provider.mutex.Unlock()
+}
+
+// monitorStaleTimeout is how long a monitor may not go round its loop before it is taken as stuck, at least a few
+// rounds; a round waits for zookeeper within zkReadTimeout, or probes namenodes for those detected through http
+func (provider *HdfsProxyProvider) monitorStaleTimeout(ns *hdfsNameservice) time.Duration {
+	timeout := time.Millisecond * time.Duration(provider.Conf.GetIntOrDefault(MonitorStaleTimeoutConfKey, monitorStaleTimeoutDefault))
+	round := 2 * (zkRetryInterval + zkReadTimeout)
+	if ns.haDetection == HADetectionHttp {
+		client, interval := provider.newProbeClient()
+		// a round probes jmx and /isActive
+		round = 3 * (interval + 2*client.Timeout)
+	}
+	if timeout < round {
+		timeout = round
+	}
+	return timeout
+}
+
+// Healthy fails once the monitor of a nameservice, which watches zookeeper or probes namenodes, is stuck or gone;
+// zookeeper or namenodes being down is no reason to restart the proxy, the monitor goes on without their answers
+func (provider *HdfsProxyProvider) Healthy() error {
+	now := time.Now()
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+	for _, ns := range provider.nameservices {
+		if timeout := provider.monitorStaleTimeout(ns); now.Sub(ns.monitorBeat) > timeout {
+			return fmt.Errorf("monitor of nameservice %s is stuck for %s", ns.name, now.Sub(ns.monitorBeat).Truncate(time.Second))
+		}
+	}
+	return nil
+}
+
+// Ready fails unless the provider is running and the active namenode of every nameservice answers a probe as active
+func (provider *HdfsProxyProvider) Ready() error {
+	provider.mutex.RLock()
+	state := provider.State
+	var notRunning []string
+	activeAddresses := make([]string, len(provider.nameservices))
+	for i, ns := range provider.nameservices {
+		if ns.state != RUN {
+			notRunning = append(notRunning, fmt.Sprintf("%s is %s", ns.name, ns.state))
+		}
+		activeAddresses[i] = ns.activeNNHttpAddress
+	}
+	provider.mutex.RUnlock()
+	if state != RUN {
+		if len(notRunning) > 0 {
+			return fmt.Errorf("provider is %s, %s", state, strings.Join(notRunning, ", "))
+		}
+		return fmt.Errorf("provider is %s", state)
+	}
+
+	client, _ := provider.newProbeClient()
+	haStates := make([]string, len(provider.nameservices))
+	var wg sync.WaitGroup
+	for i := range provider.nameservices {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			haStates[i] = probeHAState(client, provider.upstreamScheme(), activeAddresses[i])
+		}(i)
+	}
+	wg.Wait()
+	for i, ns := range provider.nameservices {
+		if haStates[i] != haStateActive {
+			return fmt.Errorf("active namenode %s of %s answers ha state %s", activeAddresses[i], ns.name, haStates[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderHealth(t *testing.T) {
+	nn1 := newMockNamenode(haStateActive, true)
+	defer nn1.Close()
+
+	confMap := make(map[string]interface{})
+	confMap[HADetectionConfKey] = HADetectionHttp
+	confMap[NamenodeHttpAddressesConfKey] = nn1.httpAddress()
+	// the monitor probes once at start within this test
+	confMap[ProbeIntervalConfKey] = 60000
+	confMap[MaxConnectionsConfKey] = 16
+	confMap[RequestTimeoutConfKey] = 1000
+	provider, err := NewHdfsProxyProvider(ProviderConf(confMap))
+	if err != nil {
+		t.Fatal("TestProviderHealth:", err.Error())
+	}
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	assert.Nil(t, provider.Healthy())
+	assert.Nil(t, provider.Ready())
+
+	// the active namenode is asked, not the state the monitor saw last
+	nn1.setHAState(haStateStandby)
+	assert.EqualError(t, provider.Ready(), "active namenode "+nn1.httpAddress()+" of default answers ha state standby")
+
+	provider.mutex.Lock()
+	provider.State = PEND
+	provider.defaultNameservice.state = PEND
+	provider.mutex.Unlock()
+	assert.EqualError(t, provider.Ready(), "provider is pending, default is pending")
+
+	// a monitor which has not gone round its loop for long is stuck
+	provider.mutex.Lock()
+	provider.defaultNameservice.monitorBeat = time.Now().Add(-time.Hour)
+	provider.mutex.Unlock()
+	assert.EqualError(t, provider.Healthy(), "monitor of nameservice default is stuck for 1h0m0s")
+}
+
+// stalledZk holds reads of the lock as go-zookeeper does while the session is lost, until zookeeper is back
+type stalledZk struct {
+	mutex sync.Mutex
+	reads int
+	back  chan []byte
+}
+
+func (client *stalledZk) GetW(zkPath string) ([]byte, <-chan zk.Event, error) {
+	client.mutex.Lock()
+	client.reads++
+	client.mutex.Unlock()
+	return <-client.back, make(chan zk.Event), nil
+}
+
+func TestResolveWithStalledZk(t *testing.T) {
+	defer func(timeout time.Duration) { zkReadTimeout = timeout }(zkReadTimeout)
+	zkReadTimeout = 50 * time.Millisecond
+
+	provider := &HdfsProxyProvider{}
+	ns := &hdfsNameservice{name: "default", zkLockPath: "/lock", webHdfsPort: "50070", state: RUN}
+	client := &stalledZk{back: make(chan []byte)}
+
+	// the monitor goes on while zookeeper does not answer, and the read left pending is not sent again
+	for i := 0; i < 3; i++ {
+		begin := time.Now()
+		resolved, _, err := provider.resolveActiveNodeInfo(ns, client)
+		assert.False(t, resolved)
+		assert.Equal(t, errZkReadTimeout, err)
+		assert.True(t, time.Since(begin) < time.Second)
+	}
+	client.mutex.Lock()
+	assert.Equal(t, 1, client.reads)
+	client.mutex.Unlock()
+
+	// once zookeeper is back the pending read answers
+	client.back <- marshalActiveNodeInfo("nn1.example.com")
+	resolved, watch, err := provider.resolveActiveNodeInfo(ns, client)
+	assert.True(t, resolved)
+	assert.NotNil(t, watch)
+	assert.Nil(t, err)
+	assert.Equal(t, "nn1.example.com", ns.activeNNAddress)
+	assert.Nil(t, ns.lockRead)
+
+	// a monitor stalled by zookeeper for a round is no reason to restart the proxy
+	provider.Conf = ProviderConf{MonitorStaleTimeoutConfKey: 100}
+	ns.monitorBeat = time.Now().Add(-time.Second)
+	provider.nameservices = []*hdfsNameservice{ns}
+	assert.Nil(t, provider.Healthy())
+}
@@ -0,0 +1,160 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	zkClient "active-proxy/provider/zk"
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+	krbClient "github.com/jcmturner/gokrb5/v8/client"
+	krbConfig "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+const (
+	KerberosPrincipalConfKey = "HDFS_KERBEROS_PRINCIPAL"
+	KerberosKeytabConfKey    = "HDFS_KERBEROS_KEYTAB"
+	KerberosKrb5ConfConfKey  = "HDFS_KERBEROS_KRB5_CONF"
+	KerberosSpnConfKey       = "HDFS_KERBEROS_SPN"
+	KerberosDoasConfKey      = "HDFS_KERBEROS_DOAS"
+	// user anonymous requests act as, they are refused if it is not set
+	KerberosAnonymousUserConfKey = "HDFS_KERBEROS_ANONYMOUS_USER"
+	// authenticate zookeeper sessions with sasl as the kerberos login of the proxy
+	ZkSaslConfKey    = "HDFS_ZK_SASL"
+	ZkSaslSpnConfKey = "HDFS_ZK_SASL_SPN"
+
+	krb5ConfDefault = "/etc/krb5.conf"
+	// _HOST is replaced by the namenode host, as hadoop does in principals
+	kerberosSpnDefault = "HTTP/_HOST"
+	// _HOST is replaced by the zookeeper server host, as the zookeeper java client does
+	zkSaslSpnDefault = "zookeeper/_HOST"
+)
+
+// kerberosAuth authenticates the proxy to namenodes with spnego, and passes the inbound user on as doas,
+// so that the proxy acts as a hadoop proxy user (hadoop.proxyuser.<proxy>.hosts/groups)
+type kerberosAuth struct {
+	client        *krbClient.Client
+	spnTemplate   string
+	doas          bool
+	anonymousUser string `description:"doas of requests without user, which are refused if empty"`
+}
+
+// errAnonymousRequest refuses requests without user, which would act as the proxy principal itself
+var errAnonymousRequest = fmt.Errorf("anonymous requests are refused, give user.name or doas")
+
+// newKerberosAuth logs in from keytab, it returns nil if HDFS_KERBEROS_PRINCIPAL is not set;
+// tickets are renewed (or got again from keytab once they can not be renewed) by the kerberos client itself
+func newKerberosAuth(conf ProviderConf) (*kerberosAuth, error) {
+	principal := conf.GetStringOrDefault(KerberosPrincipalConfKey, "")
+	if len(principal) == 0 {
+		return nil, nil
+	}
+	index := strings.LastIndex(principal, "@")
+	if index <= 0 || index == len(principal)-1 {
+		return nil, fmt.Errorf("kerberos principal %s lacks realm", principal)
+	}
+	keytabFile := conf.GetStringOrDefault(KerberosKeytabConfKey, "")
+	if len(keytabFile) == 0 {
+		return nil, fmt.Errorf("%s is required by kerberos principal %s", KerberosKeytabConfKey, principal)
+	}
+	kt, err := keytab.Load(keytabFile)
+	if err != nil {
+		return nil, fmt.Errorf("load keytab %s: %s", keytabFile, err.Error())
+	}
+	krb5Conf := conf.GetStringOrDefault(KerberosKrb5ConfConfKey, krb5ConfDefault)
+	krb5Config, err := krbConfig.Load(krb5Conf)
+	if err != nil {
+		return nil, fmt.Errorf("load %s: %s", krb5Conf, err.Error())
+	}
+
+	client := krbClient.NewWithKeytab(principal[:index], principal[index+1:], kt, krb5Config, krbClient.DisablePAFXFAST(true))
+	if err := client.Login(); err != nil {
+		return nil, fmt.Errorf("kerberos login of %s: %s", principal, err.Error())
+	}
+	glog.V(1).Infof("hdfs proxy provider: kerberos login of %s succeeds.", principal)
+	return &kerberosAuth{
+		client:        client,
+		spnTemplate:   conf.GetStringOrDefault(KerberosSpnConfKey, kerberosSpnDefault),
+		doas:          conf.GetBoolOrDefault(KerberosDoasConfKey, true),
+		anonymousUser: conf.GetStringOrDefault(KerberosAnonymousUserConfKey, ""),
+	}, nil
+}
+
+// initZkSasl lets nameservices with HDFS_ZK_SASL on authenticate their zookeeper sessions with the kerberos login
+func (provider *HdfsProxyProvider) initZkSasl() error {
+	for _, ns := range provider.nameservices {
+		if len(ns.zkSaslSpn) == 0 {
+			continue
+		}
+		if provider.kerberos == nil {
+			return fmt.Errorf("hdfs nameservice %s has %s on, which needs %s", ns.name, ZkSaslConfKey, KerberosPrincipalConfKey)
+		}
+		ns.zkOptions = append(ns.zkOptions, zkClient.WithKerberos(provider.kerberos.client, ns.zkSaslSpn))
+	}
+	return nil
+}
+
+// servicePrincipal returns the spn of the namenode listening on address
+func (auth *kerberosAuth) servicePrincipal(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return strings.Replace(auth.spnTemplate, "_HOST", strings.ToLower(host), -1)
+}
+
+// authenticate returns a copy of r carrying a fresh spnego token for the namenode at address,
+// errAnonymousRequest if r has no user to act for
+func (auth *kerberosAuth) authenticate(r *http.Request, address string) (*http.Request, error) {
+	authenticated := r.Clone(r.Context())
+	if auth.doas && !impersonate(authenticated, auth.anonymousUser) {
+		return nil, errAnonymousRequest
+	}
+	if err := spnego.SetSPNEGOHeader(auth.client, authenticated, auth.servicePrincipal(address)); err != nil {
+		return nil, err
+	}
+	return authenticated, nil
+}
+
+// impersonate turns user.name of the inbound request into doas, since namenodes take the authenticated proxy as
+// the caller and ignore user.name; requests without user act as anonymousUser, it returns false if that is empty,
+// since they would act as the proxy principal, a hadoop superuser as a rule (their own delegation token aside)
+func impersonate(r *http.Request, anonymousUser string) bool {
+	if r.URL == nil {
+		return false
+	}
+	query := r.URL.Query()
+	user := util.WebHdfsUser(r)
+	if len(user) == 0 {
+		user = anonymousUser
+	}
+	if len(user) == 0 {
+		return len(query.Get("delegation")) > 0
+	}
+	query.Set("doas", user)
+	query.Del("user.name")
+	r.URL.RawQuery = query.Encode()
+	return true
+}
+
+// transport wraps base so that namenode probes are authenticated as well
+func (auth *kerberosAuth) transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		authenticated := r.Clone(r.Context())
+		if err := spnego.SetSPNEGOHeader(auth.client, authenticated, auth.servicePrincipal(r.URL.Host)); err != nil {
+			return nil, err
+		}
+		return base.RoundTrip(authenticated)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
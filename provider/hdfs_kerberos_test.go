@@ -0,0 +1,100 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"active-proxy/util"
+
+	krbClient "github.com/jcmturner/gokrb5/v8/client"
+	krbConfig "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKerberosServicePrincipal(t *testing.T) {
+	auth := &kerberosAuth{spnTemplate: kerberosSpnDefault}
+	assert.Equal(t, "HTTP/nn1.example.com", auth.servicePrincipal("NN1.example.com:9871"))
+	auth.spnTemplate = "HTTP/_HOST@EXAMPLE.COM"
+	assert.Equal(t, "HTTP/nn1.example.com@EXAMPLE.COM", auth.servicePrincipal("nn1.example.com"))
+}
+
+func TestImpersonate(t *testing.T) {
+	cases := []struct {
+		uri           string
+		anonymousUser string
+		expected      string
+		impersonated  bool
+	}{
+		{"/webhdfs/v1/tmp?op=LISTSTATUS&user.name=alice", "", "doas=alice&op=LISTSTATUS", true},
+		{"/webhdfs/v1/tmp?op=LISTSTATUS&user.name=alice&doas=bob", "nobody", "doas=bob&op=LISTSTATUS", true},
+		// anonymous requests would act as the proxy principal
+		{"/webhdfs/v1/tmp?op=LISTSTATUS", "", "op=LISTSTATUS", false},
+		{"/webhdfs/v1/tmp?op=LISTSTATUS", "nobody", "doas=nobody&op=LISTSTATUS", true},
+		{"/webhdfs/v1/tmp?op=OPEN&delegation=abc", "", "op=OPEN&delegation=abc", true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.uri, nil)
+		assert.Equal(t, c.impersonated, impersonate(r, c.anonymousUser), c.uri)
+		assert.Equal(t, c.expected, r.URL.RawQuery, c.uri)
+	}
+
+	// anonymous requests are refused before any ticket is got
+	auth := &kerberosAuth{spnTemplate: kerberosSpnDefault, doas: true}
+	_, err := auth.authenticate(httptest.NewRequest("GET", "/webhdfs/v1/tmp?op=LISTSTATUS", nil), "nn1:9870")
+	assert.Equal(t, errAnonymousRequest, err)
+}
+
+func TestNewKerberosAuth(t *testing.T) {
+	auth, err := newKerberosAuth(ProviderConf{})
+	assert.Nil(t, err)
+	assert.Nil(t, auth)
+
+	_, err = newKerberosAuth(ProviderConf{KerberosPrincipalConfKey: "acproxy", KerberosKeytabConfKey: "/dev/null"})
+	assert.NotNil(t, err)
+	_, err = newKerberosAuth(ProviderConf{KerberosPrincipalConfKey: "acproxy@EXAMPLE.COM"})
+	assert.NotNil(t, err)
+}
+
+func TestZkSasl(t *testing.T) {
+	conf := ProviderConf{ZkServersConfKey: "zk1:2181", ZkLockPathConfKey: "/lock", WebHdfsPortConfKey: "50070"}
+	ns, err := newHdfsNameservice("ns1", ProviderConf{ZkSaslConfKey: true}, nil, conf)
+	if err != nil {
+		t.Fatal("TestZkSasl:", err.Error())
+	}
+	assert.Equal(t, zkSaslSpnDefault, ns.zkSaslSpn)
+	other, err := newHdfsNameservice("ns2", ProviderConf{ZkSaslConfKey: "false"}, nil, conf)
+	if err != nil {
+		t.Fatal("TestZkSasl:", err.Error())
+	}
+	assert.Empty(t, other.zkSaslSpn)
+	_, err = newHdfsNameservice("ns3", ProviderConf{ZkSaslConfKey: "kerberos"}, nil, conf)
+	assert.NotNil(t, err)
+
+	// sasl takes the kerberos login of the proxy
+	provider := &HdfsProxyProvider{nameservices: []*hdfsNameservice{ns, other}}
+	assert.NotNil(t, provider.initZkSasl())
+	provider.kerberos = &kerberosAuth{client: krbClient.NewWithPassword("acproxy", "EXAMPLE.COM", "secret", krbConfig.New())}
+	assert.Nil(t, provider.initZkSasl())
+	assert.Equal(t, 1, len(ns.zkOptions))
+	assert.Equal(t, 0, len(other.zkOptions))
+}
+
+func TestProxyRefusesAnonymous(t *testing.T) {
+	ns := &hdfsNameservice{name: "ns1", state: RUN, activeNNHttpAddress: "nn1:9870"}
+	provider := &HdfsProxyProvider{
+		nameservices:       []*hdfsNameservice{ns},
+		defaultNameservice: ns,
+		kerberos:           &kerberosAuth{spnTemplate: kerberosSpnDefault, doas: true},
+		BaseProxyProvider:  BaseProxyProvider{Conf: ProviderConf{RequestTimeoutConfKey: 1000}},
+	}
+
+	// without user the request would run on the namenode as the proxy principal
+	rw := httptest.NewRecorder()
+	assert.Equal(t, http.StatusOK, provider.Proxy(rw, httptest.NewRequest("DELETE", "/webhdfs/v1/warehouse?op=DELETE&recursive=true", nil)))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	exception := util.ParseRemoteException(rw.Body.Bytes())
+	if assert.NotNil(t, exception) {
+		assert.Equal(t, "SecurityException", exception.Exception)
+	}
+}
@@ -0,0 +1,97 @@
+package provider
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"active-proxy/util"
+)
+
+const viewFsMountTablePrefix = "fs.viewfs.mounttable."
+
+// MountPoint links a path prefix of the proxy namespace to a path of one nameservice
+type MountPoint struct {
+	Prefix      string `json:"prefix"`
+	Nameservice string `json:"nameservice"`
+	Target      string `json:"target"`
+}
+
+// MountTable is ordered by prefix length, so that the longest matched prefix wins
+type MountTable []MountPoint
+
+// parseMountTarget accepts either a bare nameservice ("ns1") or a viewfs link target ("hdfs://ns1/user")
+func parseMountTarget(prefix string, target string) (MountPoint, error) {
+	prefix = cleanHdfsPath(prefix)
+	if !strings.Contains(target, "://") {
+		return MountPoint{Prefix: prefix, Nameservice: target, Target: prefix}, nil
+	}
+	targetUrl, err := url.Parse(target)
+	if err != nil {
+		return MountPoint{}, err
+	}
+	if len(targetUrl.Host) == 0 {
+		return MountPoint{}, fmt.Errorf("mount target %s of %s lacks nameservice", target, prefix)
+	}
+	return MountPoint{Prefix: prefix, Nameservice: targetUrl.Host, Target: cleanHdfsPath(targetUrl.Path)}, nil
+}
+
+func NewMountTable(links map[string]string) (MountTable, error) {
+	table := MountTable{}
+	for prefix, target := range links {
+		mountPoint, err := parseMountTarget(prefix, target)
+		if err != nil {
+			return nil, err
+		}
+		table = append(table, mountPoint)
+	}
+	sort.Slice(table, func(i, j int) bool {
+		if len(table[i].Prefix) != len(table[j].Prefix) {
+			return len(table[i].Prefix) > len(table[j].Prefix)
+		}
+		return table[i].Prefix < table[j].Prefix
+	})
+	return table, nil
+}
+
+// LoadViewFsMountLinks reads links of the viewfs mount table named tableName from a mounttable xml file,
+// the nameservice of linkFallback (if any) is returned as well
+func LoadViewFsMountLinks(file string, tableName string) (map[string]string, string, error) {
+	properties, err := util.LoadHadoopConf(file)
+	if err != nil {
+		return nil, "", err
+	}
+	links := make(map[string]string)
+	fallback := ""
+	tablePrefix := viewFsMountTablePrefix + tableName + "."
+	for name, value := range properties {
+		switch {
+		case strings.HasPrefix(name, tablePrefix+"link."):
+			links[strings.TrimPrefix(name, tablePrefix+"link.")] = value
+		case name == tablePrefix+"linkFallback":
+			mountPoint, err := parseMountTarget("/", value)
+			if err != nil {
+				return nil, "", err
+			}
+			fallback = mountPoint.Nameservice
+		}
+	}
+	return links, fallback, nil
+}
+
+// Resolve finds the mount point of hdfsPath and translates the path into the nameservice
+func (table MountTable) Resolve(hdfsPath string) (MountPoint, string, bool) {
+	hdfsPath = cleanHdfsPath(hdfsPath)
+	for _, mountPoint := range table {
+		if mountPoint.Prefix == "/" || hdfsPath == mountPoint.Prefix || strings.HasPrefix(hdfsPath, mountPoint.Prefix+"/") {
+			return mountPoint, path.Join(mountPoint.Target, strings.TrimPrefix(hdfsPath, mountPoint.Prefix)), true
+		}
+	}
+	return MountPoint{}, hdfsPath, false
+}
+
+func cleanHdfsPath(hdfsPath string) string {
+	return path.Clean("/" + hdfsPath)
+}
@@ -0,0 +1,141 @@
+package provider
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const mountTableXml = `<?xml version="1.0"?>
+<configuration>
+  <property>
+    <name>fs.viewfs.mounttable.cluster.link./user</name>
+    <value>hdfs://ns1/user</value>
+  </property>
+  <property>
+    <name>fs.viewfs.mounttable.cluster.link./data</name>
+    <value>hdfs://ns2/warehouse/data</value>
+  </property>
+  <property>
+    <name>fs.viewfs.mounttable.cluster.linkFallback</name>
+    <value>hdfs://ns1/</value>
+  </property>
+  <property>
+    <name>fs.viewfs.mounttable.other.link./tmp</name>
+    <value>hdfs://ns3/tmp</value>
+  </property>
+</configuration>`
+
+func TestLoadViewFsMountLinks(t *testing.T) {
+	file, err := ioutil.TempFile("", "mounttable")
+	if err != nil {
+		t.Fatal("TestLoadViewFsMountLinks:", err.Error())
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(mountTableXml)
+	file.Close()
+
+	links, fallback, err := LoadViewFsMountLinks(file.Name(), "cluster")
+	assert.Nil(t, err)
+	assert.Equal(t, "ns1", fallback)
+	assert.Equal(t, map[string]string{"/user": "hdfs://ns1/user", "/data": "hdfs://ns2/warehouse/data"}, links)
+}
+
+func TestMountTableResolve(t *testing.T) {
+	table, err := NewMountTable(map[string]string{
+		"/user":          "ns1",
+		"/user/hive":     "hdfs://ns2/hive",
+		"/data":          "hdfs://ns2/warehouse/data",
+		"/data-archive/": "ns3",
+	})
+	assert.Nil(t, err)
+
+	cases := []struct {
+		path        string
+		nameservice string
+		nsPath      string
+		found       bool
+	}{
+		{"/user/alice", "ns1", "/user/alice", true},
+		{"/user", "ns1", "/user", true},
+		{"/user/hive/warehouse", "ns2", "/hive/warehouse", true},
+		{"/data/2017/01", "ns2", "/warehouse/data/2017/01", true},
+		{"/data-archive/2016", "ns3", "/data-archive/2016", true},
+		{"/database", "", "/database", false},
+		{"/tmp/", "", "/tmp", false},
+	}
+	for _, c := range cases {
+		mountPoint, nsPath, found := table.Resolve(c.path)
+		assert.Equal(t, c.found, found, c.path)
+		assert.Equal(t, c.nameservice, mountPoint.Nameservice, c.path)
+		assert.Equal(t, c.nsPath, nsPath, c.path)
+	}
+}
+
+func TestProviderRoute(t *testing.T) {
+	ns1 := &hdfsNameservice{name: "ns1"}
+	ns2 := &hdfsNameservice{name: "ns2"}
+	table, _ := NewMountTable(map[string]string{"/user": "ns1", "/data": "hdfs://ns2/warehouse/data", "/logs": "ns2"})
+	provider := &HdfsProxyProvider{
+		nameservices:       []*hdfsNameservice{ns1, ns2},
+		defaultNameservice: ns1,
+		mountTable:         table,
+	}
+
+	request, _ := http.NewRequest("GET", "http://localhost:8080/webhdfs/v1/user/alice?op=LISTSTATUS", nil)
+	ns, routed, refusal := provider.route(request)
+	assert.Equal(t, ns1, ns)
+	assert.Equal(t, request, routed)
+	assert.Nil(t, refusal)
+
+	request, _ = http.NewRequest("PUT", "http://localhost:8080/webhdfs/v1/data/a?op=RENAME&destination="+url.QueryEscape("/data/b"), nil)
+	ns, routed, refusal = provider.route(request)
+	assert.Equal(t, ns2, ns)
+	assert.Nil(t, refusal)
+	assert.Equal(t, "/webhdfs/v1/warehouse/data/a", routed.URL.Path)
+	assert.Equal(t, "/warehouse/data/b", routed.URL.Query().Get("destination"))
+	assert.Equal(t, "/webhdfs/v1/data/a", request.URL.Path)
+
+	// the destination is translated even if the source is mounted as is
+	request, _ = http.NewRequest("PUT", "http://localhost:8080/webhdfs/v1/logs/a?op=RENAME&destination="+url.QueryEscape("/data/b"), nil)
+	ns, routed, refusal = provider.route(request)
+	assert.Equal(t, ns2, ns)
+	assert.Nil(t, refusal)
+	assert.Equal(t, "/webhdfs/v1/logs/a", routed.URL.Path)
+	assert.Equal(t, "/warehouse/data/b", routed.URL.Query().Get("destination"))
+
+	// renames to another nameservice, mounted or not, are refused
+	for _, target := range []string{
+		"/webhdfs/v1/user/a?op=RENAME&destination=" + url.QueryEscape("/logs/a"),
+		"/webhdfs/v1/data/a?op=RENAME&destination=" + url.QueryEscape("/user/a"),
+		"/webhdfs/v1/data/a?op=RENAME&destination=" + url.QueryEscape("/tmp/a"),
+	} {
+		request, _ = http.NewRequest("PUT", "http://localhost:8080"+target, nil)
+		_, _, refusal = provider.route(request)
+		if assert.NotNil(t, refusal, target) {
+			assert.Equal(t, "IOException", refusal.Exception)
+			assert.Contains(t, refusal.Message, "Renames across Mount points not supported")
+		}
+	}
+	request, _ = http.NewRequest("PUT", "http://localhost:8080/webhdfs/v1/user/a?op=RENAME&destination="+url.QueryEscape("/tmp/a"), nil)
+	ns, routed, refusal = provider.route(request)
+	assert.Equal(t, ns1, ns)
+	assert.Nil(t, refusal)
+	assert.Equal(t, request, routed)
+
+	request, _ = http.NewRequest("GET", "http://localhost:8080/webhdfs/v1/tmp?op=LISTSTATUS", nil)
+	ns, _, _ = provider.route(request)
+	assert.Equal(t, ns1, ns)
+
+	// the refusal is the answer, it is not retried
+	rw := httptest.NewRecorder()
+	request, _ = http.NewRequest("PUT", "http://localhost:8080/webhdfs/v1/data/a?op=RENAME&destination="+url.QueryEscape("/user/a"), nil)
+	assert.Equal(t, http.StatusOK, provider.Proxy(rw, request))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, rw.Body.String(), `"exception":"IOException"`)
+}
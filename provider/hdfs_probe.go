@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	HADetectionConfKey           = "HDFS_HA_DETECTION"
+	NamenodeHttpAddressesConfKey = "HDFS_NAMENODE_HTTP_ADDRESSES"
+	ProbeIntervalConfKey         = "HDFS_PROBE_INTERVAL"
+	ProbeTimeoutConfKey          = "HDFS_PROBE_TIMEOUT"
+
+	// HADetectionZk watches the ActiveStandbyElectorLock znode written by zkfc
+	HADetectionZk = "zk"
+	// HADetectionHttp polls ha state of every namenode through its http server
+	HADetectionHttp = "http"
+
+	probeIntervalDefault = 3000
+	probeTimeoutDefault  = 1000
+
+	nnStatusJmxQuery = "/jmx?qry=Hadoop:service=NameNode,name=NNStatus"
+	nnIsActivePath   = "/isActive"
+)
+
+const (
+	haStateActive   = "active"
+	haStateStandby  = "standby"
+	haStateObserver = "observer"
+	haStateUnknown  = "unknown"
+)
+
+type hdfsNamenode struct {
+	id          string `description:"namenode id in dfs.ha.namenodes, empty if unknown"`
+	httpAddress string
+	haState     string
+}
+
+type nnStatusJmx struct {
+	Beans []struct {
+		State string `json:"State"`
+	} `json:"beans"`
+}
+
+// probeHAState asks a namenode for its ha state through the NNStatus jmx bean,
+// and falls back to /isActive (which answers 200 only on active namenode) if the bean is unavailable
+func probeHAState(client *http.Client, scheme string, httpAddress string) string {
+	resp, err := client.Get(scheme + "://" + httpAddress + nnStatusJmxQuery)
+	if err != nil {
+		glog.V(3).Infof("hdfs proxy provider: probe namenode %s fail, %s", httpAddress, err.Error())
+		return haStateUnknown
+	}
+	status := &nnStatusJmx{}
+	decodeErr := json.NewDecoder(resp.Body).Decode(status)
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && decodeErr == nil && len(status.Beans) > 0 && len(status.Beans[0].State) > 0 {
+		return strings.ToLower(status.Beans[0].State)
+	}
+
+	resp, err = client.Get(scheme + "://" + httpAddress + nnIsActivePath)
+	if err != nil {
+		return haStateUnknown
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return haStateActive
+	case http.StatusMethodNotAllowed:
+		return haStateStandby
+	default:
+		return haStateUnknown
+	}
+}
+
+// probeNamenodes refreshes ha states of all namenodes of ns concurrently, and takes the first active one if takeActive
+func (provider *HdfsProxyProvider) probeNamenodes(ns *hdfsNameservice, client *http.Client, takeActive bool) bool {
+	haStates := make([]string, len(ns.namenodes))
+	var wg sync.WaitGroup
+	for i, namenode := range ns.namenodes {
+		wg.Add(1)
+		go func(i int, httpAddress string) {
+			defer wg.Done()
+			haStates[i] = probeHAState(client, provider.upstreamScheme(), httpAddress)
+		}(i, namenode.httpAddress)
+	}
+	wg.Wait()
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	var active *hdfsNamenode
+	for i, namenode := range ns.namenodes {
+		namenode.haState = haStates[i]
+		if active == nil && namenode.haState == haStateActive {
+			active = namenode
+		}
+	}
+	if active == nil || !takeActive {
+		return active != nil
+	}
+	if ns.activeNNHttpAddress != active.httpAddress {
+		host, _, _ := net.SplitHostPort(active.httpAddress)
+		glog.V(2).Infof("hdfs proxy provider: active namenode address of %s changes from %s to %s.", ns.name, ns.activeNNAddress, host)
+		provider.setActiveNamenode(ns, host, active.httpAddress, ReasonProbeActive)
+	}
+	return true
+}
+
+func (provider *HdfsProxyProvider) newProbeClient() (*http.Client, time.Duration) {
+	client := &http.Client{
+		Transport: provider.probeTransport(),
+		Timeout:   time.Millisecond * time.Duration(provider.Conf.GetIntOrDefault(ProbeTimeoutConfKey, probeTimeoutDefault)),
+	}
+	interval := time.Millisecond * time.Duration(provider.Conf.GetIntOrDefault(ProbeIntervalConfKey, probeIntervalDefault))
+	return client, interval
+}
+
+func (provider *HdfsProxyProvider) probeTransport() http.RoundTripper {
+	var transport http.RoundTripper = http.DefaultTransport
+	if provider.transport != nil {
+		transport = provider.transport
+	}
+	if provider.kerberos != nil {
+		transport = provider.kerberos.transport(transport)
+	}
+	return transport
+}
+
+// monitorNamenodeStates is the zookeeper free counterpart of monitorZkLockPath
+func (provider *HdfsProxyProvider) monitorNamenodeStates(ns *hdfsNameservice) {
+	client, interval := provider.newProbeClient()
+
+	provider.beat(ns)
+	if provider.probeNamenodes(ns, client, true) {
+		ns.stateChan <- stateChange{RUN, ReasonStarted}
+	}
+	provider.initWg.Done()
+	for {
+		provider.beat(ns)
+		select {
+		case <-time.After(interval):
+		case <-ns.resolveChan:
+		}
+		success := provider.probeNamenodes(ns, client, true)
+		provider.mutex.RLock()
+		state := ns.state
+		provider.mutex.RUnlock()
+		switch {
+		case success && state != RUN:
+			ns.stateChan <- stateChange{RUN, ReasonProbeActive}
+		case !success && state == RUN:
+			ns.stateChan <- stateChange{PEND, ReasonProbeLostActive}
+		}
+	}
+}
+
+// monitorReadNamenodes keeps ha states of namenodes fresh for read routing,
+// while active namenode is still decided by zookeeper
+func (provider *HdfsProxyProvider) monitorReadNamenodes(ns *hdfsNameservice) {
+	client, interval := provider.newProbeClient()
+	for {
+		provider.probeNamenodes(ns, client, false)
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,130 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockNamenode struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	haState string
+}
+
+func newMockNamenode(haState string, withJmx bool) *mockNamenode {
+	namenode := newUnstartedMockNamenode(haState, withJmx)
+	namenode.Start()
+	return namenode
+}
+
+func newUnstartedMockNamenode(haState string, withJmx bool) *mockNamenode {
+	namenode := &mockNamenode{haState: haState}
+	namenode.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		namenode.mutex.Lock()
+		defer namenode.mutex.Unlock()
+		switch {
+		case r.URL.Path == "/jmx" && withJmx:
+			fmt.Fprintf(rw, `{"beans":[{"name":"Hadoop:service=NameNode,name=NNStatus","State":"%s"}]}`, namenode.haState)
+		case r.URL.Path == "/isActive" && namenode.haState == haStateActive:
+			rw.WriteHeader(http.StatusOK)
+		case r.URL.Path == "/isActive":
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		case strings.HasPrefix(r.URL.Path, "/webhdfs/v1") && namenode.haState == haStateActive:
+			fmt.Fprintf(rw, `{"FileStatuses":{"FileStatus":[]}}`)
+		case strings.HasPrefix(r.URL.Path, "/webhdfs/v1"):
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(rw, `{"RemoteException":{"exception":"StandbyException","javaClassName":"org.apache.hadoop.ipc.StandbyException",`+
+				`"message":"Operation category READ is not supported in state %s"}}`, namenode.haState)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return namenode
+}
+
+func (namenode *mockNamenode) setHAState(haState string) {
+	namenode.mutex.Lock()
+	defer namenode.mutex.Unlock()
+	namenode.haState = haState
+}
+
+func (namenode *mockNamenode) httpAddress() string {
+	return namenode.Listener.Addr().String()
+}
+
+func TestProbeHAState(t *testing.T) {
+	client := &http.Client{Timeout: time.Second}
+
+	observer := newMockNamenode(haStateObserver, true)
+	defer observer.Close()
+	assert.Equal(t, haStateObserver, probeHAState(client, "http", observer.httpAddress()))
+
+	active := newMockNamenode(haStateActive, false)
+	defer active.Close()
+	assert.Equal(t, haStateActive, probeHAState(client, "http", active.httpAddress()))
+
+	standby := newMockNamenode(haStateStandby, false)
+	standby.Close()
+	assert.Equal(t, haStateUnknown, probeHAState(client, "http", standby.httpAddress()))
+}
+
+func TestProviderHttpDetection(t *testing.T) {
+	nn1 := newMockNamenode(haStateStandby, true)
+	defer nn1.Close()
+	nn2 := newMockNamenode(haStateActive, true)
+	defer nn2.Close()
+
+	confMap := make(map[string]interface{})
+	confMap[HADetectionConfKey] = HADetectionHttp
+	confMap[NamenodeHttpAddressesConfKey] = nn1.httpAddress() + "," + nn2.httpAddress()
+	confMap[ProbeIntervalConfKey] = 100
+	confMap[MaxConnectionsConfKey] = 16
+	confMap[RequestTimeoutConfKey] = 1000
+	provider, err := NewHdfsProxyProvider(ProviderConf(confMap))
+	if err != nil {
+		t.Fatal("TestProviderHttpDetection:", err.Error())
+	}
+	provider.Pool = &mockPool{}
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	assert.Equal(t, RUN, provider.State)
+	assert.Equal(t, nn2.httpAddress(), provider.defaultNameservice.activeNNHttpAddress)
+
+	nn2.setHAState(haStateStandby)
+	time.Sleep(time.Duration(300) * time.Millisecond)
+	assert.Equal(t, PEND, provider.State)
+	assert.Equal(t, http.StatusServiceUnavailable, provider.Proxy(nil, &http.Request{Method: "GET"}))
+
+	nn1.setHAState(haStateActive)
+	time.Sleep(time.Duration(300) * time.Millisecond)
+	assert.Equal(t, RUN, provider.State)
+	assert.Equal(t, nn1.httpAddress(), provider.defaultNameservice.activeNNHttpAddress)
+	assert.Equal(t, http.StatusOK, provider.Proxy(nil, &http.Request{Method: "GET"}))
+	// finding the first active namenode is no change
+	assert.Equal(t, 1, provider.GetStats().Nameservices[0].ActiveChanges)
+
+	var transitions []string
+	for _, event := range provider.EventHistory() {
+		transitions = append(transitions, event.Kind+" "+event.Old+" -> "+event.New+", "+event.Reason)
+		if event.Kind == EventProviderState && event.Old == PEND.String() {
+			assert.True(t, event.PendingMs >= 200, event.PendingMs)
+		}
+	}
+	assert.Equal(t, []string{
+		"active_namenode  -> " + nn2.httpAddress() + ", " + ReasonProbeActive,
+		"nameservice_state initing -> running, " + ReasonStarted,
+		"provider_state initing -> running, default: " + ReasonStarted,
+		"nameservice_state running -> pending, " + ReasonProbeLostActive,
+		"provider_state running -> pending, default: " + ReasonProbeLostActive,
+		"active_namenode " + nn2.httpAddress() + " -> " + nn1.httpAddress() + ", " + ReasonProbeActive,
+		"nameservice_state pending -> running, " + ReasonProbeActive,
+		"provider_state pending -> running, default: " + ReasonProbeActive,
+	}, transitions)
+}
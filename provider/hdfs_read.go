@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"active-proxy/util"
+)
+
+const (
+	ObserverReadsConfKey        = "HDFS_OBSERVER_READS"
+	StandbyReadsConfKey         = "HDFS_STANDBY_READS"
+	ObserverReadOpsConfKey      = "HDFS_OBSERVER_READ_OPS"
+	ReadAfterWriteWindowConfKey = "HDFS_READ_AFTER_WRITE_WINDOW"
+
+	readAfterWriteWindowDefault = 5000
+	// writers older than the window are swept once so many clients are tracked
+	readAfterWriteSweepSize = 4096
+)
+
+var observerReadOpsDefault = []string{"GETFILESTATUS", "LISTSTATUS", "GETCONTENTSUMMARY", "OPEN"}
+
+// readRouter sends read-only webhdfs ops to observer (or standby) namenodes, except for clients
+// which wrote within the window, so that they keep reading their own writes from active namenode
+type readRouter struct {
+	readOps      map[string]bool
+	standbyReads bool
+	window       time.Duration
+	next         uint32
+
+	mutex      sync.Mutex
+	lastWrites map[string]time.Time
+}
+
+// newReadRouter returns nil unless HDFS_OBSERVER_READS is enabled
+func newReadRouter(conf ProviderConf) *readRouter {
+	if !conf.GetBoolOrDefault(ObserverReadsConfKey, false) {
+		return nil
+	}
+	readOps := conf.GetStringSlice(ObserverReadOpsConfKey)
+	if len(readOps) == 0 {
+		readOps = observerReadOpsDefault
+	}
+	router := &readRouter{
+		readOps:      make(map[string]bool),
+		standbyReads: conf.GetBoolOrDefault(StandbyReadsConfKey, false),
+		window:       time.Millisecond * time.Duration(conf.GetIntOrDefault(ReadAfterWriteWindowConfKey, readAfterWriteWindowDefault)),
+		lastWrites:   make(map[string]time.Time),
+	}
+	for _, op := range readOps {
+		router.readOps[strings.ToUpper(op)] = true
+	}
+	return router
+}
+
+// readClientKey identifies the client whose writes must stay visible to its reads
+func readClientKey(r *http.Request) string {
+	if user := util.WebHdfsUser(r); len(user) > 0 {
+		return "user:" + user
+	}
+	return "ip:" + util.ClientAddress(r)
+}
+
+func (router *readRouter) recordWrite(key string) {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	now := time.Now()
+	router.lastWrites[key] = now
+	if len(router.lastWrites) >= readAfterWriteSweepSize {
+		for k, lastWrite := range router.lastWrites {
+			if now.Sub(lastWrite) > router.window {
+				delete(router.lastWrites, k)
+			}
+		}
+	}
+}
+
+func (router *readRouter) wroteRecently(key string) bool {
+	router.mutex.Lock()
+	defer router.mutex.Unlock()
+
+	lastWrite, ok := router.lastWrites[key]
+	return ok && time.Since(lastWrite) <= router.window
+}
+
+// readTarget returns http address of the namenode serving r, or "" for the active namenode;
+// caller must hold provider mutex since ha states of namenodes are read
+func (router *readRouter) readTarget(ns *hdfsNameservice, r *http.Request) string {
+	op := util.WebHdfsOp(r)
+	key := readClientKey(r)
+	if util.IsMutatingOp(r.Method, op) {
+		router.recordWrite(key)
+		return ""
+	}
+	if !router.readOps[op] || router.wroteRecently(key) {
+		return ""
+	}
+
+	candidates := []string{}
+	for _, namenode := range ns.namenodes {
+		if namenode.haState == haStateObserver {
+			candidates = append(candidates, namenode.httpAddress)
+		}
+	}
+	if len(candidates) == 0 && router.standbyReads {
+		for _, namenode := range ns.namenodes {
+			if namenode.haState == haStateStandby {
+				candidates = append(candidates, namenode.httpAddress)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return candidates[int(atomic.AddUint32(&router.next, 1)%uint32(len(candidates)))]
+}
@@ -0,0 +1,47 @@
+package provider
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadRouter(t *testing.T) {
+	assert.Nil(t, newReadRouter(ProviderConf{}))
+
+	router := newReadRouter(ProviderConf{
+		ObserverReadsConfKey:        true,
+		ReadAfterWriteWindowConfKey: 200,
+	})
+	ns := &hdfsNameservice{
+		name: "ns1",
+		namenodes: []*hdfsNamenode{
+			{httpAddress: "nn1:50070", haState: haStateActive},
+			{httpAddress: "nn2:50070", haState: haStateStandby},
+			{httpAddress: "nn3:50070", haState: haStateObserver},
+		},
+	}
+
+	listStatus, _ := http.NewRequest("GET", "http://localhost:8080/webhdfs/v1/tmp?op=LISTSTATUS&user.name=alice", nil)
+	assert.Equal(t, "nn3:50070", router.readTarget(ns, listStatus))
+	checksum, _ := http.NewRequest("GET", "http://localhost:8080/webhdfs/v1/tmp/a?op=GETFILECHECKSUM&user.name=alice", nil)
+	assert.Equal(t, "", router.readTarget(ns, checksum))
+
+	// alice reads from active namenode right after her write, while bob still reads from observer
+	mkdirs, _ := http.NewRequest("PUT", "http://localhost:8080/webhdfs/v1/tmp/a?op=MKDIRS&user.name=alice", nil)
+	assert.Equal(t, "", router.readTarget(ns, mkdirs))
+	assert.Equal(t, "", router.readTarget(ns, listStatus))
+	bobListStatus, _ := http.NewRequest("GET", "http://localhost:8080/webhdfs/v1/tmp?op=LISTSTATUS&user.name=bob", nil)
+	assert.Equal(t, "nn3:50070", router.readTarget(ns, bobListStatus))
+
+	time.Sleep(time.Duration(300) * time.Millisecond)
+	assert.Equal(t, "nn3:50070", router.readTarget(ns, listStatus))
+
+	// standby namenodes serve reads only if allowed
+	ns.namenodes[2].haState = haStateUnknown
+	assert.Equal(t, "", router.readTarget(ns, listStatus))
+	router.standbyReads = true
+	assert.Equal(t, "nn2:50070", router.readTarget(ns, listStatus))
+}
@@ -11,6 +11,7 @@ import (
 	"active-proxy/util"
 
 	"github.com/golang/protobuf/proto"
+	goZk "github.com/samuel/go-zookeeper/zk"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,9 +19,9 @@ type mockPool struct {
 	util.ProxyTaskPoolInterface
 }
 
-func (pool *mockPool) Push(target string, rw http.ResponseWriter, r *http.Request) <-chan bool {
-	respChan := make(chan bool, 1)
-	respChan <- true
+func (pool *mockPool) Push(target string, rw http.ResponseWriter, r *http.Request) <-chan error {
+	respChan := make(chan error, 1)
+	respChan <- nil
 	return respChan
 }
 
@@ -70,16 +71,16 @@ func TestProviderStateTransformation(t *testing.T) {
 	hostname := "localhost"
 	nnInfo := marshalActiveNodeInfo(hostname)
 
-	zkClient.Create(provider.zkLockPath, nnInfo)
+	zkClient.Create(provider.defaultNameservice.zkLockPath, nnInfo)
 	time.Sleep(time.Duration(3) * time.Second)
 	assert.Equal(t, RUN, provider.State)
-	assert.Equal(t, hostname, provider.activeNNAddress)
+	assert.Equal(t, hostname, provider.defaultNameservice.activeNNAddress)
 
-	zkClient.Delete(provider.zkLockPath)
+	zkClient.Delete(provider.defaultNameservice.zkLockPath)
 	time.Sleep(time.Duration(1) * time.Second)
 	assert.Equal(t, PEND, provider.State)
 
-	zkClient.Create(provider.zkLockPath, nnInfo)
+	zkClient.Create(provider.defaultNameservice.zkLockPath, nnInfo)
 	time.Sleep(time.Duration(3) * time.Second)
 	assert.Equal(t, RUN, provider.State)
 }
@@ -94,9 +95,26 @@ func TestProviderProxy(t *testing.T) {
 	zkAddress := fmt.Sprintf("%s:%d", zkServer.Address, zkServer.Port)
 	zkClient, _ := zk.NewZKClient([]string{zkAddress}, 10)
 	defer zkClient.Close()
-	zkClient.Create(provider.zkLockPath, marshalActiveNodeInfo("localhost"))
+	zkClient.Create(provider.defaultNameservice.zkLockPath, marshalActiveNodeInfo("localhost"))
 	time.Sleep(time.Duration(3) * time.Second)
 
 	response := provider.Proxy(nil, &http.Request{Method: "GET"})
 	assert.Equal(t, http.StatusOK, response)
 }
+
+func TestEnsureRunningAuthFail(t *testing.T) {
+	provider := &HdfsProxyProvider{}
+	ns := &hdfsNameservice{name: "ns1", state: INIT, stateChan: make(chan stateChange, 1)}
+
+	// a lock which is not there yet is not an auth failure
+	provider.ensureRunning(ns, false, goZk.ErrNoNode, ReasonPollRecovered)
+	assert.Equal(t, 0, len(ns.stateChan))
+	provider.ensureRunning(ns, false, goZk.ErrNoAuth, ReasonPollRecovered)
+	assert.Equal(t, stateChange{AUTH_FAIL, ReasonZkAuthFailed}, <-ns.stateChan)
+	ns.state = AUTH_FAIL
+	provider.ensureRunning(ns, false, goZk.ErrAuthFailed, ReasonPollRecovered)
+	assert.Equal(t, 0, len(ns.stateChan))
+	provider.ensureRunning(ns, true, nil, ReasonPollRecovered)
+	assert.Equal(t, stateChange{RUN, ReasonPollRecovered}, <-ns.stateChan)
+	assert.Equal(t, "auth_failed", AUTH_FAIL.String())
+}
@@ -0,0 +1,46 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+
+	"active-proxy/util"
+)
+
+const (
+	UpstreamTLSConfKey           = "HDFS_UPSTREAM_TLS"
+	UpstreamTLSCAFileConfKey     = "HDFS_UPSTREAM_TLS_CA_FILE"
+	UpstreamTLSCertFileConfKey   = "HDFS_UPSTREAM_TLS_CERT_FILE"
+	UpstreamTLSKeyFileConfKey    = "HDFS_UPSTREAM_TLS_KEY_FILE"
+	UpstreamTLSServerNameConfKey = "HDFS_UPSTREAM_TLS_SERVER_NAME"
+)
+
+// initUpstreamTransport builds the transport shared by proxying and probing;
+// with HDFS_UPSTREAM_TLS (swebhdfs), namenode addresses are expected to be https ones
+func (provider *HdfsProxyProvider) initUpstreamTransport() error {
+	conf := provider.Conf
+	provider.transport = http.DefaultTransport.(*http.Transport).Clone()
+	if !conf.GetBoolOrDefault(UpstreamTLSConfKey, false) {
+		return nil
+	}
+
+	tlsConfig, err := util.NewClientTLSConfig(
+		conf.GetStringOrDefault(UpstreamTLSCAFileConfKey, ""),
+		conf.GetStringOrDefault(UpstreamTLSCertFileConfKey, ""),
+		conf.GetStringOrDefault(UpstreamTLSKeyFileConfKey, ""),
+		conf.GetStringOrDefault(UpstreamTLSServerNameConfKey, ""))
+	if err != nil {
+		return fmt.Errorf("init upstream tls: %s", err.Error())
+	}
+	provider.transport.TLSClientConfig = tlsConfig
+	provider.upstreamTLS = true
+	return nil
+}
+
+// upstreamScheme is the scheme of namenode urls
+func (provider *HdfsProxyProvider) upstreamScheme() string {
+	if provider.upstreamTLS {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,55 @@
+package provider
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProviderUpstreamTLS(t *testing.T) {
+	nn := newUnstartedMockNamenode(haStateActive, true)
+	nn.StartTLS()
+	defer nn.Close()
+
+	caFile, err := ioutil.TempFile("", "upstream-ca")
+	if err != nil {
+		t.Fatal("TestProviderUpstreamTLS:", err.Error())
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: nn.Certificate().Raw})
+	caFile.Close()
+
+	confMap := make(map[string]interface{})
+	confMap[HADetectionConfKey] = HADetectionHttp
+	confMap[NamenodeHttpAddressesConfKey] = nn.httpAddress()
+	confMap[ProbeIntervalConfKey] = 100
+	confMap[MaxConnectionsConfKey] = 16
+	confMap[RequestTimeoutConfKey] = 1000
+	confMap[UpstreamTLSConfKey] = true
+	confMap[UpstreamTLSCAFileConfKey] = caFile.Name()
+	// certificate of httptest servers is issued to example.com besides 127.0.0.1
+	confMap[UpstreamTLSServerNameConfKey] = "example.com"
+	provider, err := NewHdfsProxyProvider(ProviderConf(confMap))
+	if err != nil {
+		t.Fatal("TestProviderUpstreamTLS:", err.Error())
+	}
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	assert.Equal(t, RUN, provider.State)
+	assert.Equal(t, haStateActive, provider.defaultNameservice.namenodes[0].haState)
+
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/webhdfs/v1/tmp?op=LISTSTATUS", nil)
+	assert.Equal(t, http.StatusOK, provider.Proxy(rw, r))
+	assert.Equal(t, `{"FileStatuses":{"FileStatus":[]}}`, rw.Body.String())
+
+	// a bundle without certificates is refused
+	confMap[UpstreamTLSCAFileConfKey] = "/dev/null"
+	_, err = NewHdfsProxyProvider(ProviderConf(confMap))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,330 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+)
+
+const (
+	DelegationTokensConfKey           = "HDFS_DELEGATION_TOKENS"
+	DelegationTokenRenewerConfKey     = "HDFS_DELEGATION_TOKEN_RENEWER"
+	DelegationTokenIdleTimeoutConfKey = "HDFS_DELEGATION_TOKEN_IDLE_TIMEOUT"
+
+	delegationTokenIdleTimeoutDefault = 3600000
+	// tokens are renewed once this part of their remaining lifetime has passed
+	delegationTokenRenewRatio    = 0.8
+	delegationTokenCheckInterval = time.Minute
+	invalidTokenException        = "InvalidToken"
+	delegationTokenResponseLimit = 64 * 1024
+)
+
+// webhdfs ops which manage tokens themselves, namenodes refuse them when authenticated by a token
+var delegationTokenOps = map[string]bool{
+	"GETDELEGATIONTOKEN":    true,
+	"RENEWDELEGATIONTOKEN":  true,
+	"CANCELDELEGATIONTOKEN": true,
+}
+
+// tokenManager gets a delegation token for every user of every nameservice on behalf of clients,
+// and keeps it renewed while it is in use; tokens of an ha nameservice are shared by its namenodes,
+// so token ops always go to the namenode active at that moment and the cache survives failover
+type tokenManager struct {
+	provider    *HdfsProxyProvider
+	client      *http.Client
+	renewer     string
+	idleTimeout time.Duration
+
+	mutex  sync.Mutex
+	tokens map[string]*delegationToken `description:"keyed by nameservice/user"`
+}
+
+// delegationToken is fetched lazily, its mutex is held while it is fetched or renewed
+type delegationToken struct {
+	ns         *hdfsNameservice
+	user       string
+	lastUsed   time.Time `description:"guarded by tokenManager mutex"`
+	mutex      sync.Mutex
+	token      string
+	expiration time.Time
+	renewAt    time.Time
+}
+
+// injectedToken marks a proxied request authenticated by a managed token,
+// invalid is set by modifyResponse if the namenode refuses the token
+type injectedToken struct {
+	user    string
+	token   string
+	invalid bool
+}
+
+type injectedTokenKey struct{}
+
+// newTokenManager returns nil unless HDFS_DELEGATION_TOKENS is enabled, which needs kerberos with doas
+// since namenodes issue tokens to kerberos authenticated callers only
+func newTokenManager(provider *HdfsProxyProvider) (*tokenManager, error) {
+	conf := provider.Conf
+	if !conf.GetBoolOrDefault(DelegationTokensConfKey, false) {
+		return nil, nil
+	}
+	if provider.kerberos == nil || !provider.kerberos.doas {
+		return nil, fmt.Errorf("%s requires %s with %s enabled", DelegationTokensConfKey, KerberosPrincipalConfKey, KerberosDoasConfKey)
+	}
+	renewer := conf.GetStringOrDefault(DelegationTokenRenewerConfKey, "")
+	if len(renewer) == 0 {
+		// short name of the proxy principal, e.g. acproxy of acproxy/host@REALM
+		renewer = strings.FieldsFunc(conf.GetStringOrDefault(KerberosPrincipalConfKey, ""), func(r rune) bool {
+			return r == '/' || r == '@'
+		})[0]
+	}
+	return &tokenManager{
+		provider: provider,
+		client: &http.Client{
+			Transport: provider.probeTransport(),
+			Timeout:   time.Millisecond * time.Duration(conf.GetInt(RequestTimeoutConfKey)),
+		},
+		renewer:     renewer,
+		idleTimeout: time.Millisecond * time.Duration(conf.GetIntOrDefault(DelegationTokenIdleTimeoutConfKey, delegationTokenIdleTimeoutDefault)),
+		tokens:      make(map[string]*delegationToken),
+	}, nil
+}
+
+// inject returns a copy of r authenticated by the token of its user instead of user.name and doas,
+// r itself is returned along with nil if r is anonymous, carries its own token or fails to get one
+func (manager *tokenManager) inject(ns *hdfsNameservice, r *http.Request) (*http.Request, *injectedToken) {
+	op := util.WebHdfsOp(r)
+	user := util.WebHdfsUser(r)
+	if len(op) == 0 || delegationTokenOps[op] || len(user) == 0 || len(r.URL.Query().Get("delegation")) > 0 {
+		return r, nil
+	}
+	token, err := manager.token(ns, user)
+	if err != nil {
+		glog.Errorf("hdfs proxy provider: get delegation token of %s from %s fail, fall back to doas: %s", user, ns.name, err.Error())
+		return r, nil
+	}
+
+	injected := &injectedToken{user: user, token: token}
+	authenticated := r.Clone(context.WithValue(r.Context(), injectedTokenKey{}, injected))
+	query := authenticated.URL.Query()
+	query.Del("user.name")
+	query.Del("doas")
+	query.Set("delegation", token)
+	authenticated.URL.RawQuery = query.Encode()
+	return authenticated, injected
+}
+
+func injectedTokenOf(r *http.Request) *injectedToken {
+	if r == nil {
+		return nil
+	}
+	injected, _ := r.Context().Value(injectedTokenKey{}).(*injectedToken)
+	return injected
+}
+
+// token returns the cached token of user, fetching it from ns on first use
+func (manager *tokenManager) token(ns *hdfsNameservice, user string) (string, error) {
+	key := ns.name + "/" + user
+	manager.mutex.Lock()
+	entry, ok := manager.tokens[key]
+	if !ok {
+		entry = &delegationToken{ns: ns, user: user}
+		manager.tokens[key] = entry
+	}
+	entry.lastUsed = time.Now()
+	manager.mutex.Unlock()
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if len(entry.token) > 0 {
+		return entry.token, nil
+	}
+	token, err := manager.fetch(ns, user)
+	if err == nil {
+		// the first renewal tells when the token expires
+		var expiration time.Time
+		if expiration, err = manager.renew(ns, token); err != nil {
+			manager.cancel(ns, token)
+		} else {
+			entry.token = token
+			entry.setExpiration(expiration, time.Now())
+			glog.V(2).Infof("hdfs proxy provider: delegation token of %s from %s expires at %s.", user, ns.name, expiration.Format(time.RFC3339))
+			return token, nil
+		}
+	}
+	manager.remove(key, entry)
+	return "", err
+}
+
+func (entry *delegationToken) setExpiration(expiration time.Time, now time.Time) {
+	entry.expiration = expiration
+	entry.renewAt = now.Add(time.Duration(float64(expiration.Sub(now)) * delegationTokenRenewRatio))
+}
+
+// invalidate drops the token of user refused by a namenode, the next request gets a new one
+func (manager *tokenManager) invalidate(ns *hdfsNameservice, user string, token string) {
+	key := ns.name + "/" + user
+	manager.mutex.Lock()
+	entry := manager.tokens[key]
+	manager.mutex.Unlock()
+	if entry == nil {
+		return
+	}
+	entry.mutex.Lock()
+	stale := entry.token == token
+	entry.mutex.Unlock()
+	if stale {
+		glog.V(1).Infof("hdfs proxy provider: delegation token of %s is refused by %s, get a new one.", user, ns.name)
+		manager.remove(key, entry)
+	}
+}
+
+func (manager *tokenManager) remove(key string, entry *delegationToken) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.tokens[key] == entry {
+		delete(manager.tokens, key)
+	}
+}
+
+func (manager *tokenManager) monitorTokens() {
+	for now := range time.Tick(delegationTokenCheckInterval) {
+		manager.maintainTokens(now)
+	}
+}
+
+// maintainTokens cancels tokens idle for the idle timeout, and renews the others when they are due;
+// a token which can not be renewed any more (renewal fails or reaches its max lifetime) is retired
+func (manager *tokenManager) maintainTokens(now time.Time) {
+	var idle, due []*delegationToken
+	manager.mutex.Lock()
+	for key, entry := range manager.tokens {
+		if now.Sub(entry.lastUsed) >= manager.idleTimeout {
+			delete(manager.tokens, key)
+			idle = append(idle, entry)
+		} else {
+			due = append(due, entry)
+		}
+	}
+	manager.mutex.Unlock()
+
+	for _, entry := range idle {
+		entry.mutex.Lock()
+		if len(entry.token) > 0 {
+			glog.V(2).Infof("hdfs proxy provider: cancel idle delegation token of %s from %s.", entry.user, entry.ns.name)
+			manager.cancel(entry.ns, entry.token)
+			entry.token = ""
+		}
+		entry.mutex.Unlock()
+	}
+	for _, entry := range due {
+		manager.renewIfDue(entry, now)
+	}
+}
+
+func (manager *tokenManager) renewIfDue(entry *delegationToken, now time.Time) {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if len(entry.token) == 0 || now.Before(entry.renewAt) {
+		return
+	}
+	expiration, err := manager.renew(entry.ns, entry.token)
+	if err == nil && expiration.After(entry.expiration) {
+		entry.setExpiration(expiration, now)
+		return
+	}
+	if err != nil {
+		glog.Errorf("hdfs proxy provider: renew delegation token of %s from %s fail, retire it: %s", entry.user, entry.ns.name, err.Error())
+	} else {
+		glog.V(2).Infof("hdfs proxy provider: delegation token of %s from %s reaches its max lifetime, retire it.", entry.user, entry.ns.name)
+		manager.cancel(entry.ns, entry.token)
+	}
+	entry.token = ""
+	manager.remove(entry.ns.name+"/"+entry.user, entry)
+}
+
+// fetch gets a new token of user, the proxy being its renewer
+func (manager *tokenManager) fetch(ns *hdfsNameservice, user string) (string, error) {
+	result := &struct {
+		Token *struct {
+			UrlString string `json:"urlString"`
+		} `json:"Token"`
+	}{}
+	params := url.Values{"op": {"GETDELEGATIONTOKEN"}, "doas": {user}, "renewer": {manager.renewer}}
+	if err := manager.call(ns, http.MethodGet, params, result); err != nil {
+		return "", err
+	}
+	if result.Token == nil || len(result.Token.UrlString) == 0 {
+		return "", fmt.Errorf("no token is issued")
+	}
+	return result.Token.UrlString, nil
+}
+
+// renew extends the lifetime of token, and returns when it expires
+func (manager *tokenManager) renew(ns *hdfsNameservice, token string) (time.Time, error) {
+	result := &struct {
+		Long *int64 `json:"long"`
+	}{}
+	params := url.Values{"op": {"RENEWDELEGATIONTOKEN"}, "token": {token}}
+	if err := manager.call(ns, http.MethodPut, params, result); err != nil {
+		return time.Time{}, err
+	}
+	if result.Long == nil {
+		return time.Time{}, fmt.Errorf("no expiration time is returned")
+	}
+	return time.Unix(0, *result.Long*int64(time.Millisecond)), nil
+}
+
+// cancel is best effort, a token left behind expires by itself
+func (manager *tokenManager) cancel(ns *hdfsNameservice, token string) {
+	params := url.Values{"op": {"CANCELDELEGATIONTOKEN"}, "token": {token}}
+	if err := manager.call(ns, http.MethodPut, params, nil); err != nil {
+		glog.Warningf("hdfs proxy provider: cancel delegation token from %s fail: %s", ns.name, err.Error())
+	}
+}
+
+// call sends a token op to the active namenode of ns and decodes its json answer into result
+func (manager *tokenManager) call(ns *hdfsNameservice, method string, params url.Values, result interface{}) error {
+	manager.provider.mutex.RLock()
+	state := ns.state
+	address := ns.activeNNHttpAddress
+	manager.provider.mutex.RUnlock()
+	if state != RUN {
+		return fmt.Errorf("nameservice %s is %s", ns.name, state)
+	}
+
+	target := fmt.Sprintf("%s://%s%s?%s", manager.provider.upstreamScheme(), address, util.WebHdfsPathPrefix+"/", params.Encode())
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := manager.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, delegationTokenResponseLimit))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if exception := util.ParseRemoteException(data); exception != nil {
+			return fmt.Errorf("%s %s: %s", params.Get("op"), exception.Exception, exception.Message)
+		}
+		return fmt.Errorf("%s answers %s with %d", address, params.Get("op"), resp.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
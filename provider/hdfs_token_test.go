@@ -0,0 +1,125 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockTokenNamenode issues tokens named after their owners, and refuses tokens which are revoked
+type mockTokenNamenode struct {
+	mutex      sync.Mutex
+	issued     int
+	renewals   map[string]int
+	revoked    map[string]bool
+	lastQuery  string
+	expiration time.Time
+}
+
+func (nn *mockTokenNamenode) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	nn.mutex.Lock()
+	defer nn.mutex.Unlock()
+	query := r.URL.Query()
+	switch query.Get("op") {
+	case "GETDELEGATIONTOKEN":
+		nn.issued++
+		fmt.Fprintf(rw, `{"Token":{"urlString":"%s-%d"}}`, query.Get("doas"), nn.issued)
+	case "RENEWDELEGATIONTOKEN":
+		nn.renewals[query.Get("token")]++
+		fmt.Fprintf(rw, `{"long":%d}`, nn.expiration.UnixNano()/int64(time.Millisecond))
+	case "CANCELDELEGATIONTOKEN":
+		nn.revoked[query.Get("token")] = true
+	default:
+		nn.lastQuery = r.URL.RawQuery
+		if token := query.Get("delegation"); nn.revoked[token] {
+			util.WriteRemoteException(rw, http.StatusForbidden, &util.RemoteException{
+				Exception:     invalidTokenException,
+				JavaClassName: "org.apache.hadoop.security.token.SecretManager$InvalidToken",
+				Message:       "token can't be found in cache",
+			})
+			return
+		}
+		rw.Write([]byte(`{"FileStatuses":{"FileStatus":[]}}`))
+	}
+}
+
+func TestDelegationTokens(t *testing.T) {
+	nn := &mockTokenNamenode{renewals: make(map[string]int), revoked: make(map[string]bool), expiration: time.Now().Add(time.Hour)}
+	namenode := httptest.NewServer(nn)
+	defer namenode.Close()
+
+	conf := ProviderConf{RequestTimeoutConfKey: 1000}
+	ns := &hdfsNameservice{name: "default", state: RUN, activeNNHttpAddress: strings.TrimPrefix(namenode.URL, "http://")}
+	provider := &HdfsProxyProvider{
+		BaseProxyProvider:  BaseProxyProvider{Conf: conf, State: RUN},
+		nameservices:       []*hdfsNameservice{ns},
+		defaultNameservice: ns,
+	}
+	provider.tokens = &tokenManager{
+		provider:    provider,
+		client:      &http.Client{Timeout: time.Second},
+		renewer:     "acproxy",
+		idleTimeout: time.Hour,
+		tokens:      make(map[string]*delegationToken),
+	}
+	provider.Pool, _ = util.NewProxyTaskPool(4, util.WithResponseModifier(provider.modifyResponse))
+	go provider.Pool.Do()
+	proxy := func(uri string) int {
+		recorder := httptest.NewRecorder()
+		statusCode := provider.Proxy(recorder, httptest.NewRequest("GET", uri, nil))
+		if statusCode == http.StatusOK {
+			statusCode = recorder.Code
+		}
+		return statusCode
+	}
+
+	// the token replaces user.name, and is got only once
+	assert.Equal(t, http.StatusOK, proxy("/webhdfs/v1/tmp?op=LISTSTATUS&user.name=alice"))
+	assert.Equal(t, "delegation=alice-1&op=LISTSTATUS", nn.lastQuery)
+	assert.Equal(t, http.StatusOK, proxy("/webhdfs/v1/tmp?op=LISTSTATUS&user.name=alice"))
+	assert.Equal(t, 1, nn.issued)
+	assert.Equal(t, 1, nn.renewals["alice-1"])
+	// tokens of clients and token ops are passed through
+	assert.Equal(t, http.StatusOK, proxy("/webhdfs/v1/tmp?op=LISTSTATUS&delegation=own"))
+	assert.Equal(t, "op=LISTSTATUS&delegation=own", nn.lastQuery)
+	assert.Equal(t, 1, nn.issued)
+
+	// after failover the same token is used against the new active namenode
+	standby := httptest.NewServer(nn)
+	defer standby.Close()
+	provider.mutex.Lock()
+	ns.activeNNHttpAddress = strings.TrimPrefix(standby.URL, "http://")
+	provider.mutex.Unlock()
+	assert.Equal(t, http.StatusOK, proxy("/webhdfs/v1/tmp?op=LISTSTATUS&user.name=alice"))
+	assert.Equal(t, 1, nn.issued)
+
+	// a refused token is replaced, and the attempt is left for retry
+	nn.revoked["alice-1"] = true
+	assert.Equal(t, http.StatusServiceUnavailable, proxy("/webhdfs/v1/tmp?op=LISTSTATUS&user.name=alice"))
+	assert.Equal(t, http.StatusOK, proxy("/webhdfs/v1/tmp?op=LISTSTATUS&user.name=alice"))
+	assert.Equal(t, "delegation=alice-2&op=LISTSTATUS", nn.lastQuery)
+
+	// tokens are renewed when due, retired at max lifetime, and cancelled when idle
+	provider.tokens.maintainTokens(time.Now())
+	assert.Equal(t, 1, nn.renewals["alice-2"])
+	nn.expiration = nn.expiration.Add(time.Minute)
+	provider.tokens.maintainTokens(time.Now().Add(50 * time.Minute))
+	assert.Equal(t, 2, nn.renewals["alice-2"])
+	provider.tokens.maintainTokens(time.Now().Add(59 * time.Minute))
+	assert.Equal(t, 3, nn.renewals["alice-2"])
+	assert.True(t, nn.revoked["alice-2"])
+	assert.Equal(t, 0, len(provider.tokens.tokens))
+
+	assert.Equal(t, http.StatusOK, proxy("/webhdfs/v1/tmp?op=LISTSTATUS&user.name=bob"))
+	provider.tokens.maintainTokens(time.Now().Add(2 * time.Hour))
+	assert.True(t, nn.revoked["bob-3"])
+	assert.Equal(t, 0, len(provider.tokens.tokens))
+}
@@ -0,0 +1,201 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"active-proxy/provider/hadoop_yarn"
+	zkClient "active-proxy/provider/zk"
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+type YarnProxyProvider struct {
+	BaseProxyProvider
+	activeRMId      string            `description:"id of active resourcemanager"`
+	activeRMAddress string            `description:"active resourcemanager webapp address"`
+	rmAddresses     map[string]string `description:"webapp addresses of resourcemanagers keyed by rm id"`
+	zkLockPath      string            `description:"zkPath which contains active resourcemanager info"`
+
+	initWg sync.WaitGroup
+	mutex  sync.RWMutex
+}
+
+const (
+	YarnZkServersConfKey         = "YARN_ZK_SERVERS"
+	YarnZkParentPathConfKey      = "YARN_ZK_PARENT_PATH"
+	YarnClusterIdConfKey         = "YARN_CLUSTER_ID"
+	YarnRMWebappAddressesConfKey = "YARN_RM_WEBAPP_ADDRESSES"
+	YarnMaxConnectionsConfKey    = "YARN_MAX_CONNECTIONS"
+	YarnRequestTimeoutConfKey    = "YARN_REQUEST_TIMEOUT"
+
+	yarnZkParentPathDefault = "/yarn-leader-election"
+	yarnZkLockName          = "ActiveStandbyElectorLock"
+)
+
+func NewYarnProxyProvider(conf ProviderConf) (*YarnProxyProvider, error) {
+	rmAddresses, err := parseRMWebappAddresses(conf.GetString(YarnRMWebappAddressesConfKey))
+	if err != nil {
+		return nil, err
+	}
+	provider := &YarnProxyProvider{
+		BaseProxyProvider: BaseProxyProvider{
+			Conf:      conf,
+			Type:      YARN,
+			State:     INIT,
+			StateChan: make(chan ProviderState),
+		},
+		rmAddresses: rmAddresses,
+		zkLockPath: path.Join(conf.GetStringOrDefault(YarnZkParentPathConfKey, yarnZkParentPathDefault),
+			conf.GetString(YarnClusterIdConfKey), yarnZkLockName),
+	}
+	provider.Pool, _ = util.NewProxyTaskPool(conf.GetInt(YarnMaxConnectionsConfKey))
+	go provider.Pool.Do()
+
+	provider.initWg.Add(2)
+	go provider.monitorZkLockPath()
+	go provider.monitorProviderState()
+	// wait until two monitor goroutines finish initialization
+	provider.initWg.Wait()
+
+	return provider, nil
+}
+
+// parseRMWebappAddresses parses "rm1=host1:8088,rm2=host2:8088" into a map keyed by rm id,
+// since the election lock only records the id of the active resourcemanager
+func parseRMWebappAddresses(value string) (map[string]string, error) {
+	addresses := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+			return nil, fmt.Errorf("invalid resourcemanager webapp address %q, expect rmId=host:port", item)
+		}
+		addresses[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no resourcemanager webapp address in %s", YarnRMWebappAddressesConfKey)
+	}
+	return addresses, nil
+}
+
+func (provider *YarnProxyProvider) resolveActiveRMInfo(client *zkClient.ZKClient) (bool, <-chan zk.Event) {
+	data, ch, _ := client.GetW(provider.zkLockPath)
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if data != nil && len(data) != 0 {
+		activeRMInfo := &hadoop_yarn.ActiveRMInfoProto{}
+		proto.Unmarshal(data, activeRMInfo)
+		address, ok := provider.rmAddresses[activeRMInfo.GetRmId()]
+		if !ok {
+			glog.Warningf("yarn proxy provider: no webapp address configured for active resourcemanager %s.", activeRMInfo.GetRmId())
+			return false, ch
+		}
+		if provider.activeRMAddress != address {
+			glog.V(2).Infof("yarn proxy provider: active resourcemanager changes from %s(%s) to %s(%s).",
+				provider.activeRMId, provider.activeRMAddress, activeRMInfo.GetRmId(), address)
+			provider.activeRMId = activeRMInfo.GetRmId()
+			provider.activeRMAddress = address
+		}
+		return true, ch
+	}
+	return false, ch
+}
+
+func (provider *YarnProxyProvider) monitorZkLockPath() {
+	zkServers := strings.Split(provider.Conf.GetString(YarnZkServersConfKey), ",")
+	var success bool
+	var ch <-chan zk.Event
+	client, err := zkClient.NewZKClient(zkServers, 1)
+	if err == nil {
+		success, ch = provider.resolveActiveRMInfo(client)
+	}
+	if success {
+		provider.StateChan <- RUN
+	}
+	provider.initWg.Done()
+	// keep the proxy alive and retry, provider stays out of service meanwhile
+	for err != nil {
+		glog.Errorf("yarn proxy provider: init zkclient fail, retry in %s: %s", zkRetryInterval, err.Error())
+		time.Sleep(zkRetryInterval)
+		client, err = zkClient.NewZKClient(zkServers, 1)
+	}
+	for {
+		select {
+		case e := <-ch:
+			if e.Type == zk.EventNodeDeleted {
+				provider.StateChan <- PEND
+			}
+			_, ch = provider.resolveActiveRMInfo(client)
+
+		case <-time.After(time.Duration(3) * time.Second):
+			success, ch = provider.resolveActiveRMInfo(client)
+			provider.mutex.RLock()
+			if success && provider.State != RUN {
+				provider.StateChan <- RUN
+			}
+			provider.mutex.RUnlock()
+		}
+	}
+}
+
+func (provider *YarnProxyProvider) monitorProviderState() {
+	provider.initWg.Done()
+	for {
+		state := <-provider.StateChan
+		provider.mutex.Lock()
+		if provider.State != state {
+			glog.V(2).Infof("yarn proxy provider: state changes from %s to %s.", provider.State, state)
+			provider.State = state
+		}
+		provider.mutex.Unlock()
+	}
+}
+
+func (provider *YarnProxyProvider) Proxy(rw http.ResponseWriter, r *http.Request) int {
+	// the lock is not held upstream, a failover would wait for every request in flight otherwise
+	provider.mutex.RLock()
+	state, activeRMAddress := provider.State, provider.activeRMAddress
+	provider.mutex.RUnlock()
+
+	if state != RUN {
+		return http.StatusServiceUnavailable
+	}
+
+	util.SetUpstream(r, activeRMAddress)
+	url := fmt.Sprintf("%s://%s", "http", activeRMAddress)
+	select {
+	case <-time.After(time.Millisecond * time.Duration(provider.Conf.GetInt(YarnRequestTimeoutConfKey))):
+		return http.StatusRequestTimeout
+
+	case <-provider.Pool.Push(url, rw, r):
+		return http.StatusOK
+	}
+}
+
+func (provider *YarnProxyProvider) GetStats() ProviderStats {
+	provider.mutex.RLock()
+	defer provider.mutex.RUnlock()
+
+	stats := ProviderStats{State: provider.State.String()}
+	switch provider.State {
+	case RUN:
+		stats.Explain = "yarn proxy is in service"
+	case PEND:
+		stats.Explain = "perhaps resourcemanager election is taking place, or all resourcemanagers are dead"
+	default:
+		stats.Explain = "perhaps all resourcemanagers are dead"
+	}
+	return stats
+}
@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"active-proxy/provider/hadoop_yarn"
+	"active-proxy/provider/zk"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func prepareYarn() (*YarnProxyProvider, *zk.ZKServer, error) {
+	zkServer, err := zk.StartFatZkServer()
+	if err != nil {
+		return nil, nil, err
+	}
+	confMap := make(map[string]interface{})
+	confMap[YarnZkServersConfKey] = fmt.Sprintf("%s:%d", zkServer.Address, zkServer.Port)
+	confMap[YarnClusterIdConfKey] = "yarn-cluster"
+	confMap[YarnRMWebappAddressesConfKey] = "rm1=localhost:8088,rm2=localhost:8089"
+	confMap[YarnMaxConnectionsConfKey] = 16
+	confMap[YarnRequestTimeoutConfKey] = 1000
+	provider, err := NewYarnProxyProvider(ProviderConf(confMap))
+	if err != nil {
+		zkServer.Stop()
+		return nil, nil, err
+	}
+	provider.Pool = &mockPool{}
+	return provider, zkServer, nil
+}
+
+func marshalActiveRMInfo(rmId string) []byte {
+	clusterId := "yarn-cluster"
+	rmInfo := &hadoop_yarn.ActiveRMInfoProto{ClusterId: &clusterId, RmId: &rmId}
+	data, _ := proto.Marshal(rmInfo)
+	return data
+}
+
+func TestParseRMWebappAddresses(t *testing.T) {
+	addresses, err := parseRMWebappAddresses("rm1=host1:8088, rm2=host2:8090")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"rm1": "host1:8088", "rm2": "host2:8090"}, addresses)
+
+	_, err = parseRMWebappAddresses("host1:8088")
+	assert.NotNil(t, err)
+	_, err = parseRMWebappAddresses("")
+	assert.NotNil(t, err)
+}
+
+// pushingPool answers Push with what push returns
+type pushingPool struct {
+	mockPool
+	push func(target string) error
+}
+
+func (pool *pushingPool) Push(target string, rw http.ResponseWriter, r *http.Request) <-chan error {
+	respChan := make(chan error, 1)
+	respChan <- pool.push(target)
+	return respChan
+}
+
+func TestYarnProxyReleasesLock(t *testing.T) {
+	provider := &YarnProxyProvider{activeRMAddress: "localhost:8089"}
+	provider.State = RUN
+	provider.Conf = ProviderConf{YarnRequestTimeoutConfKey: 1000}
+	// a failover takes the write lock while requests are upstream
+	provider.Pool = &pushingPool{push: func(target string) error {
+		assert.Equal(t, "http://localhost:8089", target)
+		if assert.True(t, provider.mutex.TryLock(), "the lock is held upstream") {
+			provider.mutex.Unlock()
+		}
+		return nil
+	}}
+	assert.Equal(t, http.StatusOK, provider.Proxy(nil, &http.Request{Method: "GET"}))
+}
+
+func TestActiveRMInfoProto(t *testing.T) {
+	rmInfo := &hadoop_yarn.ActiveRMInfoProto{}
+	assert.Nil(t, proto.Unmarshal(marshalActiveRMInfo("rm2"), rmInfo))
+	assert.Equal(t, "yarn-cluster", rmInfo.GetClusterId())
+	assert.Equal(t, "rm2", rmInfo.GetRmId())
+}
+
+func TestYarnProviderStateTransformation(t *testing.T) {
+	provider, zkServer, err := prepareYarn()
+	if err != nil {
+		t.Fatal("TestYarnProviderStateTransformation:", err.Error())
+	}
+	defer zkServer.Stop()
+
+	zkAddress := fmt.Sprintf("%s:%d", zkServer.Address, zkServer.Port)
+	zkClient, _ := zk.NewZKClient([]string{zkAddress}, 10)
+	defer zkClient.Close()
+
+	assert.Equal(t, INIT, provider.State)
+
+	zkClient.Create("/yarn-leader-election", nil)
+	zkClient.Create("/yarn-leader-election/yarn-cluster", nil)
+	zkClient.Create(provider.zkLockPath, marshalActiveRMInfo("rm2"))
+	time.Sleep(time.Duration(3) * time.Second)
+	assert.Equal(t, RUN, provider.State)
+	assert.Equal(t, "localhost:8089", provider.activeRMAddress)
+
+	zkClient.Delete(provider.zkLockPath)
+	time.Sleep(time.Duration(1) * time.Second)
+	assert.Equal(t, PEND, provider.State)
+
+	response := provider.Proxy(nil, &http.Request{Method: "GET"})
+	assert.Equal(t, http.StatusServiceUnavailable, response)
+}
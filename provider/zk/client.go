@@ -1,27 +1,222 @@
 package zk
 
 import (
+	"fmt"
+	"io/ioutil"
+	"strings"
 	"time"
 
 	"github.com/samuel/go-zookeeper/zk"
 )
 
 type ZKClient struct {
-	zkServers []string
-	conn      *zk.Conn
+	zkServers    []string
+	conn         *zk.Conn
+	auths        []Auth
+	acl          []zk.ACL                        `description:"acl of created nodes"`
+	newMechanism func(host string) saslMechanism `description:"sasl of every connection, nil if none"`
+	saslResult   chan error                      `description:"how the sasl exchange of the first connection ends"`
 }
 
-func NewZKClient(zkServers []string, timeout int) (*ZKClient, error) {
-	conn, _, err := zk.Connect(zkServers, time.Second*time.Duration(timeout))
+// Auth is a scheme and credentials added to zookeeper sessions, like ha.zookeeper.auth of hadoop
+type Auth struct {
+	Scheme string
+	Auth   []byte
+}
+
+type ZKClientOption func(client *ZKClient)
+
+// WithAuth adds credentials to the session, they are sent again on reconnect
+func WithAuth(auths ...Auth) ZKClientOption {
+	return func(client *ZKClient) {
+		client.auths = append(client.auths, auths...)
+	}
+}
+
+// WithACL sets acl of created nodes instead of world:anyone:cdrwa
+func WithACL(acl []zk.ACL) ZKClientOption {
+	return func(client *ZKClient) {
+		client.acl = acl
+	}
+}
+
+func NewZKClient(zkServers []string, timeout int, options ...ZKClientOption) (*ZKClient, error) {
+	client := &ZKClient{zkServers: zkServers, acl: zk.WorldACL(zk.PermAll)}
+	for _, option := range options {
+		option(client)
+	}
+	var conn *zk.Conn
+	var err error
+	if client.newMechanism != nil {
+		client.saslResult = make(chan error, 1)
+		conn, _, err = zk.Connect(zkServers, time.Second*time.Duration(timeout), zk.WithDialer(client.dialSasl))
+	} else {
+		conn, _, err = zk.Connect(zkServers, time.Second*time.Duration(timeout))
+	}
 	if err != nil {
 		return nil, err
 	}
 	conn.SetLogger(NilLogger{})
+	client.conn = conn
 
-	client := &ZKClient{zkServers: zkServers, conn: conn}
+	if err := client.waitSasl(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := client.addAuths(); err != nil {
+		conn.Close()
+		return nil, err
+	}
 	return client, nil
 }
 
+// AuthTimeout bounds how long NewZKClient waits for zookeeper to take the credentials of the session
+var AuthTimeout = 10 * time.Second
+
+// ErrAuthTimeout means zookeeper is not reached in time to add credentials to the session
+var ErrAuthTimeout = fmt.Errorf("zookeeper is not reached in time to add credentials")
+
+// waitSasl waits for the sasl exchange of the first connection within AuthTimeout, zk.ErrAuthFailed tells zookeeper
+// refuses the credentials
+func (client *ZKClient) waitSasl() error {
+	if client.newMechanism == nil {
+		return nil
+	}
+	select {
+	case err := <-client.saslResult:
+		return err
+	case <-time.After(AuthTimeout):
+		return ErrAuthTimeout
+	}
+}
+
+// addAuths adds credentials within AuthTimeout: go-zookeeper holds AddAuth until the session is connected,
+// which is never while zookeeper is unreachable; closing the connection lets it return
+func (client *ZKClient) addAuths() error {
+	if len(client.auths) == 0 {
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		for _, auth := range client.auths {
+			if err := client.conn.AddAuth(auth.Scheme, auth.Auth); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(AuthTimeout):
+		return ErrAuthTimeout
+	}
+}
+
+// IsAuthError tells whether err means zookeeper refuses the credentials of the session
+func IsAuthError(err error) bool {
+	return err == zk.ErrNoAuth || err == zk.ErrAuthFailed
+}
+
+// ParseAuths parses comma separated scheme:credentials, e.g. digest:user:password,
+// a value starting with @ is read from the file it names, as hadoop does for ha.zookeeper.auth
+func ParseAuths(value string) ([]Auth, error) {
+	value, err := resolveIndirection(value)
+	if err != nil {
+		return nil, err
+	}
+	var auths []Auth
+	for _, item := range splitList(value) {
+		index := strings.Index(item, ":")
+		if index <= 0 || index == len(item)-1 {
+			return nil, fmt.Errorf("zookeeper auth %q is not scheme:credentials", redact(item))
+		}
+		scheme := item[:index]
+		if scheme == "sasl" {
+			// sasl is an exchange on every connection rather than credentials added to the session
+			return nil, fmt.Errorf("zookeeper sasl is not given as credentials, it takes the kerberos login of the provider instead")
+		}
+		auths = append(auths, Auth{Scheme: scheme, Auth: []byte(item[index+1:])})
+	}
+	return auths, nil
+}
+
+// ParseACL parses comma separated scheme:id:perms, e.g. digest:user:base64sha1:cdrwa,world:anyone:r,
+// a value starting with @ is read from the file it names, as hadoop does for ha.zookeeper.acl
+func ParseACL(value string) ([]zk.ACL, error) {
+	value, err := resolveIndirection(value)
+	if err != nil {
+		return nil, err
+	}
+	var acl []zk.ACL
+	for _, item := range splitList(value) {
+		first, last := strings.Index(item, ":"), strings.LastIndex(item, ":")
+		if first <= 0 || first == last {
+			return nil, fmt.Errorf("zookeeper acl %q is not scheme:id:perms", item)
+		}
+		perms, err := parsePerms(item[last+1:])
+		if err != nil {
+			return nil, fmt.Errorf("zookeeper acl %q: %s", item, err.Error())
+		}
+		acl = append(acl, zk.ACL{Perms: perms, Scheme: item[:first], ID: item[first+1 : last]})
+	}
+	return acl, nil
+}
+
+func parsePerms(value string) (int32, error) {
+	var perms int32
+	for _, c := range strings.ToLower(value) {
+		switch c {
+		case 'r':
+			perms |= zk.PermRead
+		case 'w':
+			perms |= zk.PermWrite
+		case 'c':
+			perms |= zk.PermCreate
+		case 'd':
+			perms |= zk.PermDelete
+		case 'a':
+			perms |= zk.PermAdmin
+		default:
+			return 0, fmt.Errorf("invalid permission %q, expect some of rwcda", c)
+		}
+	}
+	if perms == 0 {
+		return 0, fmt.Errorf("no permission is given")
+	}
+	return perms, nil
+}
+
+func resolveIndirection(value string) (string, error) {
+	if !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(value[1:])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// redact keeps the scheme and user of credentials for error messages
+func redact(auth string) string {
+	if index := strings.LastIndex(auth, ":"); index > 0 {
+		return auth[:index] + ":***"
+	}
+	return "***"
+}
+
 type NilLogger struct {
 	zk.Logger
 }
@@ -34,6 +229,11 @@ func (client *ZKClient) Close() {
 	client.conn.Close()
 }
 
+// State is the state of the zookeeper session, e.g. StateHasSession
+func (client *ZKClient) State() zk.State {
+	return client.conn.State()
+}
+
 func (client *ZKClient) GetW(zkPath string) ([]byte, <-chan zk.Event, error) {
 	data, _, event, err := client.conn.GetW(zkPath)
 	return data, event, err
@@ -44,6 +244,6 @@ func (client *ZKClient) Delete(zkPath string) error {
 }
 
 func (client *ZKClient) Create(zkPath string, value []byte) error {
-	_, err := client.conn.Create(zkPath, value, 0, zk.WorldACL(zk.PermAll))
+	_, err := client.conn.Create(zkPath, value, 0, client.acl)
 	return err
 }
@@ -0,0 +1,83 @@
+package zk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAuths(t *testing.T) {
+	auths, err := ParseAuths("digest:hdfs-zkfcs:pass:word, digest:acproxy:secret")
+	assert.Nil(t, err)
+	assert.Equal(t, []Auth{
+		{Scheme: "digest", Auth: []byte("hdfs-zkfcs:pass:word")},
+		{Scheme: "digest", Auth: []byte("acproxy:secret")},
+	}, auths)
+
+	file, err := ioutil.TempFile("", "zk-auth")
+	if err != nil {
+		t.Fatal("TestParseAuths:", err.Error())
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("digest:acproxy:secret\n")
+	file.Close()
+	auths, err = ParseAuths("@" + file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, []Auth{{Scheme: "digest", Auth: []byte("acproxy:secret")}}, auths)
+
+	// sasl is an exchange of every connection (WithKerberos), not credentials of the session
+	_, err = ParseAuths("sasl:acproxy")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "kerberos login")
+	}
+	_, err = ParseAuths("digest:")
+	assert.NotNil(t, err)
+	_, err = ParseAuths("@/nonexistent/zk-auth")
+	assert.NotNil(t, err)
+}
+
+func TestParseACL(t *testing.T) {
+	acl, err := ParseACL("digest:acproxy:mJ8Dm+mG0cOgvrrAXTlGnwsDYmU=:cdrwa,world:anyone:r,sasl:hdfs:RW")
+	assert.Nil(t, err)
+	assert.Equal(t, []zk.ACL{
+		{Perms: zk.PermAll, Scheme: "digest", ID: "acproxy:mJ8Dm+mG0cOgvrrAXTlGnwsDYmU="},
+		{Perms: zk.PermRead, Scheme: "world", ID: "anyone"},
+		{Perms: zk.PermRead | zk.PermWrite, Scheme: "sasl", ID: "hdfs"},
+	}, acl)
+
+	_, err = ParseACL("world:anyone")
+	assert.NotNil(t, err)
+	_, err = ParseACL("world:anyone:rx")
+	assert.NotNil(t, err)
+}
+
+func TestAuthTimeout(t *testing.T) {
+	timeout := AuthTimeout
+	AuthTimeout = 200 * time.Millisecond
+	defer func() { AuthTimeout = timeout }()
+
+	// zookeeper takes connections and never answers, credentials are never taken
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("TestAuthTimeout:", err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	start := time.Now()
+	_, err = NewZKClient([]string{listener.Addr().String()}, 1, WithAuth(Auth{Scheme: "digest", Auth: []byte("acproxy:secret")}))
+	assert.Equal(t, ErrAuthTimeout, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,345 @@
+package zk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	krbClient "github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	// opSasl is the zookeeper request carrying sasl tokens, go-zookeeper does not know it
+	opSasl = 102
+	// saslXid is the xid of sasl requests, which are answered before go-zookeeper sends any request
+	saslXid = 1
+	// errAuthFailed is the error code zookeeper answers refused sasl tokens with
+	errAuthFailed = -115
+	// maxFrameSize bounds frames read during the sasl exchange, as jute.maxbuffer does
+	maxFrameSize = 4 << 20
+
+	// saslNoSecurityLayer is the only sasl security layer spoken, messages after authentication are neither
+	// signed nor sealed
+	saslNoSecurityLayer = 1
+)
+
+// saslMechanism is the client side of a sasl mechanism: the first token is sent unasked,
+// every challenge of zookeeper is answered until the mechanism is complete
+type saslMechanism interface {
+	start() ([]byte, error)
+	step(challenge []byte) ([]byte, error)
+	complete() bool
+}
+
+// WithKerberos authenticates sessions with sasl (GSSAPI) as the kerberos login of client, to the zookeeper
+// principal given by servicePrincipal, where _HOST is replaced by the zookeeper server host (e.g. zookeeper/_HOST)
+func WithKerberos(client *krbClient.Client, servicePrincipal string) ZKClientOption {
+	return withSasl(func(host string) saslMechanism {
+		return &gssapiMechanism{
+			serviceTicket: client.GetServiceTicket,
+			client:        client,
+			spn:           strings.Replace(servicePrincipal, "_HOST", strings.ToLower(host), -1),
+		}
+	})
+}
+
+func withSasl(newMechanism func(host string) saslMechanism) ZKClientOption {
+	return func(client *ZKClient) {
+		client.newMechanism = newMechanism
+	}
+}
+
+// dialSasl connects to a zookeeper server, the connection runs the sasl exchange once the session is
+// established and before go-zookeeper sends requests on it; go-zookeeper dials again on reconnect,
+// so that every connection is authenticated
+func (client *ZKClient) dialSasl(network string, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return &saslConn{Conn: conn, mechanism: client.newMechanism(host), result: client.saslResult}, nil
+}
+
+// saslConn holds back the connect response of zookeeper until the sasl exchange is over, go-zookeeper reads it
+// only then; result is told how the first exchange ends
+type saslConn struct {
+	net.Conn
+	mechanism saslMechanism
+	result    chan error
+	exchanged bool
+	broken    bool
+	pending   []byte
+}
+
+func (conn *saslConn) Read(b []byte) (int, error) {
+	if !conn.exchanged {
+		conn.exchanged = true
+		frame, err := readFrame(conn.Conn)
+		if err != nil {
+			return 0, err
+		}
+		conn.pending = frame
+		// a session id of 0 means the session expired, go-zookeeper closes it and starts another one
+		if len(frame) >= 20 && binary.BigEndian.Uint64(frame[12:20]) != 0 {
+			err := conn.authenticate()
+			select {
+			case conn.result <- err:
+			default:
+			}
+			// zookeeper answers requests in order, the stream is lost if it broke in the middle of the exchange
+			if conn.broken {
+				return 0, err
+			}
+		}
+	}
+	if len(conn.pending) > 0 {
+		n := copy(b, conn.pending)
+		conn.pending = conn.pending[n:]
+		return n, nil
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *saslConn) authenticate() error {
+	conn.SetDeadline(time.Now().Add(AuthTimeout))
+	defer conn.SetDeadline(time.Time{})
+	token, err := conn.mechanism.start()
+	if err != nil {
+		return err
+	}
+	for {
+		challenge, err := conn.exchange(token)
+		if err != nil || conn.mechanism.complete() {
+			return err
+		}
+		if token, err = conn.mechanism.step(challenge); err != nil {
+			return err
+		}
+	}
+}
+
+// exchange sends token and returns the token zookeeper answers, zk.ErrAuthFailed if zookeeper refuses it
+func (conn *saslConn) exchange(token []byte) ([]byte, error) {
+	request := make([]byte, 16+len(token))
+	binary.BigEndian.PutUint32(request[0:4], uint32(12+len(token)))
+	binary.BigEndian.PutUint32(request[4:8], saslXid)
+	binary.BigEndian.PutUint32(request[8:12], opSasl)
+	binary.BigEndian.PutUint32(request[12:16], uint32(len(token)))
+	copy(request[16:], token)
+	if _, err := conn.Conn.Write(request); err != nil {
+		conn.broken = true
+		return nil, err
+	}
+
+	// reply header is xid, zxid and error code, followed by the token if no error
+	reply, err := readFrame(conn.Conn)
+	if err != nil {
+		conn.broken = true
+		return nil, err
+	}
+	reply = reply[4:]
+	if len(reply) < 16 {
+		conn.broken = true
+		return nil, fmt.Errorf("zookeeper answers sasl with a short reply of %d bytes", len(reply))
+	}
+	if code := int32(binary.BigEndian.Uint32(reply[12:16])); code != 0 {
+		if code == errAuthFailed {
+			return nil, zk.ErrAuthFailed
+		}
+		return nil, fmt.Errorf("zookeeper answers sasl with error code %d", code)
+	}
+	if len(reply) < 20 {
+		return nil, nil
+	}
+	size := int32(binary.BigEndian.Uint32(reply[16:20]))
+	if size <= 0 {
+		return nil, nil
+	}
+	if int(size) > len(reply)-20 {
+		conn.broken = true
+		return nil, fmt.Errorf("zookeeper answers a sasl token of %d bytes in %d", size, len(reply)-20)
+	}
+	return reply[20 : 20+size], nil
+}
+
+// readFrame reads a length prefixed frame, prefix included
+func readFrame(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(prefix)
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("zookeeper sends a frame of %d bytes", size)
+	}
+	frame := make([]byte, 4+size)
+	copy(frame, prefix)
+	if _, err := io.ReadFull(r, frame[4:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// gssapiMechanism is sasl GSSAPI with kerberos (RFC 4752): the AP-REQ is sent, the AP-REP of the mutual
+// authentication is checked, and the security layers zookeeper offers are answered with none
+type gssapiMechanism struct {
+	serviceTicket func(spn string) (messages.Ticket, types.EncryptionKey, error)
+	client        *krbClient.Client
+	spn           string
+
+	authenticator  types.Authenticator
+	sessionKey     types.EncryptionKey
+	key            types.EncryptionKey `description:"key of wrap tokens, the acceptor subkey if any"`
+	acceptorSubkey bool
+	state          int
+}
+
+const (
+	gssapiStateApRep = iota
+	gssapiStateLayers
+	gssapiStateComplete
+)
+
+func (m *gssapiMechanism) start() ([]byte, error) {
+	ticket, sessionKey, err := m.serviceTicket(m.spn)
+	if err != nil {
+		return nil, fmt.Errorf("get kerberos ticket of %s: %s", m.spn, err.Error())
+	}
+	// wrap tokens of RFC 4121 are what zookeeper signs security layers with, older enctypes sign otherwise
+	switch sessionKey.KeyType {
+	case etypeID.AES128_CTS_HMAC_SHA1_96, etypeID.AES256_CTS_HMAC_SHA1_96,
+		etypeID.AES128_CTS_HMAC_SHA256_128, etypeID.AES256_CTS_HMAC_SHA384_192:
+	default:
+		return nil, fmt.Errorf("kerberos ticket of %s has enctype %d, zookeeper sasl needs an aes one", m.spn, sessionKey.KeyType)
+	}
+	token, err := spnego.NewKRB5TokenAPREQ(m.client, ticket, sessionKey,
+		[]int{gssapi.ContextFlagMutual, gssapi.ContextFlagInteg}, []int{flags.APOptionMutualRequired})
+	if err != nil {
+		return nil, err
+	}
+	// the authenticator tells the sequence number and time the AP-REP is checked against
+	if err := token.APReq.DecryptAuthenticator(sessionKey); err != nil {
+		return nil, err
+	}
+	m.authenticator = token.APReq.Authenticator
+	m.sessionKey = sessionKey
+	m.key = sessionKey
+	return token.Marshal()
+}
+
+func (m *gssapiMechanism) step(challenge []byte) ([]byte, error) {
+	switch m.state {
+	case gssapiStateApRep:
+		if err := m.verifyApRep(challenge); err != nil {
+			return nil, err
+		}
+		m.state = gssapiStateLayers
+		return []byte{}, nil
+	case gssapiStateLayers:
+		layers, err := m.unwrap(challenge)
+		if err != nil {
+			return nil, err
+		}
+		if len(layers) != 4 || layers[0]&saslNoSecurityLayer == 0 {
+			return nil, fmt.Errorf("zookeeper %s requires a sasl security layer, which is not supported", m.spn)
+		}
+		m.state = gssapiStateComplete
+		return m.wrap([]byte{saslNoSecurityLayer, 0, 0, 0})
+	}
+	return nil, fmt.Errorf("sasl exchange with %s is complete", m.spn)
+}
+
+func (m *gssapiMechanism) complete() bool {
+	return m.state == gssapiStateComplete
+}
+
+// verifyApRep checks zookeeper has decrypted the authenticator, and takes the acceptor subkey if any
+func (m *gssapiMechanism) verifyApRep(challenge []byte) error {
+	token := spnego.KRB5Token{}
+	if err := token.Unmarshal(challenge); err != nil {
+		return fmt.Errorf("invalid sasl token of %s: %s", m.spn, err.Error())
+	}
+	if token.IsKRBError() {
+		return fmt.Errorf("zookeeper %s refuses the kerberos ticket: %s", m.spn, token.KRBError.Error())
+	}
+	if !token.IsAPRep() {
+		return fmt.Errorf("zookeeper %s answers no AP-REP to mutual authentication", m.spn)
+	}
+	data, err := crypto.DecryptEncPart(token.APRep.EncPart, m.sessionKey, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return fmt.Errorf("decrypt AP-REP of %s: %s", m.spn, err.Error())
+	}
+	part := messages.EncAPRepPart{}
+	if err := part.Unmarshal(data); err != nil {
+		return err
+	}
+	if part.CTime.Unix() != m.authenticator.CTime.Unix() || part.Cusec != m.authenticator.Cusec {
+		return fmt.Errorf("AP-REP of %s does not answer the authenticator sent", m.spn)
+	}
+	if len(part.Subkey.KeyValue) > 0 {
+		m.key = part.Subkey
+		m.acceptorSubkey = true
+	}
+	return nil
+}
+
+// unwrap checks a wrap token of zookeeper, which signs security layers without sealing them
+func (m *gssapiMechanism) unwrap(challenge []byte) ([]byte, error) {
+	if len(challenge) < gssapi.HdrLen {
+		return nil, fmt.Errorf("sasl wrap token of %s is too short", m.spn)
+	}
+	// the checksum may be rotated in front of the payload
+	token := append([]byte{}, challenge[:gssapi.HdrLen]...)
+	body := challenge[gssapi.HdrLen:]
+	if rrc := int(binary.BigEndian.Uint16(challenge[6:8])); rrc > 0 && len(body) > 0 {
+		rrc %= len(body)
+		body = append(append([]byte{}, body[rrc:]...), body[:rrc]...)
+		binary.BigEndian.PutUint16(token[6:8], 0)
+	}
+	wrapToken := gssapi.WrapToken{}
+	if err := wrapToken.Unmarshal(append(token, body...), true); err != nil {
+		return nil, fmt.Errorf("invalid sasl wrap token of %s: %s", m.spn, err.Error())
+	}
+	if wrapToken.Flags&0x02 != 0 {
+		return nil, fmt.Errorf("sasl wrap token of %s is sealed, which is not supported", m.spn)
+	}
+	if ok, err := wrapToken.Verify(m.key, keyusage.GSSAPI_ACCEPTOR_SEAL); !ok {
+		return nil, fmt.Errorf("sasl wrap token of %s: %s", m.spn, err.Error())
+	}
+	return wrapToken.Payload, nil
+}
+
+func (m *gssapiMechanism) wrap(payload []byte) ([]byte, error) {
+	encType, err := crypto.GetEtype(m.key.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	wrapToken := gssapi.WrapToken{
+		EC:        uint16(encType.GetHMACBitLength() / 8),
+		SndSeqNum: uint64(m.authenticator.SeqNumber),
+		Payload:   payload,
+	}
+	if m.acceptorSubkey {
+		wrapToken.Flags = 0x04
+	}
+	if err := wrapToken.SetCheckSum(m.key, keyusage.GSSAPI_INITIATOR_SEAL); err != nil {
+		return nil, err
+	}
+	return wrapToken.Marshal()
+}
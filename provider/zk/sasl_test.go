@@ -0,0 +1,173 @@
+package zk
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	krbClient "github.com/jcmturner/gokrb5/v8/client"
+	krbConfig "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+)
+
+// encAPRepPart is messages.EncAPRepPart as the acceptor marshals it
+type encAPRepPart struct {
+	CTime  time.Time           `asn1:"generalized,explicit,tag:0"`
+	Cusec  int                 `asn1:"explicit,tag:1"`
+	Subkey types.EncryptionKey `asn1:"optional,explicit,tag:2"`
+}
+
+// saslZkServer establishes sessions and plays the GSSAPI acceptor with sessionKey, as zookeeper/<host> does
+// knowing the key of its ticket; it answers AP-REQs with refused if set, and tells on done whether the
+// security layer answered is signed with the acceptor subkey
+func saslZkServer(t *testing.T, listener net.Listener, sessionKey types.EncryptionKey, refused bool, done chan<- bool) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reply := func(code int32, token []byte) {
+		frame := make([]byte, 20, 24+len(token))
+		binary.BigEndian.PutUint32(frame[4:8], saslXid)
+		binary.BigEndian.PutUint32(frame[16:20], uint32(code))
+		if code == 0 {
+			size := make([]byte, 4)
+			binary.BigEndian.PutUint32(size, uint32(len(token)))
+			frame = append(append(frame, size...), token...)
+		}
+		binary.BigEndian.PutUint32(frame[0:4], uint32(len(frame)-4))
+		conn.Write(frame)
+	}
+	readToken := func() []byte {
+		frame, err := readFrame(conn)
+		if err != nil || binary.BigEndian.Uint32(frame[8:12]) != opSasl {
+			done <- false
+			return nil
+		}
+		return frame[16:]
+	}
+
+	// connect request and response, with session id 1
+	if _, err := readFrame(conn); err != nil {
+		return
+	}
+	response := make([]byte, 40)
+	binary.BigEndian.PutUint32(response[0:4], 36)
+	binary.BigEndian.PutUint32(response[8:12], 4000)
+	binary.BigEndian.PutUint64(response[12:20], 1)
+	binary.BigEndian.PutUint32(response[20:24], 16)
+	conn.Write(response)
+
+	token := spnego.KRB5Token{}
+	if err := token.Unmarshal(readToken()); err != nil || !token.IsAPReq() {
+		done <- false
+		return
+	}
+	if refused {
+		reply(errAuthFailed, nil)
+		done <- true
+		return
+	}
+	if err := token.APReq.DecryptAuthenticator(sessionKey); err != nil {
+		done <- false
+		return
+	}
+	authenticator := token.APReq.Authenticator
+	subkey := types.EncryptionKey{KeyType: etypeID.AES256_CTS_HMAC_SHA1_96, KeyValue: make([]byte, 32)}
+	rand.Read(subkey.KeyValue)
+	part, _ := asn1.Marshal(encAPRepPart{CTime: authenticator.CTime, Cusec: authenticator.Cusec, Subkey: subkey})
+	encPart, _ := crypto.GetEncryptedData(asn1tools.AddASNAppTag(part, asnAppTag.EncAPRepPart), sessionKey, keyusage.AP_REP_ENCPART, 0)
+	apRep, _ := asn1.Marshal(messages.APRep{PVNO: 5, MsgType: msgtype.KRB_AP_REP, EncPart: encPart})
+	gssToken, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	gssToken = append(append(gssToken, 0x02, 0x00), asn1tools.AddASNAppTag(apRep, asnAppTag.APREP)...)
+	reply(0, asn1tools.AddASNAppTag(gssToken, 0))
+
+	// security layers offered: none, integrity and confidentiality, signed with the acceptor subkey
+	if len(readToken()) != 0 {
+		done <- false
+		return
+	}
+	layers := gssapi.WrapToken{Flags: 0x01 | 0x04, EC: 12, Payload: []byte{0x07, 0x00, 0x10, 0x00}}
+	layers.SetCheckSum(subkey, keyusage.GSSAPI_ACCEPTOR_SEAL)
+	layersToken, _ := layers.Marshal()
+	reply(0, layersToken)
+
+	answer := gssapi.WrapToken{}
+	if err := answer.Unmarshal(readToken(), false); err != nil {
+		done <- false
+		return
+	}
+	verified, _ := answer.Verify(subkey, keyusage.GSSAPI_INITIATOR_SEAL)
+	reply(0, nil)
+	done <- verified && answer.Payload[0] == saslNoSecurityLayer
+	// go-zookeeper goes on with the session
+	for {
+		if _, err := readFrame(conn); err != nil {
+			return
+		}
+	}
+}
+
+func TestSaslKerberos(t *testing.T) {
+	sessionKey := types.EncryptionKey{KeyType: etypeID.AES256_CTS_HMAC_SHA1_96, KeyValue: make([]byte, 32)}
+	rand.Read(sessionKey.KeyValue)
+	client := krbClient.NewWithPassword("acproxy", "EXAMPLE.COM", "secret", krbConfig.New())
+	var spns []string
+	mechanism := withSasl(func(host string) saslMechanism {
+		return &gssapiMechanism{
+			serviceTicket: func(spn string) (messages.Ticket, types.EncryptionKey, error) {
+				spns = append(spns, spn)
+				// the part only zookeeper decrypts is not looked at by the acceptor of the test
+				return messages.Ticket{
+					TktVNO:  5,
+					Realm:   "EXAMPLE.COM",
+					SName:   types.NewPrincipalName(nametype.KRB_NT_SRV_INST, spn),
+					EncPart: types.EncryptedData{EType: etypeID.AES256_CTS_HMAC_SHA1_96, KVNO: 1, Cipher: []byte("ticket")},
+				}, sessionKey, nil
+			},
+			client: client,
+			spn:    "zookeeper/" + host,
+		}
+	})
+
+	for _, refused := range []bool{false, true} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("TestSaslKerberos:", err.Error())
+		}
+		done := make(chan bool, 1)
+		go saslZkServer(t, listener, sessionKey, refused, done)
+
+		zkClient, err := NewZKClient([]string{listener.Addr().String()}, 1, mechanism)
+		if refused {
+			// refused credentials are told apart from unreachable zookeeper
+			assert.Equal(t, zk.ErrAuthFailed, err)
+			assert.True(t, IsAuthError(err))
+		} else if assert.Nil(t, err) {
+			zkClient.conn.Close()
+		}
+		select {
+		case verified := <-done:
+			assert.True(t, verified, "refused=%v", refused)
+		case <-time.After(5 * time.Second):
+			t.Fatal("TestSaslKerberos: sasl exchange is not over")
+		}
+		listener.Close()
+	}
+	assert.Equal(t, "zookeeper/127.0.0.1", spns[0])
+}
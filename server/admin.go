@@ -0,0 +1,270 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sort"
+
+	. "active-proxy/provider"
+	"active-proxy/util"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// AdminPathPrefix is reserved for the management api, it is never proxied
+	AdminPathPrefix = "/_acproxy/"
+	// AdminApiPrefix is the current version of the management api, served by the admin listener
+	AdminApiPrefix = AdminPathPrefix + "v1"
+)
+
+// shownConfKeys are provider keys the config dump shows; values of other keys are hidden, those holding or
+// locating credentials (zookeeper auth and acl, kerberos principal and keytab, tls key) and keys the proxy
+// does not know alike
+var shownConfKeys = map[string]bool{
+	HADetectionConfKey:                true,
+	ZkServersConfKey:                  true,
+	ZkLockPathConfKey:                 true,
+	ZkSaslConfKey:                     true,
+	ZkSaslSpnConfKey:                  true,
+	NamenodeHttpAddressesConfKey:      true,
+	WebHdfsPortConfKey:                true,
+	MaxConnectionsConfKey:             true,
+	RequestTimeoutConfKey:             true,
+	ProbeIntervalConfKey:              true,
+	ProbeTimeoutConfKey:               true,
+	MonitorStaleTimeoutConfKey:        true,
+	EventHistorySizeConfKey:           true,
+	NameservicesConfKey:               true,
+	DefaultNameserviceConfKey:         true,
+	MountTableConfKey:                 true,
+	MountTableFileConfKey:             true,
+	MountTableNameConfKey:             true,
+	HadoopConfDirConfKey:              true,
+	DatanodeGatewayConfKey:            true,
+	DatanodeTimeoutConfKey:            true,
+	ObserverReadsConfKey:              true,
+	StandbyReadsConfKey:               true,
+	ObserverReadOpsConfKey:            true,
+	ReadAfterWriteWindowConfKey:       true,
+	UpstreamTLSConfKey:                true,
+	UpstreamTLSCAFileConfKey:          true,
+	UpstreamTLSCertFileConfKey:        true,
+	UpstreamTLSServerNameConfKey:      true,
+	KerberosKrb5ConfConfKey:           true,
+	KerberosSpnConfKey:                true,
+	KerberosDoasConfKey:               true,
+	KerberosAnonymousUserConfKey:      true,
+	DelegationTokensConfKey:           true,
+	DelegationTokenRenewerConfKey:     true,
+	DelegationTokenIdleTimeoutConfKey: true,
+	YarnZkServersConfKey:              true,
+	YarnZkParentPathConfKey:           true,
+	YarnClusterIdConfKey:              true,
+	YarnRMWebappAddressesConfKey:      true,
+	YarnMaxConnectionsConfKey:         true,
+	YarnRequestTimeoutConfKey:         true,
+}
+
+// adminRouter serves the management api: states, statistics, metrics and health as the proxy listener does,
+// and read-only switch, log verbosity, config dump and pprof for PROXY_ADMIN_USERS only, or for anyone on a loopback
+// address without authentication
+func (server *ProxyServer) adminRouter() *mux.Router {
+	router := mux.NewRouter()
+	api := router.PathPrefix(AdminApiPrefix).Subrouter()
+	api.Path("/states").HandlerFunc(server.StatesHandler)
+	api.Path("/states/history").HandlerFunc(server.StatesHistoryHandler)
+	api.Path("/states/stream").HandlerFunc(server.StatesStreamHandler)
+	api.Path("/statistics").HandlerFunc(server.StatisticsHandler)
+	api.Path("/statistics/summary").HandlerFunc(server.StatisticsSummaryHandler)
+	api.Path("/statistics/timeseries").HandlerFunc(server.StatisticsTimeseriesHandler)
+	api.Path("/metrics").HandlerFunc(server.MetricsHandler)
+	api.Path("/healthz").HandlerFunc(server.HealthzHandler)
+	api.Path("/readyz").HandlerFunc(server.ReadyzHandler)
+	if !server.adminGuarded() {
+		glog.Warningf("readonly, log/verbosity, config and debug/pprof are not served on %s, "+
+			"they need authentication on or a loopback admin address", server.proxyConf.AdminAddress)
+		return router
+	}
+	if server.readOnlyMiddleware != nil {
+		api.Path("/readonly").Handler(server.adminChain(server.readOnlyMiddleware.AdminHandler))
+	}
+	api.Path("/log/verbosity").Handler(server.adminChain(server.VerbosityHandler))
+	api.Path("/config").Handler(server.adminChain(server.ConfigHandler))
+
+	// pprof tells profiles by paths under /debug/pprof/
+	profiles := http.NewServeMux()
+	profiles.HandleFunc("/debug/pprof/", pprof.Index)
+	profiles.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	profiles.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	profiles.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	profiles.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	api.PathPrefix("/debug/pprof/").Handler(server.adminChain(http.StripPrefix(AdminApiPrefix, profiles).ServeHTTP))
+	return router
+}
+
+// adminGuarded tells whether admin endpoints are kept from strangers: by PROXY_ADMIN_USERS with authentication on,
+// or by an admin listener reachable from the host only without it
+func (server *ProxyServer) adminGuarded() bool {
+	if server.authMiddleware != nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(server.proxyConf.AdminAddress)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// serveAdmin serves the management api on PROXY_ADMIN_ADDRESS, with the tls settings of the proxy listener if any
+func (server *ProxyServer) serveAdmin() {
+	httpServer := &http.Server{Addr: server.proxyConf.AdminAddress, Handler: server.adminRouter()}
+	var err error
+	if server.serverTLS == nil {
+		err = httpServer.ListenAndServe()
+	} else {
+		httpServer.TLSConfig = server.serverTLS.Config()
+		err = httpServer.ListenAndServeTLS("", "")
+	}
+	glog.Errorf("Serve admin api on %s fails: %s", server.proxyConf.AdminAddress, err.Error())
+}
+
+// Verbosity is the glog verbosity, v for all files and vmodule for some of them (e.g. "hdfs*=4")
+type Verbosity struct {
+	V       *int    `json:"v,omitempty"`
+	Vmodule *string `json:"vmodule,omitempty"`
+}
+
+// VerbosityHandler shows glog verbosity on GET, and changes what the json body gives on PUT
+func (server *ProxyServer) VerbosityHandler(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		verbosity := Verbosity{}
+		if err := json.NewDecoder(r.Body).Decode(&verbosity); err != nil {
+			http.Error(rw, fmt.Sprintf("invalid verbosity: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		if verbosity.V != nil {
+			if err := flag.Set("v", fmt.Sprint(*verbosity.V)); err != nil {
+				http.Error(rw, fmt.Sprintf("invalid v: %s", err.Error()), http.StatusBadRequest)
+				return
+			}
+		}
+		if verbosity.Vmodule != nil {
+			if err := flag.Set("vmodule", *verbosity.Vmodule); err != nil {
+				http.Error(rw, fmt.Sprintf("invalid vmodule: %s", err.Error()), http.StatusBadRequest)
+				return
+			}
+		}
+		glog.Infof("Log verbosity is changed by %s: v=%s vmodule=%s", util.ClientAddress(r),
+			flag.Lookup("v").Value.String(), flag.Lookup("vmodule").Value.String())
+	default:
+		rw.Header().Set("Allow", "GET, PUT")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(rw, `{"v":%s,"vmodule":%q}`, flag.Lookup("v").Value.String(), flag.Lookup("vmodule").Value.String())
+}
+
+// ConfigHandler dumps the configuration in effect, credentials and where they are kept redacted
+func (server *ProxyServer) ConfigHandler(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(server.redactedConf())
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("dump config: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	rw.Write(data)
+}
+
+// redactedConf is proxyConf with static tokens, tls key, htpasswd, spnego keytab and principal and provider keys
+// other than shownConfKeys hidden, and provider keys overridden by environment variables as the provider reads them
+func (server *ProxyServer) redactedConf() ProxyConf {
+	conf := server.proxyConf
+	for _, secret := range []*string{&conf.TLSKeyFile, &conf.Auth.HtpasswdFile, &conf.Auth.SpnegoKeytab, &conf.Auth.SpnegoPrincipal} {
+		if len(*secret) > 0 {
+			*secret = "***"
+		}
+	}
+	if len(conf.Auth.Tokens) > 0 {
+		// tokens are told apart by their users
+		users := make([]string, 0, len(conf.Auth.Tokens))
+		for _, user := range conf.Auth.Tokens {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		conf.Auth.Tokens = make(map[string]string, len(users))
+		for i, user := range users {
+			conf.Auth.Tokens[fmt.Sprintf("***%d", i+1)] = user
+		}
+	}
+	providerConf := make(map[string]interface{}, len(conf.ProxyProviderConf))
+	for key, value := range conf.ProxyProviderConf {
+		if envVal := os.Getenv(key); len(envVal) > 0 {
+			value = envVal
+		}
+		providerConf[key] = redactConfValue(key, value)
+	}
+	conf.ProxyProviderConf = providerConf
+	return conf
+}
+
+// redactConfValue hides the value unless key is one of shownConfKeys, keys of each nameservice in
+// HDFS_NAMESERVICES are redacted the same way; yaml maps are turned into json objects
+func redactConfValue(key string, value interface{}) interface{} {
+	if !shownConfKeys[key] {
+		return "***"
+	}
+	if key != NameservicesConfKey {
+		return jsonConfValue(value)
+	}
+	nameservices, ok := jsonConfValue(value).(map[string]interface{})
+	if !ok {
+		return "***"
+	}
+	for name, nsConf := range nameservices {
+		keys, ok := nsConf.(map[string]interface{})
+		if !ok {
+			nameservices[name] = "***"
+			continue
+		}
+		for k, item := range keys {
+			keys[k] = redactConfValue(k, item)
+		}
+	}
+	return nameservices
+}
+
+// jsonConfValue turns yaml maps, nested ones included, into json objects
+func jsonConfValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprint(k)] = jsonConfValue(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = jsonConfValue(item)
+		}
+		return m
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = jsonConfValue(item)
+		}
+		return items
+	}
+	return value
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"active-proxy/middleware"
+	. "active-proxy/provider"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminRouter(t *testing.T) {
+	conf := ProxyConf{
+		GlobalConf: GlobalConf{
+			Auth: middleware.AuthConf{
+				Backends: []string{"token"},
+				Tokens:   map[string]string{"3c8f0a6e2b": "etl", "a1b2c3d4e5": "ops"},
+			},
+			AdminUsers: []string{"ops"},
+		},
+		ProxyProviderType: "hdfs",
+		ProxyProviderConf: ProviderConf{
+			ZkServersConfKey: "zk1:2181",
+			ZkAuthConfKey:    "digest:acproxy:secret",
+			NameservicesConfKey: map[interface{}]interface{}{
+				"ns1": map[interface{}]interface{}{ZkAuthConfKey: "digest:acproxy:secret", ZkLockPathConfKey: "/lock"},
+			},
+		},
+	}
+	authMiddleware, err := middleware.NewAuthMiddleware(conf.Auth)
+	if err != nil {
+		t.Fatal("TestAdminRouter:", err.Error())
+	}
+	proxyServer := &ProxyServer{proxyConf: conf, provider: &statsProvider{}, authMiddleware: authMiddleware,
+		statisticsMiddleware: middleware.NewStatisticsMiddleware(10, 0)}
+	router := proxyServer.adminRouter()
+	serve := func(method string, target string, token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, r)
+		return rw
+	}
+
+	// states and statistics are open as on the proxy listener
+	assert.Equal(t, http.StatusOK, serve("GET", AdminApiPrefix+"/states", "", "").Code)
+	assert.Equal(t, http.StatusOK, serve("GET", AdminApiPrefix+"/statistics?status=5xx", "", "").Code)
+	assert.Equal(t, http.StatusOK, serve("GET", AdminApiPrefix+"/readyz", "", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve("GET", "/states", "", "").Code)
+
+	// the rest is for admin users only
+	assert.Equal(t, http.StatusUnauthorized, serve("GET", AdminApiPrefix+"/config", "", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve("GET", AdminApiPrefix+"/config", "3c8f0a6e2b", "").Code)
+	rw := serve("GET", AdminApiPrefix+"/config", "a1b2c3d4e5", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.NotContains(t, rw.Body.String(), "secret")
+	assert.NotContains(t, rw.Body.String(), "a1b2c3d4e5")
+	dump := ProxyConf{}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &dump))
+	assert.Equal(t, map[string]string{"***1": "etl", "***2": "ops"}, dump.Auth.Tokens)
+	assert.Equal(t, "zk1:2181", dump.ProxyProviderConf[ZkServersConfKey])
+	assert.Equal(t, "***", dump.ProxyProviderConf[ZkAuthConfKey])
+	assert.Equal(t, "/lock", dump.ProxyProviderConf.GetConf(NameservicesConfKey).GetConf("ns1")[ZkLockPathConfKey])
+	// the dump leaves the configuration in use alone
+	assert.Equal(t, "digest:acproxy:secret", conf.ProxyProviderConf[ZkAuthConfKey])
+	assert.Equal(t, "etl", proxyServer.proxyConf.Auth.Tokens["3c8f0a6e2b"])
+
+	v := flag.Lookup("v").Value.String()
+	defer flag.Set("v", v)
+	rw = serve("PUT", AdminApiPrefix+"/log/verbosity", "a1b2c3d4e5", `{"v": 4}`)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, `{"v":4,"vmodule":""}`, rw.Body.String())
+	assert.Equal(t, "4", flag.Lookup("v").Value.String())
+	assert.Equal(t, http.StatusBadRequest, serve("PUT", AdminApiPrefix+"/log/verbosity", "a1b2c3d4e5", `{"vmodule": "hdfs"}`).Code)
+
+	rw = serve("GET", AdminApiPrefix+"/debug/pprof/", "a1b2c3d4e5", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "goroutine")
+	rw = serve("GET", AdminApiPrefix+"/debug/pprof/goroutine?debug=1", "a1b2c3d4e5", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "goroutine profile")
+}
+
+func TestConfigRedacted(t *testing.T) {
+	conf := ProxyConf{
+		GlobalConf: GlobalConf{
+			TLSCertFile: "/etc/acproxy/server.pem",
+			TLSKeyFile:  "/etc/acproxy/secret-server-key.pem",
+			Auth: middleware.AuthConf{
+				Tokens:          map[string]string{"secret-token": "etl"},
+				HtpasswdFile:    "/etc/acproxy/secret.htpasswd",
+				SpnegoKeytab:    "/etc/security/keytabs/secret-http.keytab",
+				SpnegoPrincipal: "HTTP/secret.example.com@EXAMPLE.COM",
+			},
+		},
+		ProxyProviderType: "hdfs",
+		ProxyProviderConf: ProviderConf{
+			ZkServersConfKey:           "zk1:2181",
+			ZkAuthConfKey:              "digest:acproxy:secret",
+			ZkACLConfKey:               "digest:acproxy:secret-hash=:rwcda",
+			KerberosPrincipalConfKey:   "acproxy/secret.example.com@EXAMPLE.COM",
+			KerberosKeytabConfKey:      "/etc/security/keytabs/secret-acproxy.keytab",
+			UpstreamTLSKeyFileConfKey:  "/etc/acproxy/secret-client-key.pem",
+			UpstreamTLSCertFileConfKey: "/etc/acproxy/client.pem",
+			"HDFS_UNKNOWN_PASSWORD":    "secret",
+			NameservicesConfKey: map[interface{}]interface{}{
+				"ns1": map[interface{}]interface{}{
+					ZkLockPathConfKey:         "/lock",
+					ZkAuthConfKey:             "digest:acproxy:secret",
+					KerberosKeytabConfKey:     "/etc/security/keytabs/secret-ns1.keytab",
+					NameservicesConfKey:       "secret",
+					UpstreamTLSKeyFileConfKey: []interface{}{"secret"},
+				},
+			},
+			MountTableConfKey: map[interface{}]interface{}{"/user": "ns1"},
+		},
+	}
+	proxyServer := &ProxyServer{proxyConf: conf}
+	rw := httptest.NewRecorder()
+	proxyServer.ConfigHandler(rw, httptest.NewRequest("GET", AdminApiPrefix+"/config", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	// no value of the dump, however deep, tells a credential or where it is kept
+	var dump interface{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &dump); err != nil {
+		t.Fatal("TestConfigRedacted:", err.Error())
+	}
+	var walk func(path string, value interface{})
+	walk = func(path string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for k, item := range v {
+				assert.NotContains(t, k, "secret", path)
+				walk(path+"/"+k, item)
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(path+"/[]", item)
+			}
+		case string:
+			assert.NotContains(t, v, "secret", path)
+		}
+	}
+	walk("", dump)
+
+	// the rest is shown as configured
+	shown := ProxyConf{}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &shown))
+	assert.Equal(t, "/etc/acproxy/server.pem", shown.TLSCertFile)
+	assert.Equal(t, "***", shown.TLSKeyFile)
+	assert.Equal(t, "zk1:2181", shown.ProxyProviderConf[ZkServersConfKey])
+	assert.Equal(t, "/etc/acproxy/client.pem", shown.ProxyProviderConf[UpstreamTLSCertFileConfKey])
+	assert.Equal(t, "/lock", shown.ProxyProviderConf.GetConf(NameservicesConfKey).GetConf("ns1")[ZkLockPathConfKey])
+	assert.Equal(t, "ns1", shown.ProxyProviderConf.GetConf(MountTableConfKey)["/user"])
+}
+
+func TestAdminRouterWithoutAuth(t *testing.T) {
+	proxyServer := &ProxyServer{provider: &statsProvider{}, statisticsMiddleware: middleware.NewStatisticsMiddleware(10, 0)}
+	serve := func(address string, target string) int {
+		proxyServer.proxyConf.AdminAddress = address
+		rw := httptest.NewRecorder()
+		proxyServer.adminRouter().ServeHTTP(rw, httptest.NewRequest("GET", target, nil))
+		return rw.Code
+	}
+
+	// without authentication only those on the host may reach admin endpoints
+	for address, expected := range map[string]int{
+		"127.0.0.1:8081": http.StatusOK,
+		"[::1]:8081":     http.StatusOK,
+		"localhost:8081": http.StatusOK,
+		":8081":          http.StatusNotFound,
+		"0.0.0.0:8081":   http.StatusNotFound,
+		"10.0.0.8:8081":  http.StatusNotFound,
+	} {
+		assert.Equal(t, expected, serve(address, AdminApiPrefix+"/config"), address)
+		assert.Equal(t, expected, serve(address, AdminApiPrefix+"/debug/pprof/"), address)
+		assert.Equal(t, http.StatusOK, serve(address, AdminApiPrefix+"/states"), address)
+	}
+}
+
+func TestAdminPathReserved(t *testing.T) {
+	prepare()
+
+	// the management api is never proxied upstream
+	resp, err := http.Get("http://localhost:8080" + AdminApiPrefix + "/states")
+	if err != nil {
+		t.Fatal("TestAdminPathReserved:", err.Error())
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
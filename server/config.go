@@ -3,9 +3,11 @@ package server
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 
+	"active-proxy/middleware"
 	. "active-proxy/provider"
 
 	"gopkg.in/yaml.v2"
@@ -19,12 +21,42 @@ type ProxyConf struct {
 }
 
 type GlobalConf struct {
-	ProxyServerPort   string
-	RetryAttempts     int
-	RetryDelay        int
-	RecentRequestNums int
+	ProxyServerPort     string
+	RetryAttempts       int
+	RetryDelay          int
+	RecentRequestNums   int   `description:"recent requests returned by /statistics if no limit is given"`
+	RecentRequestMemory int64 `description:"bytes of recent request records kept for /statistics"`
+	BodyMemoryLimit     int64
+	BodySpoolLimit      int64
+	BodySpoolDir        string
+	ResponseHoldLimit   int
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSClientCAFile     string
+	TLSClientAuth       string
+	TLSReloadInterval   int
+	Auth                middleware.AuthConf
+	Authz               middleware.AuthzConf
+	Audit               middleware.AuditConf
+	ReadOnly            middleware.ReadOnlyConf
+	RateLimit           middleware.RateLimitConf
+	Quota               middleware.QuotaConf
+	AdminUsers          []string `description:"authenticated users allowed to admin endpoints, if authentication is on"`
+	AdminAddress        string   `description:"host:port of the admin listener serving the management api, none if empty"`
+	HideLegacyEndpoints bool     `description:"states, statistics, metrics and readonly are served by the admin listener only"`
 }
 
+const (
+	bodyMemoryLimitDefault   = 1 << 20
+	bodySpoolLimitDefault    = 256 << 20
+	responseHoldLimitDefault = 64 << 10
+	tlsReloadIntervalDefault = 10000
+	auditMaxSizeDefault      = 256 << 20
+	auditRotateDefault       = 24 * 3600 * 1000
+	auditMaxBackupsDefault   = 30
+	quotaRefreshDefault      = 300000
+)
+
 func NewProxyConf(providerType string, filePath string) (*ProxyConf, error) {
 	absFilePath, _ := filepath.Abs(filePath)
 	data, err := ioutil.ReadFile(absFilePath)
@@ -43,6 +75,51 @@ func NewProxyConf(providerType string, filePath string) (*ProxyConf, error) {
 	retryAttempts := globalConf.GetInt("PROXY_RETRY_ATTEMPTS")
 	retryDelay := globalConf.GetInt("PROXY_RETRY_DELAY")
 	recentRequestNums := globalConf.GetInt("PROXY_RECENT_REQUEST_NUMS")
+	bodyMemoryLimit := globalConf.GetIntOrDefault("PROXY_BODY_MEMORY_LIMIT", bodyMemoryLimitDefault)
+	bodySpoolLimit := globalConf.GetIntOrDefault("PROXY_BODY_SPOOL_LIMIT", bodySpoolLimitDefault)
+	bodySpoolDir := globalConf.GetStringOrDefault("PROXY_BODY_SPOOL_DIR", os.TempDir())
+	responseHoldLimit := globalConf.GetIntOrDefault("PROXY_RESPONSE_HOLD_LIMIT", responseHoldLimitDefault)
+	authConf := middleware.AuthConf{
+		Backends:           globalConf.GetStringSlice("PROXY_AUTH_BACKENDS"),
+		Tokens:             make(map[string]string),
+		HtpasswdFile:       globalConf.GetStringOrDefault("PROXY_AUTH_HTPASSWD_FILE", ""),
+		JwksFile:           globalConf.GetStringOrDefault("PROXY_AUTH_JWKS_FILE", ""),
+		JwtIssuer:          globalConf.GetStringOrDefault("PROXY_AUTH_JWT_ISSUER", ""),
+		JwtAudience:        globalConf.GetStringOrDefault("PROXY_AUTH_JWT_AUDIENCE", ""),
+		JwtUserClaim:       globalConf.GetStringOrDefault("PROXY_AUTH_JWT_USER_CLAIM", ""),
+		JwtGroupsClaim:     globalConf.GetStringOrDefault("PROXY_AUTH_JWT_GROUPS_CLAIM", ""),
+		SpnegoKeytab:       globalConf.GetStringOrDefault("PROXY_AUTH_SPNEGO_KEYTAB", ""),
+		SpnegoPrincipal:    globalConf.GetStringOrDefault("PROXY_AUTH_SPNEGO_PRINCIPAL", ""),
+		CertSubjectPattern: globalConf.GetStringOrDefault("PROXY_AUTH_CERT_SUBJECT_PATTERN", ""),
+		DoasUsers:          globalConf.GetStringSlice("PROXY_AUTH_DOAS_USERS"),
+	}
+	for token, user := range globalConf.GetConf("PROXY_AUTH_TOKENS") {
+		authConf.Tokens[token] = fmt.Sprint(user)
+	}
+	authzConf, err := convert2AuthzConf(globalConf)
+	if err != nil {
+		return nil, err
+	}
+	readOnlyConf, err := convert2ReadOnlyConf(globalConf)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitConf := middleware.RateLimitConf{}
+	if rules, ok := globalConf["PROXY_RATE_LIMITS"]; ok {
+		data, _ := yaml.Marshal(rules)
+		if err := yaml.Unmarshal(data, &rateLimitConf.Rules); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_RATE_LIMITS: %s", err.Error())
+		}
+	}
+	quotaConf, err := convert2QuotaConf(globalConf)
+	if err != nil {
+		return nil, err
+	}
+	adminAddress := globalConf.GetStringOrDefault("PROXY_ADMIN_ADDRESS", "")
+	hideLegacyEndpoints := globalConf.GetBoolOrDefault("PROXY_ADMIN_HIDE_LEGACY_ENDPOINTS", false)
+	if hideLegacyEndpoints && len(adminAddress) == 0 {
+		return nil, fmt.Errorf("PROXY_ADMIN_HIDE_LEGACY_ENDPOINTS requires PROXY_ADMIN_ADDRESS, or states and statistics are served nowhere")
+	}
 
 	var providerConf ProviderConf
 	if conf, ok := m[strings.ToUpper(providerType)]; ok {
@@ -53,10 +130,35 @@ func NewProxyConf(providerType string, filePath string) (*ProxyConf, error) {
 
 	return &ProxyConf{
 		GlobalConf: GlobalConf{
-			ProxyServerPort:   ":" + proxyPort,
-			RetryAttempts:     retryAttempts,
-			RetryDelay:        retryDelay,
-			RecentRequestNums: recentRequestNums,
+			ProxyServerPort:     ":" + proxyPort,
+			RetryAttempts:       retryAttempts,
+			RetryDelay:          retryDelay,
+			RecentRequestNums:   recentRequestNums,
+			RecentRequestMemory: int64(globalConf.GetIntOrDefault("PROXY_RECENT_REQUEST_MEMORY", middleware.RecentRequestMemoryDefault)),
+			BodyMemoryLimit:     int64(bodyMemoryLimit),
+			BodySpoolLimit:      int64(bodySpoolLimit),
+			BodySpoolDir:        bodySpoolDir,
+			ResponseHoldLimit:   responseHoldLimit,
+			TLSCertFile:         globalConf.GetStringOrDefault("PROXY_TLS_CERT_FILE", ""),
+			TLSKeyFile:          globalConf.GetStringOrDefault("PROXY_TLS_KEY_FILE", ""),
+			TLSClientCAFile:     globalConf.GetStringOrDefault("PROXY_TLS_CLIENT_CA_FILE", ""),
+			TLSClientAuth:       globalConf.GetStringOrDefault("PROXY_TLS_CLIENT_AUTH", ""),
+			TLSReloadInterval:   globalConf.GetIntOrDefault("PROXY_TLS_RELOAD_INTERVAL", tlsReloadIntervalDefault),
+			Auth:                authConf,
+			Authz:               *authzConf,
+			Audit: middleware.AuditConf{
+				Dir:            globalConf.GetStringOrDefault("PROXY_AUDIT_LOG_DIR", ""),
+				Format:         globalConf.GetStringOrDefault("PROXY_AUDIT_LOG_FORMAT", ""),
+				MaxSize:        int64(globalConf.GetIntOrDefault("PROXY_AUDIT_LOG_MAX_SIZE", auditMaxSizeDefault)),
+				RotateInterval: globalConf.GetIntOrDefault("PROXY_AUDIT_LOG_ROTATE_INTERVAL", auditRotateDefault),
+				MaxBackups:     globalConf.GetIntOrDefault("PROXY_AUDIT_LOG_MAX_BACKUPS", auditMaxBackupsDefault),
+			},
+			ReadOnly:            *readOnlyConf,
+			RateLimit:           rateLimitConf,
+			Quota:               *quotaConf,
+			AdminUsers:          globalConf.GetStringSlice("PROXY_ADMIN_USERS"),
+			AdminAddress:        adminAddress,
+			HideLegacyEndpoints: hideLegacyEndpoints,
 		},
 		ConfigFile:        absFilePath,
 		ProxyProviderType: providerType,
@@ -71,3 +173,55 @@ func convert2ProviderConf(m interface{}) ProviderConf {
 	}
 	return ProviderConf(conf)
 }
+
+// convert2AuthzConf reads PROXY_AUTHZ_RULES (list of rules) and PROXY_AUTHZ_GROUPS (group: [users])
+func convert2AuthzConf(globalConf ProviderConf) (*middleware.AuthzConf, error) {
+	authzConf := &middleware.AuthzConf{
+		Groups:        make(map[string][]string),
+		DefaultEffect: globalConf.GetStringOrDefault("PROXY_AUTHZ_DEFAULT_EFFECT", ""),
+	}
+	if rules, ok := globalConf["PROXY_AUTHZ_RULES"]; ok {
+		// rules are nested yaml, let yaml map them to their struct
+		data, _ := yaml.Marshal(rules)
+		if err := yaml.Unmarshal(data, &authzConf.Rules); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_AUTHZ_RULES: %s", err.Error())
+		}
+	}
+	groups := globalConf.GetConf("PROXY_AUTHZ_GROUPS")
+	for group := range groups {
+		authzConf.Groups[group] = groups.GetStringSlice(group)
+	}
+	return authzConf, nil
+}
+
+// convert2ReadOnlyConf reads PROXY_READ_ONLY* and PROXY_MAINTENANCE_WINDOWS (list of start, end, paths, reason)
+func convert2ReadOnlyConf(globalConf ProviderConf) (*middleware.ReadOnlyConf, error) {
+	readOnlyConf := &middleware.ReadOnlyConf{
+		Enabled: globalConf.GetBoolOrDefault("PROXY_READ_ONLY", false),
+		Paths:   globalConf.GetStringSlice("PROXY_READ_ONLY_PATHS"),
+		Reason:  globalConf.GetStringOrDefault("PROXY_READ_ONLY_REASON", ""),
+	}
+	if windows, ok := globalConf["PROXY_MAINTENANCE_WINDOWS"]; ok {
+		data, _ := yaml.Marshal(windows)
+		if err := yaml.Unmarshal(data, &readOnlyConf.Windows); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_MAINTENANCE_WINDOWS: %s", err.Error())
+		}
+	}
+	return readOnlyConf, nil
+}
+
+// convert2QuotaConf reads PROXY_MAX_UPLOAD_SIZE, PROXY_WRITE_QUOTAS (list of path, bytes) and PROXY_WRITE_QUOTA_*
+func convert2QuotaConf(globalConf ProviderConf) (*middleware.QuotaConf, error) {
+	quotaConf := &middleware.QuotaConf{
+		MaxUploadSize:   int64(globalConf.GetIntOrDefault("PROXY_MAX_UPLOAD_SIZE", 0)),
+		RefreshInterval: globalConf.GetIntOrDefault("PROXY_WRITE_QUOTA_REFRESH_INTERVAL", quotaRefreshDefault),
+		User:            globalConf.GetStringOrDefault("PROXY_WRITE_QUOTA_USER", ""),
+	}
+	if quotas, ok := globalConf["PROXY_WRITE_QUOTAS"]; ok {
+		data, _ := yaml.Marshal(quotas)
+		if err := yaml.Unmarshal(data, &quotaConf.Quotas); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_WRITE_QUOTAS: %s", err.Error())
+		}
+	}
+	return quotaConf, nil
+}
@@ -1,10 +1,16 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"active-proxy/middleware"
@@ -21,10 +27,19 @@ type ProxyServer struct {
 	provider             ProxyProvider
 	pool                 util.ProxyTaskPoolInterface
 	statisticsMiddleware *middleware.StatisticsMiddleware
+	authMiddleware       *middleware.AuthMiddleware
+	authzMiddleware      *middleware.AuthzMiddleware
+	auditMiddleware      *middleware.AuditMiddleware
+	readOnlyMiddleware   *middleware.ReadOnlyMiddleware
+	rateLimitMiddleware  *middleware.RateLimitMiddleware
+	metricsMiddleware    *middleware.MetricsMiddleware
+	quotaMiddleware      *middleware.QuotaMiddleware
+	serverTLS            *util.ServerTLS
 }
 
 func NewProxyServer(conf ProxyConf) (*ProxyServer, error) {
 	server := &ProxyServer{proxyConf: conf}
+	relaysDatanodes := false
 
 	switch conf.ProxyProviderType {
 	case "hdfs":
@@ -34,58 +49,285 @@ func NewProxyServer(conf ProxyConf) (*ProxyServer, error) {
 		}
 		server.provider = hdfsProvider
 		server.pool = hdfsProvider.Pool
+		relaysDatanodes = hdfsProvider.RelaysDatanodes()
+	case "yarn":
+		yarnProvider, err := NewYarnProxyProvider(conf.ProxyProviderConf)
+		if err != nil {
+			return nil, err
+		}
+		server.provider = yarnProvider
+		server.pool = yarnProvider.Pool
 	default:
 		return nil, fmt.Errorf("invalid proxy provider: %s", conf.ProxyProviderType)
 	}
 
-	server.statisticsMiddleware = middleware.NewStatisticsMiddleware(conf.RecentRequestNums)
+	server.statisticsMiddleware = middleware.NewStatisticsMiddleware(conf.RecentRequestNums, conf.RecentRequestMemory)
+	server.metricsMiddleware = middleware.NewMetricsMiddleware()
+	auditMiddleware, err := middleware.NewAuditMiddleware(conf.Audit)
+	if err != nil {
+		return nil, err
+	}
+	server.auditMiddleware = auditMiddleware
+	authMiddleware, err := middleware.NewAuthMiddleware(conf.Auth)
+	if err != nil {
+		return nil, err
+	}
+	server.authMiddleware = authMiddleware
+	authzMiddleware, err := middleware.NewAuthzMiddleware(conf.Authz)
+	if err != nil {
+		return nil, err
+	}
+	server.authzMiddleware = authzMiddleware
+	if server.readOnlyMiddleware, err = middleware.NewReadOnlyMiddleware(conf.ReadOnly); err != nil {
+		return nil, err
+	}
+	if server.rateLimitMiddleware, err = middleware.NewRateLimitMiddleware(conf.RateLimit, server.statisticsMiddleware.RecordThrottled); err != nil {
+		return nil, err
+	}
+	// webhdfs clients send data to the datanode the namenode redirects to, the proxy sees it only if it relays;
+	// checked before the quota middleware starts refreshing usage
+	if conf.Quota.Enabled() && !relaysDatanodes {
+		return nil, fmt.Errorf("PROXY_MAX_UPLOAD_SIZE and PROXY_WRITE_QUOTAS need the hdfs provider with %s on, "+
+			"uploads go to datanodes past the proxy otherwise", DatanodeGatewayConfKey)
+	}
+	// quota usage is refreshed from namenodes, yarn has no paths to limit
+	var contentLength func(string) (int64, error)
+	if conf.ProxyProviderType == "hdfs" {
+		contentLength = server.contentLength
+	}
+	if server.quotaMiddleware, err = middleware.NewQuotaMiddleware(conf.Quota, contentLength); err != nil {
+		return nil, err
+	}
+	if len(conf.TLSCertFile) > 0 || len(conf.TLSKeyFile) > 0 {
+		if server.serverTLS, err = util.NewServerTLS(conf.TLSCertFile, conf.TLSKeyFile, conf.TLSClientCAFile, conf.TLSClientAuth); err != nil {
+			return nil, fmt.Errorf("init tls listener: %s", err.Error())
+		}
+	}
 
 	return server, nil
 }
 
 func (server *ProxyServer) StartServer() {
+	if len(server.proxyConf.AdminAddress) > 0 {
+		go server.serveAdmin()
+	}
+
 	router := mux.NewRouter()
-	router.PathPrefix("/states").HandlerFunc(server.StatesHandler)
-	router.PathPrefix("/statistics").HandlerFunc(server.StatisticsHandler)
+	router.PathPrefix(AdminPathPrefix).HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Error(rw, "management api is served by the admin listener, see PROXY_ADMIN_ADDRESS", http.StatusNotFound)
+	})
+	router.Path("/healthz").HandlerFunc(server.HealthzHandler)
+	router.Path("/readyz").HandlerFunc(server.ReadyzHandler)
+	if !server.proxyConf.HideLegacyEndpoints {
+		server.legacyRoutes(router)
+	}
 
 	defaultRouter := mux.NewRouter()
 	defaultRouter.PathPrefix("/").HandlerFunc(server.DefaultHandler)
 
 	// specific middleware for default handler
-	router.PathPrefix("/").Handler(negroni.New(
-		server.statisticsMiddleware,
-		negroni.Wrap(defaultRouter),
-	))
+	proxyChain := negroni.New(server.statisticsMiddleware)
+	if server.metricsMiddleware != nil {
+		proxyChain.Use(server.metricsMiddleware)
+	}
+	// audit comes before authentication, so that refused requests are recorded
+	if server.auditMiddleware != nil {
+		proxyChain.Use(server.auditMiddleware)
+	}
+	if server.authMiddleware != nil {
+		proxyChain.Use(server.authMiddleware)
+	}
+	// limits apply to authenticated users, before anything costly is done
+	if server.rateLimitMiddleware != nil {
+		proxyChain.Use(server.rateLimitMiddleware)
+	}
+	if server.authzMiddleware != nil {
+		proxyChain.Use(server.authzMiddleware)
+	}
+	if server.readOnlyMiddleware != nil {
+		proxyChain.Use(server.readOnlyMiddleware)
+	}
+	if server.quotaMiddleware != nil {
+		proxyChain.Use(server.quotaMiddleware)
+	}
+	proxyChain.UseHandler(defaultRouter)
+	router.PathPrefix("/").Handler(proxyChain)
+
+	if server.serverTLS == nil {
+		http.ListenAndServe(server.proxyConf.ProxyServerPort, router)
+		return
+	}
+	go server.serverTLS.Watch(time.Millisecond * time.Duration(server.proxyConf.TLSReloadInterval))
+	httpServer := &http.Server{
+		Addr:      server.proxyConf.ProxyServerPort,
+		Handler:   router,
+		TLSConfig: server.serverTLS.Config(),
+	}
+	if err := httpServer.ListenAndServeTLS("", ""); err != nil {
+		glog.Errorf("Serve tls on %s fails: %s", server.proxyConf.ProxyServerPort, err.Error())
+	}
+}
+
+// legacyRoutes are endpoints kept on the proxy listener for compatibility, they are served under AdminApiPrefix as well.
+// the read-only switch needs authentication there, anyone reaching the proxy could turn it otherwise
+func (server *ProxyServer) legacyRoutes(router *mux.Router) {
+	router.Path("/states/history").HandlerFunc(server.StatesHistoryHandler)
+	router.Path("/states/stream").HandlerFunc(server.StatesStreamHandler)
+	router.PathPrefix("/states").HandlerFunc(server.StatesHandler)
+	router.Path("/statistics/summary").HandlerFunc(server.StatisticsSummaryHandler)
+	router.Path("/statistics/timeseries").HandlerFunc(server.StatisticsTimeseriesHandler)
+	router.PathPrefix("/statistics").HandlerFunc(server.StatisticsHandler)
+	router.Path("/metrics").HandlerFunc(server.MetricsHandler)
+	if server.readOnlyMiddleware == nil {
+		return
+	}
+	if server.authMiddleware == nil {
+		glog.Warningf("/readonly is not served on the proxy listener without authentication, " +
+			"read-only mode is switched on a loopback admin listener (PROXY_ADMIN_ADDRESS) only")
+		return
+	}
+	router.Path("/readonly").Handler(server.adminChain(server.readOnlyMiddleware.AdminHandler))
+}
 
-	http.ListenAndServe(server.proxyConf.ProxyServerPort, router)
+// adminChain lets only PROXY_ADMIN_USERS reach handler if authentication is on, anyone otherwise,
+// so handlers it leaves open are served by the admin listener only
+func (server *ProxyServer) adminChain(handler http.HandlerFunc) http.Handler {
+	if server.authMiddleware == nil {
+		return handler
+	}
+	admins := make(map[string]bool)
+	for _, user := range server.proxyConf.AdminUsers {
+		admins[user] = true
+	}
+	return negroni.New(server.authMiddleware, negroni.HandlerFunc(func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if principal := util.RequestPrincipal(r); principal == nil || !admins[principal.User] {
+			http.Error(rw, "admin endpoints are for PROXY_ADMIN_USERS only", http.StatusForbidden)
+			return
+		}
+		next(rw, r)
+	}), negroni.Wrap(handler))
 }
 
+// NotRetryableHeader explains why a failed request was not retried
+const NotRetryableHeader = "X-Acproxy-Not-Retryable"
+
 func (server *ProxyServer) DefaultHandler(rw http.ResponseWriter, r *http.Request) {
+	// every attempt sends the body from the beginning
+	var body *util.ReplayableBody
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = util.NewReplayableBody(r.Body, server.proxyConf.BodyMemoryLimit, server.proxyConf.BodySpoolLimit, server.proxyConf.BodySpoolDir)
+		if err != nil {
+			glog.V(1).Infof("Request %s fails to read body: %s", r.URL.String(), err.Error())
+			http.Error(rw, fmt.Sprintf("read request body: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		defer body.Close()
+	}
+
+	info := util.RequestInfoOf(r)
 	for i := 0; i < server.proxyConf.RetryAttempts; i++ {
-		statusCode := server.provider.Proxy(rw, r)
+		if info != nil {
+			info.Attempts++
+		}
+		attempt := r
+		if body != nil {
+			attempt = r.WithContext(r.Context())
+			attempt.Body = body.Reader()
+		}
+		attemptWriter := util.NewDeferredResponseWriter(rw, server.proxyConf.ResponseHoldLimit)
+		statusCode := server.provider.Proxy(attemptWriter, attempt)
 		if statusCode < 400 {
+			attemptWriter.Commit()
+			return
+		}
+		if attemptWriter.Abandon() {
+			glog.V(1).Infof("Request %s fails at %d/%d times after part of response is sent, give up", r.URL.String(), i+1, server.proxyConf.RetryAttempts)
 			return
 		}
 
 		var errorMsg string
+		retryable := true
 		switch statusCode {
 		case http.StatusServiceUnavailable:
 			errorMsg = fmt.Sprintf("%s proxy provider not in service temporarily", server.proxyConf.ProxyProviderType)
 		case http.StatusRequestTimeout:
 			errorMsg = fmt.Sprintf("request %s timeout", r.RequestURI)
+		default:
+			// refused by provider, retrying makes no difference
+			errorMsg = http.StatusText(statusCode)
+			retryable = false
+		}
+		if retryable && body != nil && !body.Replayable() {
+			rw.Header().Set(NotRetryableHeader, fmt.Sprintf("request body exceeds %d bytes which can be replayed", server.proxyConf.BodyMemoryLimit+server.proxyConf.BodySpoolLimit))
+			retryable = false
 		}
 
 		// bad request
-		if i == server.proxyConf.RetryAttempts-1 {
+		if !retryable || i == server.proxyConf.RetryAttempts-1 {
 			glog.V(1).Infof("Request %s still fails after retrying %d times: %s", r.URL.String(), i+1, errorMsg)
 			http.Error(rw, errorMsg, statusCode)
-		} else {
-			glog.V(3).Infof("Request %s fails at %d/%d times: %s", r.URL.String(), i+1, server.proxyConf.RetryAttempts, errorMsg)
-			time.Sleep(time.Millisecond * time.Duration(server.proxyConf.RetryDelay))
+			return
 		}
+		glog.V(3).Infof("Request %s fails at %d/%d times: %s", r.URL.String(), i+1, server.proxyConf.RetryAttempts, errorMsg)
+		time.Sleep(time.Millisecond * time.Duration(server.proxyConf.RetryDelay))
+	}
+}
+
+// contentLength asks the active namenode for the length of files under hdfsPath, through the proxy itself
+// so that mount tables, failover and upstream authentication apply
+func (server *ProxyServer) contentLength(hdfsPath string) (int64, error) {
+	query := url.Values{"op": []string{"GETCONTENTSUMMARY"}}
+	if user := server.proxyConf.Quota.User; len(user) > 0 {
+		query.Set("user.name", user)
+	}
+	target := &url.URL{Path: util.WebHdfsPathPrefix + hdfsPath, RawQuery: query.Encode()}
+	r, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	r.RequestURI = r.URL.RequestURI()
+	recorder := &bufferedResponseWriter{header: make(http.Header)}
+	server.DefaultHandler(recorder, r)
+	if recorder.statusCode != 0 && recorder.statusCode != http.StatusOK {
+		if exception := util.ParseRemoteException(recorder.body.Bytes()); exception != nil {
+			return 0, fmt.Errorf("%s: %s", exception.Exception, exception.Message)
+		}
+		return 0, fmt.Errorf("GETCONTENTSUMMARY of %s answers %d", hdfsPath, recorder.statusCode)
+	}
+	summary := &struct {
+		ContentSummary *struct {
+			Length int64 `json:"length"`
+		}
+	}{}
+	if err := json.Unmarshal(recorder.body.Bytes(), summary); err != nil || summary.ContentSummary == nil {
+		return 0, fmt.Errorf("invalid GETCONTENTSUMMARY of %s: %s", hdfsPath, recorder.body.String())
+	}
+	return summary.ContentSummary.Length, nil
+}
+
+// bufferedResponseWriter keeps the response of a request sent by the proxy itself
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
 	}
 }
 
+func (w *bufferedResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
 func convertResponseBody2String(response *http.Response) string {
 	if response.Body != nil {
 		body, _ := ioutil.ReadAll(response.Body)
@@ -98,6 +340,208 @@ func (server *ProxyServer) StatesHandler(rw http.ResponseWriter, r *http.Request
 	io.WriteString(rw, server.provider.GetStats().Json())
 }
 
+// HealthzHandler answers 200 while the proxy is alive, 503 with the reason once its provider cannot recover by itself
+func (server *ProxyServer) HealthzHandler(rw http.ResponseWriter, r *http.Request) {
+	var err error
+	if checker, ok := server.provider.(HealthChecker); ok {
+		err = checker.Healthy()
+	}
+	writeHealth(rw, "healthy", err)
+}
+
+// ReadyzHandler answers 200 only while requests may be sent to the proxy, 503 with the reason otherwise
+func (server *ProxyServer) ReadyzHandler(rw http.ResponseWriter, r *http.Request) {
+	var err error
+	if checker, ok := server.provider.(HealthChecker); ok {
+		err = checker.Ready()
+	} else if state := server.provider.GetStats().State; state != RUN.String() {
+		err = fmt.Errorf("provider is %s", state)
+	}
+	writeHealth(rw, "ready", err)
+}
+
+func writeHealth(rw http.ResponseWriter, check string, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		glog.V(2).Infof("Proxy is not %s: %s", check, err.Error())
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(rw, util.JsonMarshal(map[string]interface{}{check: false, "reason": err.Error()}))
+		return
+	}
+	io.WriteString(rw, util.JsonMarshal(map[string]interface{}{check: true}))
+}
+
+// StatesHistoryHandler serves recorded transitions of provider and nameservice states and active namenodes, oldest first
+func (server *ProxyServer) StatesHistoryHandler(rw http.ResponseWriter, r *http.Request) {
+	source, ok := server.provider.(EventSource)
+	if !ok {
+		http.Error(rw, fmt.Sprintf("%s proxy provider keeps no history", server.proxyConf.ProxyProviderType), http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	io.WriteString(rw, util.JsonMarshal(source.EventHistory()))
+}
+
+// StatesStreamHandler streams transitions as server-sent events, a client reconnecting with Last-Event-ID
+// gets the transitions it has missed from the history first
+func (server *ProxyServer) StatesStreamHandler(rw http.ResponseWriter, r *http.Request) {
+	source, ok := server.provider.(EventSource)
+	flusher, canFlush := rw.(http.Flusher)
+	if !ok || !canFlush {
+		http.Error(rw, fmt.Sprintf("%s proxy provider streams no transitions", server.proxyConf.ProxyProviderType), http.StatusNotFound)
+		return
+	}
+	history, events, cancel := source.SubscribeEvents()
+	defer cancel()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	if lastId, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		for _, event := range history {
+			if event.Id > lastId {
+				writeServerSentEvent(rw, event)
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			// a comment line, keeps idle connections from being closed by load balancers
+			io.WriteString(rw, ": keepalive\n\n")
+		case event, ok := <-events:
+			if !ok {
+				// fallen behind, the client reconnects with Last-Event-ID
+				return
+			}
+			writeServerSentEvent(rw, event)
+		}
+		flusher.Flush()
+	}
+}
+
+const eventStreamKeepalive = 15 * time.Second
+
+func writeServerSentEvent(w io.Writer, event ProviderEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Kind, util.JsonMarshal(event))
+}
+
+// StatisticsHandler serves totals and recent requests, filtered by the query, e.g.
+// ?status_class=5xx&method=PUT&path=/data&since=10m for 5xx PUTs under /data in the last 10 minutes
 func (server *ProxyServer) StatisticsHandler(rw http.ResponseWriter, r *http.Request) {
-	io.WriteString(rw, server.statisticsMiddleware.Json())
+	query, err := parseRequestsQuery(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	io.WriteString(rw, server.statisticsMiddleware.Json(query))
+}
+
+// parseRequestsQuery reads filters of /statistics, times are RFC 3339 or durations before now
+func parseRequestsQuery(values url.Values, now time.Time) (middleware.RequestsQuery, error) {
+	query := middleware.RequestsQuery{
+		Method:     strings.ToUpper(values.Get("method")),
+		Op:         strings.ToUpper(values.Get("op")),
+		PathPrefix: values.Get("path"),
+		ClientIp:   values.Get("client"),
+		User:       values.Get("user"),
+		RequestId:  values.Get("request_id"),
+	}
+	if status := strings.ToLower(values.Get("status")); strings.HasSuffix(status, "xx") {
+		query.StatusClass = status
+	} else if len(status) > 0 {
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return query, fmt.Errorf("status should be a status code or class like 5xx, got %s", status)
+		}
+		query.StatusCode = code
+	}
+	if len(query.PathPrefix) > 0 {
+		query.PathPrefix = path.Clean("/" + query.PathPrefix)
+	}
+	if minLatency := values.Get("min_latency"); len(minLatency) > 0 {
+		latency, err := time.ParseDuration(minLatency)
+		if err != nil {
+			return query, fmt.Errorf("min_latency should be a duration like 500ms, got %s", minLatency)
+		}
+		query.MinLatency = latency
+	}
+	for _, bound := range []struct {
+		name string
+		time *time.Time
+	}{{"since", &query.Since}, {"until", &query.Until}} {
+		value := values.Get(bound.name)
+		if len(value) == 0 {
+			continue
+		}
+		if ago, err := time.ParseDuration(value); err == nil {
+			*bound.time = now.Add(-ago)
+		} else if *bound.time, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("%s should be RFC 3339 or a duration like 10m, got %s", bound.name, value)
+		}
+	}
+	if offset := values.Get("offset"); len(offset) > 0 {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return query, fmt.Errorf("offset should be a non-negative number, got %s", offset)
+		}
+		query.Offset = n
+	}
+	if limit := values.Get("limit"); len(limit) > 0 {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > middleware.RecentRequestMaxLimit {
+			return query, fmt.Errorf("limit should be within 1 and %d", middleware.RecentRequestMaxLimit)
+		}
+		query.Limit = n
+	}
+	return query, nil
+}
+
+func (server *ProxyServer) StatisticsSummaryHandler(rw http.ResponseWriter, r *http.Request) {
+	io.WriteString(rw, server.statisticsMiddleware.Summary())
+}
+
+// StatisticsTimeseriesHandler serves a point per minute of requests of one op or status class (e.g. 5xx),
+// over the last minutes (60 if not given)
+func (server *ProxyServer) StatisticsTimeseriesHandler(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	op := strings.ToUpper(query.Get("op"))
+	statusClass := strings.ToLower(query.Get("status_class"))
+	if len(op) > 0 && len(statusClass) > 0 {
+		http.Error(rw, "either op or status_class may be given", http.StatusBadRequest)
+		return
+	}
+	span := middleware.TimeseriesMaxSpan
+	if minutes := query.Get("minutes"); len(minutes) > 0 {
+		n, err := strconv.Atoi(minutes)
+		if err != nil || n <= 0 || time.Duration(n)*time.Minute > middleware.TimeseriesMaxSpan {
+			http.Error(rw, fmt.Sprintf("minutes should be within 1 and %d", int(middleware.TimeseriesMaxSpan/time.Minute)), http.StatusBadRequest)
+			return
+		}
+		span = time.Duration(n) * time.Minute
+	}
+	io.WriteString(rw, server.statisticsMiddleware.Timeseries(op, statusClass, span))
+}
+
+// MetricsHandler serves requests, provider states and the task pool in prometheus format
+func (server *ProxyServer) MetricsHandler(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", util.MetricsContentType)
+	metrics := util.NewMetricsWriter(rw)
+	if server.metricsMiddleware != nil {
+		server.metricsMiddleware.WriteMetrics(metrics)
+	}
+	server.provider.GetStats().WriteMetrics(metrics)
+	if server.pool != nil {
+		stats := server.pool.Stats()
+		metrics.Header("acproxy_pool_queued_tasks", "gauge", "Upstream requests waiting for a connection slot.")
+		metrics.Sample("acproxy_pool_queued_tasks", float64(stats.Queued))
+		metrics.Header("acproxy_pool_inflight_tasks", "gauge", "Upstream requests being proxied.")
+		metrics.Sample("acproxy_pool_inflight_tasks", float64(stats.InFlight))
+	}
 }
@@ -1,16 +1,24 @@
 package server
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"runtime"
+	"strings"
 	"testing"
 
 	"active-proxy/middleware"
 	. "active-proxy/provider"
+	"active-proxy/util"
 
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
+	"gopkg.in/yaml.v2"
 )
 
 type mockHDFSProxyProvider struct {
@@ -42,7 +50,7 @@ func prepare() {
 		}
 		server = &ProxyServer{proxyConf: conf}
 		server.provider = &mockHDFSProxyProvider{}
-		server.statisticsMiddleware = middleware.NewStatisticsMiddleware(conf.RecentRequestNums)
+		server.statisticsMiddleware = middleware.NewStatisticsMiddleware(conf.RecentRequestNums, conf.RecentRequestMemory)
 		go server.StartServer()
 		runtime.Gosched()
 	}
@@ -110,6 +118,22 @@ func TestStatisticsHandler(t *testing.T) {
 	} else {
 		t.Error("TestStatisticsHandler:", "lack recent requests")
 	}
+
+	request, _ = http.NewRequest("GET", "http://localhost:8080/statistics?method=post&status=4xx&since=1m&limit=1", nil)
+	resp, _ = client.Do(request)
+	respData, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	statisticsMap = make(map[string]interface{})
+	json.Unmarshal(respData, &statisticsMap)
+	statsSlice := convert2RequestsRecords(statisticsMap["recentRequests"].([]interface{}))
+	assert.Equal(t, 1, len(statsSlice))
+	assert.Equal(t, "POST", statsSlice[0].Method)
+	assert.Equal(t, http.StatusMethodNotAllowed, statsSlice[0].StatusCode)
+
+	request, _ = http.NewRequest("GET", "http://localhost:8080/statistics?min_latency=fast", nil)
+	resp, _ = client.Do(request)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 }
 
 func convert2RequestsRecords(stats []interface{}) []middleware.RequestsRecord {
@@ -126,3 +150,410 @@ func convert2RequestsRecords(stats []interface{}) []middleware.RequestsRecord {
 	}
 	return statsSlice
 }
+
+// flakyProvider consumes the body and writes part of a response, then fails its first attempts
+type flakyProvider struct {
+	ProxyProvider
+	failures int
+	attempts int
+}
+
+func (provider *flakyProvider) Proxy(rw http.ResponseWriter, request *http.Request) int {
+	provider.attempts++
+	body, _ := ioutil.ReadAll(request.Body)
+	if provider.attempts <= provider.failures {
+		rw.WriteHeader(http.StatusBadGateway)
+		rw.Write([]byte("broken"))
+		return http.StatusServiceUnavailable
+	}
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write(body)
+	return http.StatusCreated
+}
+
+func TestDefaultHandlerReplaysBody(t *testing.T) {
+	conf := ProxyConf{
+		GlobalConf: GlobalConf{
+			RetryAttempts:     3,
+			BodyMemoryLimit:   4,
+			BodySpoolLimit:    8,
+			ResponseHoldLimit: 1024,
+		},
+	}
+
+	// body held in memory and spool
+	provider := &flakyProvider{failures: 2}
+	proxyServer := &ProxyServer{proxyConf: conf, provider: provider}
+	recorder := httptest.NewRecorder()
+	proxyServer.DefaultHandler(recorder, httptest.NewRequest("PUT", HdfsUrl+"/tmp/a?op=CREATE", strings.NewReader("0123456789")))
+	assert.Equal(t, 3, provider.attempts)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "0123456789", recorder.Body.String())
+
+	// body too large to replay
+	provider = &flakyProvider{failures: 2}
+	proxyServer = &ProxyServer{proxyConf: conf, provider: provider}
+	recorder = httptest.NewRecorder()
+	proxyServer.DefaultHandler(recorder, httptest.NewRequest("PUT", HdfsUrl+"/tmp/a?op=CREATE", strings.NewReader("0123456789abcdef")))
+	assert.Equal(t, 1, provider.attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.NotEmpty(t, recorder.Header().Get(NotRetryableHeader))
+	assert.NotContains(t, recorder.Body.String(), "broken")
+}
+
+func TestConvert2AuthzConf(t *testing.T) {
+	data := `
+PROXY_AUTHZ_DEFAULT_EFFECT: allow
+PROXY_AUTHZ_GROUPS:
+  admin: [root, hdfs]
+PROXY_AUTHZ_RULES:
+  - name: no-recursive-delete
+    effect: deny
+    paths: [/prod/**]
+    ops: [DELETE]
+    params:
+      recursive: true
+`
+	m := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal([]byte(data), &m); err != nil {
+		t.Fatal("TestConvert2AuthzConf:", err.Error())
+	}
+	authzConf, err := convert2AuthzConf(convert2ProviderConf(m))
+	if err != nil {
+		t.Fatal("TestConvert2AuthzConf:", err.Error())
+	}
+	assert.Equal(t, "allow", authzConf.DefaultEffect)
+	assert.Equal(t, map[string][]string{"admin": {"root", "hdfs"}}, authzConf.Groups)
+	assert.Equal(t, []middleware.AuthzRule{{
+		Name:   "no-recursive-delete",
+		Effect: "deny",
+		Paths:  []string{"/prod/**"},
+		Ops:    []string{"DELETE"},
+		Params: map[string]string{"recursive": "true"},
+	}}, authzConf.Rules)
+}
+
+func TestConvert2ReadOnlyConf(t *testing.T) {
+	data := `
+PROXY_READ_ONLY: true
+PROXY_READ_ONLY_PATHS: [/warehouse]
+PROXY_MAINTENANCE_WINDOWS:
+  - start: 2030-01-01T00:00:00Z
+    end: 2030-01-01T02:00:00Z
+    reason: upgrade
+`
+	m := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal([]byte(data), &m); err != nil {
+		t.Fatal("TestConvert2ReadOnlyConf:", err.Error())
+	}
+	readOnlyConf, err := convert2ReadOnlyConf(convert2ProviderConf(m))
+	if err != nil {
+		t.Fatal("TestConvert2ReadOnlyConf:", err.Error())
+	}
+	assert.True(t, readOnlyConf.Enabled)
+	assert.Equal(t, []string{"/warehouse"}, readOnlyConf.Paths)
+	assert.Equal(t, []middleware.MaintenanceWindow{{Start: "2030-01-01T00:00:00Z", End: "2030-01-01T02:00:00Z", Reason: "upgrade"}}, readOnlyConf.Windows)
+}
+
+func TestAdminChain(t *testing.T) {
+	authMiddleware, err := middleware.NewAuthMiddleware(middleware.AuthConf{
+		Backends: []string{middleware.AuthBackendToken},
+		Tokens:   map[string]string{"admin-token": "root", "user-token": "alice"},
+	})
+	if err != nil {
+		t.Fatal("TestAdminChain:", err.Error())
+	}
+	server := &ProxyServer{proxyConf: ProxyConf{GlobalConf: GlobalConf{AdminUsers: []string{"root"}}}, authMiddleware: authMiddleware}
+	handler := server.adminChain(func(rw http.ResponseWriter, r *http.Request) {})
+	for token, expected := range map[string]int{"admin-token": http.StatusOK, "user-token": http.StatusForbidden, "": http.StatusUnauthorized} {
+		r := httptest.NewRequest("GET", "/readonly", nil)
+		if len(token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		assert.Equal(t, expected, rw.Code, token)
+	}
+}
+
+// summaryProvider relays GETCONTENTSUMMARY of /sandbox, and FileNotFoundException of other paths
+type summaryProvider struct {
+	ProxyProvider
+	request *http.Request
+}
+
+func (provider *summaryProvider) Proxy(rw http.ResponseWriter, request *http.Request) int {
+	provider.request = request
+	if request.URL.Path != "/webhdfs/v1/sandbox" {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(`{"RemoteException":{"exception":"FileNotFoundException","javaClassName":"java.io.FileNotFoundException","message":"File does not exist"}}`))
+		return http.StatusOK
+	}
+	rw.Write([]byte(`{"ContentSummary":{"directoryCount":1,"fileCount":2,"length":1024,"spaceConsumed":3072}}`))
+	return http.StatusOK
+}
+
+func TestContentLength(t *testing.T) {
+	provider := &summaryProvider{}
+	proxyServer := &ProxyServer{provider: provider, proxyConf: ProxyConf{GlobalConf: GlobalConf{
+		RetryAttempts:     1,
+		ResponseHoldLimit: 1024,
+		Quota:             middleware.QuotaConf{User: "hdfs"},
+	}}}
+	length, err := proxyServer.contentLength("/sandbox")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), length)
+	assert.Equal(t, "GETCONTENTSUMMARY", provider.request.URL.Query().Get("op"))
+	assert.Equal(t, "hdfs", provider.request.URL.Query().Get("user.name"))
+
+	_, err = proxyServer.contentLength("/missing")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "FileNotFoundException")
+}
+
+func TestConvert2QuotaConf(t *testing.T) {
+	data := `
+PROXY_MAX_UPLOAD_SIZE: 1073741824
+PROXY_WRITE_QUOTAS:
+  - path: /sandbox
+    bytes: 10737418240
+`
+	m := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal([]byte(data), &m); err != nil {
+		t.Fatal("TestConvert2QuotaConf:", err.Error())
+	}
+	quotaConf, err := convert2QuotaConf(convert2ProviderConf(m))
+	if err != nil {
+		t.Fatal("TestConvert2QuotaConf:", err.Error())
+	}
+	assert.Equal(t, int64(1073741824), quotaConf.MaxUploadSize)
+	assert.Equal(t, quotaRefreshDefault, quotaConf.RefreshInterval)
+	assert.Equal(t, []middleware.PathQuota{{Path: "/sandbox", Bytes: 10737418240}}, quotaConf.Quotas)
+}
+
+// statsProvider reports a nameservice which has failed over once
+type statsProvider struct {
+	ProxyProvider
+}
+
+func (provider *statsProvider) GetStats() ProviderStats {
+	return ProviderStats{State: RUN.String(), Nameservices: []NameserviceStats{{
+		Name:           "ns1",
+		State:          RUN.String(),
+		ActiveNamenode: "nn2.example.com",
+		ActiveChanges:  1,
+		ZkSessionState: "HasSession",
+	}}}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	pool, _ := util.NewProxyTaskPool(4)
+	proxyServer := &ProxyServer{provider: &statsProvider{}, pool: pool, metricsMiddleware: middleware.NewMetricsMiddleware()}
+	rw := httptest.NewRecorder()
+	proxyServer.MetricsHandler(rw, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, util.MetricsContentType, rw.Header().Get("Content-Type"))
+	for _, line := range []string{
+		`acproxy_provider_state{state="running"} 1`,
+		`acproxy_provider_state{state="pending"} 0`,
+		`acproxy_nameservice_state{nameservice="ns1",state="running"} 1`,
+		`acproxy_active_namenode{nameservice="ns1",namenode="nn2.example.com"} 1`,
+		`acproxy_active_namenode_changes_total{nameservice="ns1"} 1`,
+		`acproxy_zk_session_state{nameservice="ns1",state="HasSession"} 1`,
+		"acproxy_pool_queued_tasks 0",
+		"acproxy_pool_inflight_tasks 0",
+	} {
+		assert.Contains(t, rw.Body.String(), line+"\n")
+	}
+}
+
+// eventsProvider has a history of two transitions, and streams what is sent to events
+type eventsProvider struct {
+	ProxyProvider
+	events chan ProviderEvent
+}
+
+func (provider *eventsProvider) EventHistory() []ProviderEvent {
+	return []ProviderEvent{
+		{Id: 1, Kind: EventProviderState, Old: "running", New: "pending", Reason: "ns1: " + ReasonZnodeDeleted},
+		{Id: 2, Kind: EventProviderState, Old: "pending", New: "running", Reason: "ns1: " + ReasonPollRecovered, PendingMs: 3000},
+	}
+}
+
+func (provider *eventsProvider) SubscribeEvents() ([]ProviderEvent, <-chan ProviderEvent, func()) {
+	return provider.EventHistory(), provider.events, func() {}
+}
+
+func TestStatesStreamHandler(t *testing.T) {
+	provider := &eventsProvider{events: make(chan ProviderEvent, 1)}
+	proxyServer := &ProxyServer{provider: provider}
+	httpServer := httptest.NewServer(http.HandlerFunc(proxyServer.StatesStreamHandler))
+	defer httpServer.Close()
+
+	// reconnecting after the first event, the second one is replayed before live ones
+	r, _ := http.NewRequest("GET", httpServer.URL, nil)
+	r.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal("TestStatesStreamHandler:", err.Error())
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	provider.events <- ProviderEvent{Id: 3, Kind: EventActiveNamenode, Nameservice: "ns1", Old: "nn1:9870", New: "nn2:9870", Reason: ReasonZnodeChanged}
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 6 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal("TestStatesStreamHandler:", err.Error())
+		}
+		// data lines are json events, told apart by their reasons
+		switch line = strings.TrimSpace(line); {
+		case len(line) == 0:
+		case strings.HasPrefix(line, "data: "):
+			event := ProviderEvent{}
+			assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+			lines = append(lines, event.Reason)
+		default:
+			lines = append(lines, line)
+		}
+	}
+	assert.Equal(t, []string{
+		"id: 2", "event: provider_state", "ns1: " + ReasonPollRecovered,
+		"id: 3", "event: active_namenode", ReasonZnodeChanged,
+	}, lines)
+
+	rw := httptest.NewRecorder()
+	proxyServer.StatesHistoryHandler(rw, httptest.NewRequest("GET", "/states/history", nil))
+	history := []ProviderEvent{}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &history))
+	assert.Equal(t, int64(3000), history[1].PendingMs)
+
+	rw = httptest.NewRecorder()
+	(&ProxyServer{provider: &mockHDFSProxyProvider{}}).StatesHistoryHandler(rw, httptest.NewRequest("GET", "/states/history", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+// healthProvider is alive but not ready
+type healthProvider struct {
+	ProxyProvider
+}
+
+func (provider *healthProvider) Healthy() error {
+	return nil
+}
+
+func (provider *healthProvider) Ready() error {
+	return fmt.Errorf("provider is pending, ns1 is pending")
+}
+
+func TestHealthHandlers(t *testing.T) {
+	proxyServer := &ProxyServer{provider: &healthProvider{}}
+	rw := httptest.NewRecorder()
+	proxyServer.HealthzHandler(rw, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, `{"healthy":true}`, rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	proxyServer.ReadyzHandler(rw, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, `{"ready":false,"reason":"provider is pending, ns1 is pending"}`, rw.Body.String())
+
+	// providers without health checks are ready while running
+	rw = httptest.NewRecorder()
+	(&ProxyServer{provider: &statsProvider{}}).ReadyzHandler(rw, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	rw = httptest.NewRecorder()
+	(&ProxyServer{provider: &mockHDFSProxyProvider{}}).ReadyzHandler(rw, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+}
+
+func TestQuotaThroughDatanodeGateway(t *testing.T) {
+	datanode := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer datanode.Close()
+	namenode := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/jmx" {
+			rw.Write([]byte(`{"beans":[{"name":"Hadoop:service=NameNode,name=NNStatus","State":"active"}]}`))
+			return
+		}
+		http.Redirect(rw, r, datanode.URL+r.URL.Path+"?op=CREATE&namenoderpcaddress=nn1:8020", http.StatusTemporaryRedirect)
+	}))
+	defer namenode.Close()
+
+	conf := ProxyConf{
+		GlobalConf: GlobalConf{
+			RetryAttempts:     1,
+			ResponseHoldLimit: 1024,
+			Quota:             middleware.QuotaConf{MaxUploadSize: 8},
+		},
+		ProxyProviderType: "hdfs",
+		ProxyProviderConf: ProviderConf{
+			HADetectionConfKey:           HADetectionHttp,
+			NamenodeHttpAddressesConfKey: strings.TrimPrefix(namenode.URL, "http://"),
+			ProbeIntervalConfKey:         60000,
+			MaxConnectionsConfKey:        16,
+			RequestTimeoutConfKey:        1000,
+		},
+	}
+	// without the gateway data would go to datanodes past the proxy
+	_, err := NewProxyServer(conf)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), DatanodeGatewayConfKey)
+
+	conf.ProxyProviderConf[DatanodeGatewayConfKey] = true
+	proxyServer, err := NewProxyServer(conf)
+	if err != nil {
+		t.Fatal("TestQuotaThroughDatanodeGateway:", err.Error())
+	}
+	httpServer := httptest.NewServer(negroni.New(proxyServer.quotaMiddleware, negroni.Wrap(http.HandlerFunc(proxyServer.DefaultHandler))))
+	defer httpServer.Close()
+
+	// the namenode answers CREATE with a redirect, which brings the data back to the proxy
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	create := func(target string, data string) *http.Response {
+		r, _ := http.NewRequest("PUT", target, strings.NewReader(data))
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal("TestQuotaThroughDatanodeGateway:", err.Error())
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := create(httpServer.URL+"/webhdfs/v1/tmp/a?op=CREATE", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	location := resp.Header.Get("Location")
+	assert.True(t, strings.HasPrefix(location, httpServer.URL+DatanodePathPrefix), location)
+
+	assert.Equal(t, http.StatusCreated, create(location, "0123").StatusCode)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, create(location, "0123456789").StatusCode)
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	readOnlyMiddleware, err := middleware.NewReadOnlyMiddleware(middleware.ReadOnlyConf{})
+	if err != nil {
+		t.Fatal("TestLegacyRoutes:", err.Error())
+	}
+	authMiddleware, err := middleware.NewAuthMiddleware(middleware.AuthConf{
+		Backends: []string{middleware.AuthBackendToken},
+		Tokens:   map[string]string{"admin-token": "root"},
+	})
+	if err != nil {
+		t.Fatal("TestLegacyRoutes:", err.Error())
+	}
+	matches := func(server *ProxyServer, method string, target string) bool {
+		router := mux.NewRouter()
+		server.legacyRoutes(router)
+		return router.Match(httptest.NewRequest(method, target, nil), &mux.RouteMatch{})
+	}
+
+	// without authentication anyone reaching the proxy could switch read-only mode, it is left to the admin listener
+	server := &ProxyServer{readOnlyMiddleware: readOnlyMiddleware}
+	assert.True(t, matches(server, "GET", "/states"))
+	assert.False(t, matches(server, "PUT", "/readonly"))
+
+	server.authMiddleware = authMiddleware
+	assert.True(t, matches(server, "PUT", "/readonly"))
+}
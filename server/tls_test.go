@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"active-proxy/middleware"
+	"active-proxy/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/negroni"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue signs a certificate of subject by ca, or a self signed ca if ca is nil
+func issue(t *testing.T, subject pkix.Name, serial int64, ca *testCert) *testCert {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, certFile string, keyFile string) {
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0644)
+	if len(keyFile) > 0 {
+		der, _ := x509.MarshalECPrivateKey(c.key)
+		ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem")
+	ca := issue(t, pkix.Name{CommonName: "test ca"}, 1, nil)
+	ca.write(t, caFile, "")
+	issue(t, pkix.Name{CommonName: "127.0.0.1"}, 2, ca).write(t, certFile, keyFile)
+
+	serverTLS, err := util.NewServerTLS(certFile, keyFile, caFile, "")
+	if err != nil {
+		t.Fatal("TestMutualTLS:", err.Error())
+	}
+	go serverTLS.Watch(50 * time.Millisecond)
+	auth, _ := middleware.NewAuthMiddleware(middleware.AuthConf{
+		Backends:           []string{middleware.AuthBackendCert},
+		CertSubjectPattern: "CN=([^,]+),OU=data",
+	})
+	proxyServer := httptest.NewUnstartedServer(negroni.New(auth, negroni.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.URL.Query().Get("user.name")))
+	}))))
+	proxyServer.TLS = serverTLS.Config()
+	proxyServer.StartTLS()
+	defer proxyServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(clientCert *testCert) (*http.Response, error) {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if clientCert != nil {
+			tlsConfig.Certificates = []tls.Certificate{clientCert.tlsCertificate()}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}}
+		return client.Get(proxyServer.URL + "/webhdfs/v1/tmp?op=LISTSTATUS&user.name=hdfs")
+	}
+
+	resp, err := get(issue(t, pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"data"}}, 3, ca))
+	if assert.Nil(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "alice", string(body))
+		assert.Equal(t, int64(2), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+	}
+	// client certificates are required, and must be issued by the client ca
+	_, err = get(nil)
+	assert.NotNil(t, err)
+	_, err = get(issue(t, pkix.Name{CommonName: "mallory", OrganizationalUnit: []string{"data"}}, 4, issue(t, pkix.Name{CommonName: "other ca"}, 5, nil)))
+	assert.NotNil(t, err)
+	// subjects out of the pattern are refused
+	resp, err = get(issue(t, pkix.Name{CommonName: "bob", OrganizationalUnit: []string{"web"}}, 6, ca))
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// a renewed certificate is served without restart
+	time.Sleep(20 * time.Millisecond)
+	issue(t, pkix.Name{CommonName: "127.0.0.1"}, 7, ca).write(t, certFile, keyFile)
+	time.Sleep(200 * time.Millisecond)
+	resp, err = get(issue(t, pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"data"}}, 8, ca))
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, int64(7), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+	}
+}
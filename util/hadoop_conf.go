@@ -0,0 +1,34 @@
+package util
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"strings"
+)
+
+type hadoopConfiguration struct {
+	Properties []struct {
+		Name  string `xml:"name"`
+		Value string `xml:"value"`
+	} `xml:"property"`
+}
+
+// LoadHadoopConf reads hadoop style xml configuration files (core-site.xml, hdfs-site.xml, mounttable.xml...),
+// properties in latter files override those in former ones
+func LoadHadoopConf(files ...string) (map[string]string, error) {
+	properties := make(map[string]string)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		conf := &hadoopConfiguration{}
+		if err := xml.Unmarshal(data, conf); err != nil {
+			return nil, err
+		}
+		for _, property := range conf.Properties {
+			properties[strings.TrimSpace(property.Name)] = strings.TrimSpace(property.Value)
+		}
+	}
+	return properties, nil
+}
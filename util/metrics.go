@@ -0,0 +1,71 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MetricsWriter writes metrics in the prometheus text exposition format (version 0.0.4)
+type MetricsWriter struct {
+	w io.Writer
+}
+
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func NewMetricsWriter(w io.Writer) *MetricsWriter {
+	return &MetricsWriter{w: w}
+}
+
+// Header starts the samples of metric name, metricType is counter, gauge or histogram
+func (metrics *MetricsWriter) Header(name string, metricType string, help string) {
+	fmt.Fprintf(metrics.w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(help), name, metricType)
+}
+
+// Sample writes one sample of name, labels are label names followed by their values
+func (metrics *MetricsWriter) Sample(name string, value float64, labels ...string) {
+	var builder strings.Builder
+	builder.WriteString(name)
+	if len(labels) > 1 {
+		builder.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				builder.WriteString(",")
+			}
+			builder.WriteString(labels[i])
+			builder.WriteString(`="`)
+			builder.WriteString(labelValueEscaper.Replace(labels[i+1]))
+			builder.WriteString(`"`)
+		}
+		builder.WriteString("}")
+	}
+	builder.WriteString(" ")
+	builder.WriteString(FormatMetricValue(value))
+	builder.WriteString("\n")
+	io.WriteString(metrics.w, builder.String())
+}
+
+var labelValueEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+// FormatMetricValue formats value as prometheus does, +Inf for bucket bounds included
+func FormatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// BoolMetric is 1 for true, 0 for false
+func BoolMetric(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
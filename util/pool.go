@@ -4,55 +4,123 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync/atomic"
+
+	"github.com/golang/glog"
 )
 
 type ProxyTask struct {
-	RespChan       chan bool
+	RespChan       chan error
 	target         string
 	request        *http.Request
 	responseWriter http.ResponseWriter
 }
 
 type ProxyTaskPoolInterface interface {
-	Push(string, http.ResponseWriter, *http.Request) <-chan bool
+	Push(string, http.ResponseWriter, *http.Request) <-chan error
 	Do()
+	Stats() ProxyTaskPoolStats
+}
+
+// ProxyTaskPoolStats counts tasks waiting to be proxied and tasks being proxied
+type ProxyTaskPoolStats struct {
+	Queued   int64
+	InFlight int64
+}
+
+// RetryableError is returned by response modifiers for upstream responses which should be retried elsewhere,
+// nothing is written to the client then
+type RetryableError struct {
+	Reason string
+}
+
+func (err *RetryableError) Error() string {
+	return err.Reason
 }
 
 type ProxyTaskPool struct {
 	taskChan chan ProxyTask // accept task
 	doChan   chan int       // limit task numbers
 
-	LimitTaskNum int
+	LimitTaskNum   int
+	modifyResponse func(*http.Response) error
+	transport      http.RoundTripper
+
+	queued   int64 `description:"pushed tasks not started yet, accessed atomically"`
+	inFlight int64 `description:"started tasks not finished yet, accessed atomically"`
+}
+
+// ProxyTaskPoolOption customizes the reverse proxy serving tasks
+type ProxyTaskPoolOption func(pool *ProxyTaskPool)
+
+// WithResponseModifier lets modifier inspect or change upstream responses before they are copied to clients,
+// a RetryableError from modifier is passed back to the pusher of the task
+func WithResponseModifier(modifier func(*http.Response) error) ProxyTaskPoolOption {
+	return func(pool *ProxyTaskPool) {
+		pool.modifyResponse = modifier
+	}
 }
 
-func NewProxyTaskPool(maxTaskNum int) (ProxyTaskPoolInterface, error) {
+// WithTransport sends upstream requests through transport instead of http.DefaultTransport,
+// e.g. one configured with tls client settings
+func WithTransport(transport http.RoundTripper) ProxyTaskPoolOption {
+	return func(pool *ProxyTaskPool) {
+		pool.transport = transport
+	}
+}
+
+func NewProxyTaskPool(maxTaskNum int, options ...ProxyTaskPoolOption) (ProxyTaskPoolInterface, error) {
 	pool := &ProxyTaskPool{LimitTaskNum: maxTaskNum}
 	pool.taskChan = make(chan ProxyTask, maxTaskNum)
 	pool.doChan = make(chan int, maxTaskNum)
+	for _, option := range options {
+		option(pool)
+	}
 	return pool, nil
 }
 
-func (pool *ProxyTaskPool) Push(target string, rw http.ResponseWriter, r *http.Request) <-chan bool {
+func (pool *ProxyTaskPool) Push(target string, rw http.ResponseWriter, r *http.Request) <-chan error {
 	task := ProxyTask{
-		RespChan:       make(chan bool),
+		// buffered, since pusher may have given up waiting
+		RespChan:       make(chan error, 1),
 		target:         target,
 		request:        r,
 		responseWriter: rw,
 	}
+	atomic.AddInt64(&pool.queued, 1)
 	pool.doChan <- 1
 	pool.taskChan <- task
 	return task.RespChan
 }
 
+func (pool *ProxyTaskPool) Stats() ProxyTaskPoolStats {
+	return ProxyTaskPoolStats{Queued: atomic.LoadInt64(&pool.queued), InFlight: atomic.LoadInt64(&pool.inFlight)}
+}
+
 func (pool *ProxyTaskPool) Do() {
 	for {
 		task := <-pool.taskChan
+		atomic.AddInt64(&pool.queued, -1)
+		atomic.AddInt64(&pool.inFlight, 1)
 		go func(task ProxyTask) {
 			targetUrl, _ := url.Parse(task.target)
 			reverseProxy := httputil.NewSingleHostReverseProxy(targetUrl)
+			reverseProxy.ModifyResponse = pool.modifyResponse
+			if pool.transport != nil {
+				reverseProxy.Transport = pool.transport
+			}
+			var proxyErr error
+			reverseProxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, err error) {
+				proxyErr = err
+				if _, ok := err.(*RetryableError); !ok {
+					glog.V(1).Infof("Proxy %s to %s fails: %s", r.URL.String(), task.target, err.Error())
+					rw.WriteHeader(http.StatusBadGateway)
+				}
+			}
 			reverseProxy.ServeHTTP(task.responseWriter, task.request)
+			atomic.AddInt64(&pool.inFlight, -1)
 			<-pool.doChan
-			task.RespChan <- true
+			task.RespChan <- proxyErr
 		}(task)
 	}
 }
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"context"
+	"net/http"
+)
+
+// Principal is the authenticated identity of an inbound request
+type Principal struct {
+	Name      string   `description:"name as authenticated, e.g. alice/host@EXAMPLE.COM"`
+	User      string   `description:"hadoop user name acted as upstream, e.g. alice"`
+	Groups    []string `description:"groups given by authentication, e.g. groups claim of jwt"`
+	Mechanism string   `description:"authentication backend, token, basic, jwt, spnego or cert"`
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a shallow copy of r carrying principal, which is recorded in RequestInfo of r as well
+func WithPrincipal(r *http.Request, principal *Principal) *http.Request {
+	if info := RequestInfoOf(r); info != nil {
+		info.Principal = principal
+	}
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+}
+
+// RequestPrincipal returns the principal of r, or nil if r is not authenticated
+func RequestPrincipal(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
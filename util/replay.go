@@ -0,0 +1,102 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// ReplayableBody holds a request body so that it can be sent again on every attempt:
+// up to memoryLimit bytes are kept in memory, up to spoolLimit more bytes are spooled to a temp file,
+// and the rest (if any) is streamed from the original body, which makes the body replayable until it is touched
+type ReplayableBody struct {
+	memory    []byte
+	spool     *os.File
+	spoolSize int64
+	rest      io.ReadCloser
+
+	mutex        sync.Mutex
+	restConsumed bool
+}
+
+func NewReplayableBody(body io.ReadCloser, memoryLimit int64, spoolLimit int64, spoolDir string) (*ReplayableBody, error) {
+	replayable := &ReplayableBody{}
+	memory, err := ioutil.ReadAll(io.LimitReader(body, memoryLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(memory)) <= memoryLimit {
+		replayable.memory = memory
+		body.Close()
+		return replayable, nil
+	}
+	replayable.memory = memory[:memoryLimit]
+	overflow := io.MultiReader(bytes.NewReader(memory[memoryLimit:]), body)
+
+	if spoolLimit > 0 {
+		if replayable.spool, err = ioutil.TempFile(spoolDir, "acproxy-body-"); err != nil {
+			return nil, err
+		}
+		if replayable.spoolSize, err = io.CopyN(replayable.spool, overflow, spoolLimit); err == io.EOF {
+			body.Close()
+			return replayable, nil
+		} else if err != nil {
+			replayable.Close()
+			return nil, err
+		}
+	}
+	replayable.rest = struct {
+		io.Reader
+		io.Closer
+	}{overflow, body}
+	return replayable, nil
+}
+
+// Replayable tells whether another attempt can still get the whole body
+func (body *ReplayableBody) Replayable() bool {
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	return body.rest == nil || !body.restConsumed
+}
+
+// Size returns the number of bytes held, which is the whole body if it is fully held
+func (body *ReplayableBody) Size() int64 {
+	return int64(len(body.memory)) + body.spoolSize
+}
+
+// Reader starts the body from the beginning for a new attempt
+func (body *ReplayableBody) Reader() io.ReadCloser {
+	readers := []io.Reader{bytes.NewReader(body.memory)}
+	if body.spool != nil {
+		readers = append(readers, io.NewSectionReader(body.spool, 0, body.spoolSize))
+	}
+	if body.rest != nil {
+		readers = append(readers, &restReader{body})
+	}
+	return ioutil.NopCloser(io.MultiReader(readers...))
+}
+
+// Close releases the spool file and the original body
+func (body *ReplayableBody) Close() error {
+	if body.rest != nil {
+		body.rest.Close()
+	}
+	if body.spool != nil {
+		body.spool.Close()
+		return os.Remove(body.spool.Name())
+	}
+	return nil
+}
+
+type restReader struct {
+	body *ReplayableBody
+}
+
+func (reader *restReader) Read(p []byte) (int, error) {
+	reader.body.mutex.Lock()
+	reader.body.restConsumed = true
+	reader.body.mutex.Unlock()
+	return reader.body.rest.Read(p)
+}
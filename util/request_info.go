@@ -0,0 +1,67 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIdHeader carries the id of a request, taken from the client if it sends one and answered in the response
+const RequestIdHeader = "X-Request-Id"
+
+// longer or unprintable ids from clients are replaced, they end up in logs and statistics
+const requestIdMaxLength = 128
+
+// RequestInfo collects what the layers of the proxy learn about one inbound request, e.g. for audit;
+// it is filled by the goroutine serving the request only
+type RequestInfo struct {
+	Id        string
+	Principal *Principal `description:"set by authentication, nil if not authenticated"`
+	Upstream  string     `description:"host:port of the namenode or datanode of the last attempt"`
+	Attempts  int
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a shallow copy of r carrying a new RequestInfo, or r itself if it carries one already,
+// so that every layer collecting RequestInfo shares the same
+func WithRequestInfo(r *http.Request) (*http.Request, *RequestInfo) {
+	if info := RequestInfoOf(r); info != nil {
+		return r, info
+	}
+	info := &RequestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// RequestInfoOf returns the RequestInfo of r, or nil if nobody collects it
+func RequestInfoOf(r *http.Request) *RequestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// SetUpstream records where r is sent, it does nothing if nobody collects RequestInfo
+func SetUpstream(r *http.Request, upstream string) {
+	if info := RequestInfoOf(r); info != nil {
+		info.Upstream = upstream
+	}
+}
+
+// RequestId returns the X-Request-Id of r if it is sane, or a new random id
+func RequestId(r *http.Request) string {
+	if id := r.Header.Get(RequestIdHeader); len(id) > 0 && len(id) <= requestIdMaxLength && isPrintable(id) {
+		return id
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func isPrintable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// ErrAbandonedResponse is returned to writers of an attempt given up by the proxy
+var ErrAbandonedResponse = errors.New("response of abandoned attempt")
+
+// DeferredResponseWriter holds back the response of one attempt until the proxy decides to keep it (Commit)
+// or to retry (Abandon); a response larger than holdLimit is committed once it outgrows the limit
+type DeferredResponseWriter struct {
+	rw         http.ResponseWriter
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+	holdLimit  int
+
+	mutex     sync.Mutex
+	committed bool
+	abandoned bool
+}
+
+func NewDeferredResponseWriter(rw http.ResponseWriter, holdLimit int) *DeferredResponseWriter {
+	return &DeferredResponseWriter{rw: rw, header: make(http.Header), holdLimit: holdLimit}
+}
+
+func (w *DeferredResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *DeferredResponseWriter) WriteHeader(statusCode int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *DeferredResponseWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.abandoned {
+		return 0, ErrAbandonedResponse
+	}
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	if w.committed {
+		return w.rw.Write(p)
+	}
+	w.body.Write(p)
+	if w.body.Len() > w.holdLimit {
+		w.commit()
+	}
+	return len(p), nil
+}
+
+// Flush passes through only after commit, since held responses must not reach the client
+func (w *DeferredResponseWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.committed && !w.abandoned {
+		if flusher, ok := w.rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// Commit sends the held response to the client, later writes go straight through
+func (w *DeferredResponseWriter) Commit() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.committed && !w.abandoned {
+		w.commit()
+	}
+}
+
+func (w *DeferredResponseWriter) commit() {
+	w.committed = true
+	if w.statusCode == 0 {
+		return
+	}
+	header := w.rw.Header()
+	for key, values := range w.header {
+		header[key] = values
+	}
+	w.rw.WriteHeader(w.statusCode)
+	w.rw.Write(w.body.Bytes())
+	w.body.Reset()
+}
+
+// Abandon drops the held response and fails later writes,
+// it returns true if part of the response has already reached the client
+func (w *DeferredResponseWriter) Abandon() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.abandoned = true
+	w.body.Reset()
+	return w.committed
+}
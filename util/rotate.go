@@ -0,0 +1,117 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const rotatedTimeFormat = "20060102-150405.000"
+
+// RotatingFile appends to a file under dir, which is renamed to <name>.<time> once it outgrows maxSize
+// or has been written for interval (either check is off if 0); only the newest maxBackups rotated files
+// are kept, or all of them if maxBackups is 0
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewRotatingFile(dir string, name string, maxSize int64, interval time.Duration, maxBackups int) (*RotatingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f := &RotatingFile{path: filepath.Join(dir, name), maxSize: maxSize, interval: interval, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write never splits p across files, so that a record written at once stays in one file
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := time.Now()
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) || (f.interval > 0 && now.Sub(f.opened) >= f.interval)) {
+		if err := f.rotate(now); err != nil {
+			// keep writing to the current file rather than losing records
+			glog.Errorf("Rotate %s fails: %s", f.path, err.Error())
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) rotate(now time.Time) error {
+	f.file.Close()
+	f.file = nil
+	rotated := f.path + "." + now.Format(rotatedTimeFormat)
+	// files rotated within the same millisecond get a sequence number
+	for i := 1; fileExists(rotated); i++ {
+		rotated = fmt.Sprintf("%s.%s.%d", f.path, now.Format(rotatedTimeFormat), i)
+	}
+	renameErr := os.Rename(f.path, rotated)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	if f.maxBackups > 0 {
+		// rotated names sort by time
+		backups, _ := filepath.Glob(f.path + ".*")
+		sort.Strings(backups)
+		for len(backups) > f.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,165 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// NewClientTLSConfig builds the tls configuration of upstream connections: servers are verified against the
+// pem bundle caFile (system roots if empty), certFile and keyFile give the client certificate (none if empty),
+// and serverName overrides the name verified in server certificates (host of the url if empty)
+func NewClientTLSConfig(caFile string, certFile string, keyFile string, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName}
+	if len(caFile) > 0 {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate is found in %s", caFile)
+		}
+	}
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// ServerTLS serves the certificate and client ca bundle read from files, and reads them again once they change,
+// so that renewed certificates are served without a restart
+type ServerTLS struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+
+	mutex     sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// NewServerTLS verifies client certificates against clientCAFile (if given) as clientAuth asks:
+// none, optional (verified if presented) or require, which is the default with a client ca
+func NewServerTLS(certFile string, keyFile string, clientCAFile string, clientAuth string) (*ServerTLS, error) {
+	s := &ServerTLS{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile, modTimes: make(map[string]time.Time)}
+	switch {
+	case len(clientCAFile) == 0 || clientAuth == ClientAuthNone:
+		s.clientAuth = tls.NoClientCert
+	case clientAuth == ClientAuthOptional:
+		s.clientAuth = tls.VerifyClientCertIfGiven
+	case clientAuth == ClientAuthRequire || len(clientAuth) == 0:
+		s.clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client auth %s, expect %s, %s or %s", clientAuth, ClientAuthNone, ClientAuthOptional, ClientAuthRequire)
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ServerTLS) files() []string {
+	files := []string{s.certFile, s.keyFile}
+	if len(s.clientCAFile) > 0 {
+		files = append(files, s.clientCAFile)
+	}
+	return files
+}
+
+// changed tells whether any file is modified since last reload
+func (s *ServerTLS) changed() bool {
+	for _, file := range s.files() {
+		if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(s.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ServerTLS) reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range s.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if len(s.clientCAFile) > 0 {
+		data, err := ioutil.ReadFile(s.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate is found in %s", s.clientCAFile)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cert = &cert
+	s.clientCAs = clientCAs
+	s.modTimes = modTimes
+	return nil
+}
+
+// Watch reloads files changed on disk every interval, a failed reload keeps serving the former ones
+func (s *ServerTLS) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !s.changed() {
+			continue
+		}
+		if err := s.reload(); err != nil {
+			glog.Errorf("Reload tls certificate %s fails, keep the former one: %s", s.certFile, err.Error())
+			continue
+		}
+		glog.V(1).Infof("Tls certificate %s is reloaded.", s.certFile)
+	}
+}
+
+// Config is the tls configuration of the listener, every handshake takes the latest certificate and client cas
+func (s *ServerTLS) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			s.mutex.RLock()
+			defer s.mutex.RUnlock()
+			return s.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mutex.RLock()
+			defer s.mutex.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+				ClientCAs:    s.clientCAs,
+				ClientAuth:   s.clientAuth,
+			}, nil
+		},
+	}
+}
@@ -0,0 +1,161 @@
+package util
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const WebHdfsPathPrefix = "/webhdfs/v1"
+
+// webhdfs operations which change the namespace or data, keyed by upper case op
+var webHdfsMutatingOps = map[string]bool{
+	// PUT
+	"CREATE":                true,
+	"MKDIRS":                true,
+	"CREATESYMLINK":         true,
+	"RENAME":                true,
+	"SETREPLICATION":        true,
+	"SETOWNER":              true,
+	"SETPERMISSION":         true,
+	"SETTIMES":              true,
+	"RENEWDELEGATIONTOKEN":  true,
+	"CANCELDELEGATIONTOKEN": true,
+	"CREATESNAPSHOT":        true,
+	"RENAMESNAPSHOT":        true,
+	"SETXATTR":              true,
+	"REMOVEXATTR":           true,
+	"SETACL":                true,
+	"MODIFYACLENTRIES":      true,
+	"REMOVEACLENTRIES":      true,
+	"REMOVEDEFAULTACL":      true,
+	"REMOVEACL":             true,
+	"SETSTORAGEPOLICY":      true,
+	"SATISFYSTORAGEPOLICY":  true,
+	"ENABLEECPOLICY":        true,
+	"DISABLEECPOLICY":       true,
+	"SETECPOLICY":           true,
+	"ALLOWSNAPSHOT":         true,
+	"DISALLOWSNAPSHOT":      true,
+	// POST
+	"APPEND":             true,
+	"CONCAT":             true,
+	"TRUNCATE":           true,
+	"UNSETSTORAGEPOLICY": true,
+	"UNSETECPOLICY":      true,
+	// DELETE
+	"DELETE":         true,
+	"DELETESNAPSHOT": true,
+}
+
+// webhdfs operations which only read, keyed by upper case op
+var webHdfsReadOps = map[string]bool{
+	// GET
+	"OPEN":                          true,
+	"GETFILESTATUS":                 true,
+	"LISTSTATUS":                    true,
+	"LISTSTATUS_BATCH":              true,
+	"GETCONTENTSUMMARY":             true,
+	"GETQUOTAUSAGE":                 true,
+	"GETFILECHECKSUM":               true,
+	"GETHOMEDIRECTORY":              true,
+	"GETDELEGATIONTOKEN":            true,
+	"GETTRASHROOT":                  true,
+	"GETXATTRS":                     true,
+	"LISTXATTRS":                    true,
+	"GETACLSTATUS":                  true,
+	"CHECKACCESS":                   true,
+	"GETALLSTORAGEPOLICY":           true,
+	"GETSTORAGEPOLICY":              true,
+	"GETSNAPSHOTDIFF":               true,
+	"GETSNAPSHOTTABLEDIRECTORYLIST": true,
+	"GETFILEBLOCKLOCATIONS":         true,
+	"GET_BLOCK_LOCATIONS":           true,
+	"GETSERVERDEFAULTS":             true,
+	"GETECPOLICY":                   true,
+	"GETSTATUS":                     true,
+}
+
+// IsWebHdfsOp tells whether op is a known upper case webhdfs op, e.g. to keep metric labels bounded
+func IsWebHdfsOp(op string) bool {
+	return webHdfsMutatingOps[op] || webHdfsReadOps[op]
+}
+
+// WebHdfsOp returns the upper case op parameter of a webhdfs request, or "" for other requests
+func WebHdfsOp(r *http.Request) string {
+	if r.URL == nil || !strings.HasPrefix(r.URL.Path, WebHdfsPathPrefix) {
+		return ""
+	}
+	return strings.ToUpper(r.URL.Query().Get("op"))
+}
+
+// WebHdfsPath returns the hdfs path of a webhdfs request, or "" for other requests
+func WebHdfsPath(r *http.Request) string {
+	if r.URL == nil || !strings.HasPrefix(r.URL.Path, WebHdfsPathPrefix) {
+		return ""
+	}
+	hdfsPath := strings.TrimPrefix(r.URL.Path, WebHdfsPathPrefix)
+	if len(hdfsPath) == 0 {
+		return "/"
+	}
+	return hdfsPath
+}
+
+// WebHdfsUser returns the user a webhdfs request acts as, doas or user.name, or "" if neither is given
+func WebHdfsUser(r *http.Request) string {
+	if r.URL == nil {
+		return ""
+	}
+	query := r.URL.Query()
+	if user := query.Get("doas"); len(user) > 0 {
+		return user
+	}
+	return query.Get("user.name")
+}
+
+// IsMutatingOp tells whether a webhdfs op changes the namespace or data,
+// unknown ops are judged by http method since webhdfs reads are all GET
+func IsMutatingOp(method string, op string) bool {
+	if mutating, ok := webHdfsMutatingOps[op]; ok {
+		return mutating
+	}
+	return method != http.MethodGet && method != http.MethodHead
+}
+
+// ClientAddress returns the ip of the peer sending r
+func ClientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RemoteException is the json error body of webhdfs, {"RemoteException": {...}}
+type RemoteException struct {
+	Exception     string `json:"exception"`
+	JavaClassName string `json:"javaClassName"`
+	Message       string `json:"message"`
+}
+
+type remoteExceptionBody struct {
+	RemoteException *RemoteException `json:"RemoteException"`
+}
+
+// WriteRemoteException answers like webhdfs does for exceptions, so that clients surface them as usual
+func WriteRemoteException(rw http.ResponseWriter, statusCode int, exception *RemoteException) {
+	data, _ := json.Marshal(&remoteExceptionBody{RemoteException: exception})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rw.Write(data)
+}
+
+// ParseRemoteException returns nil if data is not a webhdfs RemoteException
+func ParseRemoteException(data []byte) *RemoteException {
+	body := &remoteExceptionBody{}
+	if err := json.Unmarshal(data, body); err != nil || body.RemoteException == nil {
+		return nil
+	}
+	return body.RemoteException
+}